@@ -0,0 +1,138 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"time"
+
+	"github.com/cilium/ebpf"
+	bpf "github.com/iovisor/gobpf/bcc"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/overhead"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sys/unix"
+)
+
+// maxSamplingRatio bounds the subsampling, at least 1 event out of it being recorded
+const maxSamplingRatio = 1024
+
+var (
+	samplingRatio = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bcc_stacktrace_sampling_ratio",
+		Help: "One event out of this many is recorded to keep the overhead within -max-overhead.",
+	})
+	overheadRatio = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "bcc_stacktrace_overhead_ratio",
+		Help: "Fraction of the cpu time of the host spent profiling over the last interval, by the profiler and its bpf programs.",
+	})
+)
+
+// overheadMeter measures the cpu time spent profiling: by the profiler itself, and by its
+// bpf programs when the kernel accounts their run time (5.8+)
+type overheadMeter struct {
+	progs []*ebpf.Program
+	// stats keeps the run time of the programs accounted while profiling
+	stats io.Closer
+
+	last   time.Duration
+	lastAt time.Time
+}
+
+// newOverheadMeter measures the run time of the programs loaded with the fds
+func newOverheadMeter(fds []int) *overheadMeter {
+	m := &overheadMeter{}
+	stats, err := ebpf.EnableStats(uint32(unix.BPF_STATS_RUN_TIME))
+	if err != nil {
+		log.Printf("Failed to enable bpf stats, only the cpu time of the profiler is accounted: %v", err)
+	} else {
+		m.stats = stats
+		for _, fd := range fds {
+			// The program owns the fd it is given, bcc keeps its own
+			dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+			if err != nil {
+				log.Printf("Failed to duplicate program fd: %v", err)
+				continue
+			}
+			prog, err := ebpf.NewProgramFromFD(dup)
+			if err != nil {
+				log.Printf("Failed to open program: %v", err)
+				continue
+			}
+			m.progs = append(m.progs, prog)
+		}
+	}
+	m.last, m.lastAt = m.cost(), time.Now()
+	return m
+}
+
+// cost is the cpu time spent profiling so far
+func (m *overheadMeter) cost() time.Duration {
+	cost := time.Duration(cpuSeconds() * float64(time.Second))
+	for _, prog := range m.progs {
+		info, err := prog.Info()
+		if err != nil {
+			continue
+		}
+		if run, ok := info.Runtime(); ok {
+			cost += run
+		}
+	}
+	return cost
+}
+
+// measure returns the fraction of the cpu time of the host spent profiling since the
+// previous measure
+func (m *overheadMeter) measure() float64 {
+	cost, now := m.cost(), time.Now()
+	elapsed := now.Sub(m.lastAt)
+	spent := cost - m.last
+	m.last, m.lastAt = cost, now
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(spent) / (float64(elapsed) * float64(runtime.NumCPU()))
+}
+
+// followOverhead adjusts the subsampling ratio of stack_trace.c every interval, for the
+// programs loaded with the fds to take at most budget of the cpu time of the host along
+// with the profiler
+func followOverhead(m *bpf.Module, fds []int, budget float64, interval time.Duration) error {
+	sampling := bpf.NewTable(m.TableId("sampling"), m)
+	set := func(ratio uint32) error {
+		value := make([]byte, 4)
+		bpfmap.NativeEndian.PutUint32(value, ratio)
+		if err := sampling.Set(make([]byte, 4), value); err != nil {
+			return fmt.Errorf("setting sampling ratio: %w", err)
+		}
+		samplingRatio.Set(float64(ratio))
+		return nil
+	}
+	c := overhead.NewController(budget, maxSamplingRatio)
+	if err := set(c.Ratio()); err != nil {
+		return err
+	}
+
+	meter := newOverheadMeter(fds)
+	go func() {
+		for range time.Tick(interval) {
+			o := meter.measure()
+			overheadRatio.Set(o)
+			prev := c.Ratio()
+			ratio := c.Update(o)
+			if ratio == prev {
+				continue
+			}
+			log.Printf("Overhead %.2f%% of the cpu time, recording 1 event out of %d", o*100, ratio)
+			if err := set(ratio); err != nil {
+				log.Printf("Failed to adjust sampling: %v", err)
+			}
+		}
+	}()
+	return nil
+}
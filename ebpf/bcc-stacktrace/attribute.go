@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/k8s"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+)
+
+// attributedSource labels the samples of a source with their cgroup, pod and container
+type attributedSource struct {
+	sampleSource
+	attributor *k8s.Attributor
+	// checkCPU flags the samples taken outside of the cpuset of their container, the
+	// samples must then have their cpu
+	checkCPU bool
+}
+
+// withAttribution returns the source as is when samples are not attributed
+func withAttribution(src sampleSource, attributor *k8s.Attributor, checkCPU bool) sampleSource {
+	if attributor == nil {
+		return src
+	}
+	return &attributedSource{src, attributor, checkCPU}
+}
+
+func (s *attributedSource) drain() []pprof.Sample {
+	samples := s.sampleSource.drain()
+	for i := range samples {
+		labels := s.attributor.Labels(samples[i].CgroupId)
+		if s.checkCPU && s.attributor.OutsideCPUSet(samples[i].CgroupId, samples[i].Cpu) {
+			// The labels are shared by the samples of the cgroup
+			flagged := map[string]string{"outside_cpuset": "true"}
+			for k, v := range labels {
+				flagged[k] = v
+			}
+			labels = flagged
+		}
+		samples[i].Labels = labels
+	}
+	return samples
+}
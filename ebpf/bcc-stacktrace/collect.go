@@ -0,0 +1,414 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	bpf "github.com/iovisor/gobpf/bcc"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/replay"
+	"golang.org/x/sys/unix"
+)
+
+// errorNames are the reasons samples or their stacks are lost, in the order of enum error_t
+// in stack_trace.c and off_cpu.c
+var errorNames = []string{
+	"kernel stack collision",
+	"kernel stack fault",
+	"kernel stack map full",
+	"kernel stack other",
+	"user stack collision",
+	"user stack fault",
+	"user stack map full",
+	"user stack other",
+	"counts map full",
+	"events lost",
+	"set flipped twice",
+	"blocked map full",
+}
+
+// errEventsLost is the index of the streamed samples which could not be sent in errorNames
+const errEventsLost = 9
+
+// bpfErrors exposes the error counters since start on /debug/vars
+var bpfErrors = expvar.NewMap("bpf_errors")
+
+// highWaterPoll is how often the occupancy of the counts map is checked
+const highWaterPoll = 100 * time.Millisecond
+
+// idlePoll and idleTimeout are how often and how long a drain polls for the programs
+// still writing to the set it flipped from. They run to completion in microseconds.
+const (
+	idlePoll    = 100 * time.Microsecond
+	idleTimeout = 100 * time.Millisecond
+)
+
+// bpfTables are the maps shared by the bpf programs and the profiler. Samples are
+// recorded in one of two sets of counts/stackmap tables, the active table telling which.
+type bpfTables struct {
+	counts   [2]*bpf.Table
+	stackmap [2]*bpf.Table
+	active   *bpf.Table
+	errors   *bpf.Table
+	// occupancy counts the entries added to the counts map of each set
+	occupancy *bpf.Table
+	// inflight counts the programs writing to each set
+	inflight *bpf.Table
+	// blocked holds the tasks switched out by off_cpu.c, whose stacks must be kept
+	blocked *bpf.Table
+
+	// Index of the set the programs currently write to
+	current int
+	// separateDelete is set on kernels which can't look up and delete hash map entries
+	// at once, before 5.14
+	separateDelete bool
+	// Error counters as of the previous read
+	lastErrors []uint64
+
+	// mu serializes the drains, the early ones included
+	mu sync.Mutex
+	// Samples drained early, before the end of the interval
+	pending []pprof.Sample
+	// snapshot collects the raw entries drained when recording
+	snapshot *replay.Snapshot
+}
+
+func newTables(m *bpf.Module) *bpfTables {
+	return &bpfTables{
+		counts:     [2]*bpf.Table{bpf.NewTable(m.TableId("counts_0"), m), bpf.NewTable(m.TableId("counts_1"), m)},
+		stackmap:   [2]*bpf.Table{bpf.NewTable(m.TableId("stackmap_0"), m), bpf.NewTable(m.TableId("stackmap_1"), m)},
+		active:     bpf.NewTable(m.TableId("active"), m),
+		errors:     bpf.NewTable(m.TableId("errors"), m),
+		occupancy:  bpf.NewTable(m.TableId("occupancy"), m),
+		inflight:   bpf.NewTable(m.TableId("inflight"), m),
+		lastErrors: make([]uint64, len(errorNames)),
+	}
+}
+
+// flip makes the programs record into the other set of tables, and returns the index of
+// the set they were writing to
+func (t *bpfTables) flip() (int, error) {
+	prev := t.current
+	next := make([]byte, 4)
+	bpfmap.NativeEndian.PutUint32(next, uint32(1-prev))
+	if err := t.active.Set(make([]byte, 4), next); err != nil {
+		return 0, err
+	}
+	t.current = 1 - prev
+	return prev, nil
+}
+
+// take reads and removes the entry of the counts map of the set at once. off_cpu.c keeps
+// adding to the set the blocks of the tasks switched out before the flip: what it adds
+// once the entry is taken goes to a new entry, drained with the set the next time.
+func (t *bpfTables) take(buf int, key []byte) ([]byte, error) {
+	table := t.counts[buf]
+	if !t.separateDelete {
+		value, err := lookupAndDelete(table, key)
+		if err == nil || !(errors.Is(err, unix.EINVAL) || errors.Is(err, errENOTSUPP)) {
+			return value, err
+		}
+		log.Printf("Failed to look up and delete counts entries at once, reading and deleting them apart: %v", err)
+		t.separateDelete = true
+	}
+	value, err := table.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return value, table.Delete(key)
+}
+
+// errENOTSUPP is the error of the commands a map does not support, not in unix
+const errENOTSUPP = syscall.Errno(524)
+
+// lookupAndDelete runs BPF_MAP_LOOKUP_AND_DELETE_ELEM, which gobpf does not wrap
+func lookupAndDelete(table *bpf.Table, key []byte) ([]byte, error) {
+	config := table.Config()
+	value := make([]byte, config["leaf_size"].(uint64))
+	attr := struct {
+		MapFd uint32
+		_     uint32
+		Key   uint64
+		Value uint64
+		Flags uint64
+	}{
+		MapFd: uint32(config["fd"].(int)),
+		Key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		Value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+	}
+	_, _, errno := unix.Syscall(unix.SYS_BPF, unix.BPF_MAP_LOOKUP_AND_DELETE_ELEM, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	if errno != 0 {
+		return nil, errno
+	}
+	return value, nil
+}
+
+// drain returns the samples drained early since the previous drain, along with the ones
+// still in the tables
+func (t *bpfTables) drain() []pprof.Sample {
+	samples, _ := t.drainRecorded()
+	return samples
+}
+
+// drainRecorded drains the tables, also returning the raw entries of the samples when
+// recording
+func (t *bpfTables) drainRecorded() ([]pprof.Sample, *replay.Snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	samples := append(t.pending, t.drainSet()...)
+	t.pending = nil
+	s := t.snapshot
+	if s != nil {
+		t.snapshot = &replay.Snapshot{}
+	}
+	return samples, s
+}
+
+// record starts collecting the raw entries drained
+func (t *bpfTables) record() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.snapshot = &replay.Snapshot{}
+}
+
+// watch drains the tables early whenever the counts map being written to holds at least
+// highWater entries, checking it every interval. The samples are kept until the next drain.
+func (t *bpfTables) watch(highWater uint64, interval time.Duration) {
+	if highWater == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			n, err := t.occupied()
+			if err != nil {
+				log.Printf("Failed to read the occupancy of the counts map: %v", err)
+				continue
+			}
+			if n < highWater {
+				continue
+			}
+			log.Printf("Counts map holds %d entries, draining it early", n)
+			t.mu.Lock()
+			t.pending = append(t.pending, t.drainSet()...)
+			t.mu.Unlock()
+			earlyDrains.Inc()
+		}
+	}()
+}
+
+// occupied returns the number of entries of the counts map being written to
+func (t *bpfTables) occupied() (uint64, error) {
+	t.mu.Lock()
+	key := setKey(t.current)
+	t.mu.Unlock()
+	value, err := t.occupancy.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return bpfmap.NativeEndian.Uint64(value), nil
+}
+
+// setKey is the key of the entry of a set in the arrays indexed by set
+func setKey(buf int) []byte {
+	key := make([]byte, 4)
+	bpfmap.NativeEndian.PutUint32(key, uint32(buf))
+	return key
+}
+
+// waitIdle waits for the programs still writing to the set to be done
+func (t *bpfTables) waitIdle(buf int) {
+	inflight := func() (uint64, error) {
+		value, err := t.inflight.Get(setKey(buf))
+		if err != nil {
+			return 0, err
+		}
+		return bpfmap.NativeEndian.Uint64(value), nil
+	}
+	if err := bpfmap.WaitIdle(inflight, idlePoll, idleTimeout); err != nil {
+		log.Printf("Draining the bpf tables without waiting for the programs: %v", err)
+	}
+}
+
+// drainSet reads all the samples out of the counts/stackmap tables and cleans them. The
+// tables are flipped first, so that stack_trace.c stops writing to the set being read
+// once the programs which read the previous index are done, off_cpu.c still adding to
+// it, see take. Must be called with mu held.
+func (t *bpfTables) drainSet() []pprof.Sample {
+	buf, err := t.flip()
+	if err != nil {
+		// Leave the samples in the maps for the next drain
+		log.Printf("Failed to flip the bpf tables: %v", err)
+		return nil
+	}
+	t.waitIdle(buf)
+
+	stacks := map[string]bool{}
+	lookup := func(key []byte) ([]byte, error) {
+		value, err := t.stackmap[buf].Get(key)
+		if err == nil {
+			stacks[string(key)] = true
+			if t.snapshot != nil {
+				t.snapshot.Stacks = append(t.snapshot.Stacks, replay.Entry{Key: key, Value: value})
+			}
+		}
+		return value, err
+	}
+
+	// The keys are listed first, the entries being removed as they are read
+	var keys [][]byte
+	itCounts := t.counts[buf].Iter()
+	for itCounts.Next() {
+		keys = append(keys, append([]byte(nil), itCounts.Key()...))
+	}
+
+	// Each entry in counts map is a sample in pprof
+	var samples []pprof.Sample
+	for _, key := range keys {
+		value, err := t.take(buf, key)
+		if err != nil {
+			log.Printf("Failed to read counts table: %v", err)
+			continue
+		}
+		if t.snapshot != nil {
+			t.snapshot.Counts = append(t.snapshot.Counts, replay.Entry{Key: key, Value: value})
+		}
+		sample, err := bpfmap.Native.DecodeSample(key, value, lookup)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+
+		samples = append(samples, sample)
+		samplesCollected.Add(float64(sample.Count))
+	}
+	mapEntries.WithLabelValues("counts").Set(float64(len(keys)))
+	mapEntries.WithLabelValues("stackmap").Set(float64(len(stacks)))
+
+	t.cleanStacks(buf)
+	if err := t.occupancy.Set(setKey(buf), make([]byte, 8)); err != nil {
+		log.Printf("Failed to reset the occupancy of the counts map: %v", err)
+	}
+	return samples
+}
+
+// cleanStacks empties the stackmap of the set, except for the stacks of the tasks which
+// are still blocked: their time is counted in the set when they are switched back in.
+// The stacks of the counts added since the drain listed them are kept as well, the tasks
+// switched in meanwhile not being in blocked anymore.
+func (t *bpfTables) cleanStacks(buf int) {
+	keep := t.blockedStacks(buf)
+	if t.blocked != nil {
+		// Switch-ins are counted until they added their counts, once out of blocked
+		t.waitIdle(buf)
+		t.countedStacks(buf, keep)
+	}
+	if len(keep) == 0 {
+		if err := t.stackmap[buf].DeleteAll(); err != nil {
+			log.Printf("Failed to clean stackmap table: %v", err)
+		}
+		return
+	}
+
+	var stale [][]byte
+	it := t.stackmap[buf].Iter()
+	for it.Next() {
+		if !keep[int32(bpfmap.NativeEndian.Uint32(it.Key()))] {
+			stale = append(stale, append([]byte(nil), it.Key()...))
+		}
+	}
+	for _, key := range stale {
+		if err := t.stackmap[buf].Delete(key); err != nil {
+			log.Printf("Failed to clean stackmap table: %v", err)
+		}
+	}
+}
+
+// countedStacks adds the ids of the stacks of the entries of the counts map of the set to ids
+func (t *bpfTables) countedStacks(buf int, ids map[int32]bool) {
+	var key bpfmap.CountsKey
+	it := t.counts[buf].Iter()
+	for it.Next() {
+		if err := binary.Read(bytes.NewBuffer(it.Key()), bpfmap.NativeEndian, &key); err != nil {
+			log.Printf("decoding counts map key: %v", err)
+			continue
+		}
+		ids[key.KernStackId] = true
+		ids[key.UserStackId] = true
+	}
+}
+
+// blockedStacks returns the ids of the stacks recorded in the set by the tasks currently
+// switched out
+func (t *bpfTables) blockedStacks(buf int) map[int32]bool {
+	if t.blocked == nil {
+		return nil
+	}
+	ids := map[int32]bool{}
+	it := t.blocked.Iter()
+	for it.Next() {
+		value, err := bpfmap.Native.DecodeBlocked(it.Leaf())
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		if int(value.Buf) == buf {
+			ids[value.Key.KernStackId] = true
+			ids[value.Key.UserStackId] = true
+		}
+	}
+	return ids
+}
+
+// readErrors returns how many times each error happened since the previous read, summed over all cpus
+func (t *bpfTables) readErrors() []uint64 {
+	deltas := make([]uint64, len(errorNames))
+	key := make([]byte, 4)
+	for i := range errorNames {
+		bpfmap.NativeEndian.PutUint32(key, uint32(i))
+		value, err := t.errors.Get(key)
+		if err != nil {
+			log.Printf("Failed to read error counter %s: %v", errorNames[i], err)
+			continue
+		}
+		// Per cpu arrays hold one 8 bytes value per possible cpu
+		var total uint64
+		for off := 0; off+8 <= len(value); off += 8 {
+			total += bpfmap.NativeEndian.Uint64(value[off:])
+		}
+		deltas[i] = total - t.lastErrors[i]
+		t.lastErrors[i] = total
+		bpfErrors.Add(errorNames[i], int64(deltas[i]))
+		samplesDropped.WithLabelValues(errorNames[i]).Add(float64(deltas[i]))
+	}
+	return deltas
+}
+
+// errorComments describes the errors of an interval, to be attached to the profiles
+func errorComments(deltas []uint64) []string {
+	var parts []string
+	for i, n := range deltas {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", errorNames[i], n))
+		}
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	return []string{"bpf errors: " + strings.Join(parts, ", ")}
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/diff"
+)
+
+// runDiff is the diff subcommand, comparing two profiles or two directories of profiles
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s diff [flags] <base> <new>\n\nBase and new are pprof files, or directories whose pprof files are merged.\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	out := fs.String("o", "diff.pb.gz", "File the diff profile is written to, base samples being negated as with pprof -diff_base. Default to diff.pb.gz")
+	top := fs.Int("top", 20, "Number of regressions reported. Default to 20")
+	sampleType := fs.String("sample-type", "", "Type of the values compared, e.g. samples or cpu. Default to the last one of the profiles")
+	matchSymbols := fs.Bool("match-symbols", false, "Align the functions by name and file only, to compare different builds of a program. Default to false")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	base, err := diff.Load(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to load the base profile: %v", err)
+	}
+	cur, err := diff.Load(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Failed to load the new profile: %v", err)
+	}
+	opts := diff.Options{SampleType: *sampleType, MatchSymbols: *matchSymbols}
+
+	report, err := diff.Compare(base, cur, opts)
+	if err != nil {
+		log.Fatalf("Failed to compare the profiles: %v", err)
+	}
+	if err := report.Write(os.Stdout, *top); err != nil {
+		log.Fatalf("Failed to write the report: %v", err)
+	}
+
+	d, err := diff.Diff(base, cur, opts)
+	if err != nil {
+		log.Fatalf("Failed to diff the profiles: %v", err)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+	defer f.Close()
+	if err := d.Write(f); err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+}
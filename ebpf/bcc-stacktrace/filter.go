@@ -0,0 +1,122 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	bpf "github.com/iovisor/gobpf/bcc"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/target"
+)
+
+// filterFlags compiles the target maps into the bpf programs, unless all processes are profiled
+func filterFlags(sel *target.Selector) []string {
+	if sel.All() {
+		return nil
+	}
+	return []string{"-DFILTER_TARGETS"}
+}
+
+// setAllTargets makes stack_trace.c record all processes, whatever the target maps hold,
+// or only the targets again
+func setAllTargets(m *bpf.Module, all bool) error {
+	key := make([]byte, 4)
+	value := make([]byte, 4)
+	if all {
+		bpfmap.NativeEndian.PutUint32(value, 1)
+	}
+	if err := bpf.NewTable(m.TableId("all_targets"), m).Set(key, value); err != nil {
+		return fmt.Errorf("switching target filtering: %w", err)
+	}
+	return nil
+}
+
+// bpfTargets are the target maps of the bpf programs, along with what they hold
+type bpfTargets struct {
+	pids    *bpf.Table
+	cgroups *bpf.Table
+
+	currentPids    map[uint32]bool
+	currentCgroups map[uint64]bool
+}
+
+func newTargets(m *bpf.Module) *bpfTargets {
+	return &bpfTargets{
+		pids:           bpf.NewTable(m.TableId("target_pids"), m),
+		cgroups:        bpf.NewTable(m.TableId("target_cgroups"), m),
+		currentPids:    map[uint32]bool{},
+		currentCgroups: map[uint64]bool{},
+	}
+}
+
+// followTargets fills the target maps with the processes and cgroups selected, and looks
+// for new ones every interval, e.g. processes restarted with a new pid
+func followTargets(sel *target.Selector, t *bpfTargets, interval time.Duration) error {
+	if err := t.discover(sel); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := t.discover(sel); err != nil {
+				log.Printf("Failed to update targets: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (t *bpfTargets) discover(sel *target.Selector) error {
+	pids, cgroups, err := sel.Discover()
+	if err != nil {
+		return err
+	}
+	return t.update(pids, cgroups)
+}
+
+// update makes the target maps hold the pids and the cgroups
+func (t *bpfTargets) update(pids map[uint32]bool, cgroups map[uint64]bool) error {
+	one := []byte{1}
+	key := make([]byte, 8)
+	for pid := range pids {
+		if !t.currentPids[pid] {
+			bpfmap.NativeEndian.PutUint32(key, pid)
+			if err := t.pids.Set(key[:4], one); err != nil {
+				return fmt.Errorf("adding target pid %d: %w", pid, err)
+			}
+			t.currentPids[pid] = true
+		}
+	}
+	for pid := range t.currentPids {
+		if !pids[pid] {
+			bpfmap.NativeEndian.PutUint32(key, pid)
+			if err := t.pids.Delete(key[:4]); err != nil {
+				return fmt.Errorf("removing target pid %d: %w", pid, err)
+			}
+			delete(t.currentPids, pid)
+		}
+	}
+
+	for id := range cgroups {
+		if !t.currentCgroups[id] {
+			bpfmap.NativeEndian.PutUint64(key, id)
+			if err := t.cgroups.Set(key, one); err != nil {
+				return fmt.Errorf("adding target cgroup %d: %w", id, err)
+			}
+			t.currentCgroups[id] = true
+		}
+	}
+	for id := range t.currentCgroups {
+		if !cgroups[id] {
+			bpfmap.NativeEndian.PutUint64(key, id)
+			if err := t.cgroups.Delete(key); err != nil {
+				return fmt.Errorf("removing target cgroup %d: %w", id, err)
+			}
+			delete(t.currentCgroups, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	bpf "github.com/iovisor/gobpf/bcc"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/goroutine"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+)
+
+// goroutineFlags compiles the reading of the current goroutine into stack_trace.c, g being
+// found in a different place on each architecture
+func goroutineFlags() ([]string, error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return []string{"-DGOROUTINES", "-DGO_ARCH_AMD64"}, nil
+	case "arm64":
+		return []string{"-DGOROUTINES", "-DGO_ARCH_ARM64"}, nil
+	}
+	return nil, fmt.Errorf("goroutines are not supported on %s", runtime.GOARCH)
+}
+
+// binaryId identifies an executable by its device and inode
+type binaryId struct {
+	dev uint64
+	ino uint64
+}
+
+// goProcesses keeps the go_procs map of stack_trace.c up to date with the Go processes
+// running, and the offsets of their struct g
+type goProcesses struct {
+	table *bpf.Table
+
+	mu sync.Mutex
+	// Offsets of the processes in the table, by pid
+	procs map[uint32]*goroutine.Offsets
+	// Offsets by executable, nil for the ones which are not Go or cannot be read
+	binaries map[binaryId]*goroutine.Offsets
+}
+
+func newGoProcesses(m *bpf.Module) *goProcesses {
+	return &goProcesses{
+		table:    bpf.NewTable(m.TableId("go_procs"), m),
+		procs:    map[uint32]*goroutine.Offsets{},
+		binaries: map[binaryId]*goroutine.Offsets{},
+	}
+}
+
+// followGoProcesses looks for Go processes every interval, the debug info of each binary
+// being read once
+func followGoProcesses(p *goProcesses, interval time.Duration) error {
+	if err := p.scan(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := p.scan(); err != nil {
+				log.Printf("Failed to look for Go processes: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *goProcesses) scan() error {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return fmt.Errorf("listing processes: %w", err)
+	}
+	self := uint32(os.Getpid())
+	found := map[uint32]*goroutine.Offsets{}
+	for _, entry := range entries {
+		pid, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil || uint32(pid) == self {
+			continue
+		}
+		if o := p.binaryOffsets(filepath.Join("/proc", entry.Name(), "exe")); o != nil {
+			found[uint32(pid)] = o
+		}
+	}
+	return p.update(found)
+}
+
+// binaryOffsets returns the offsets of an executable, nil if it is not a Go one
+func (p *goProcesses) binaryOffsets(exe string) *goroutine.Offsets {
+	// Kernel threads and processes which exited have no executable
+	fi, err := os.Stat(exe)
+	if err != nil {
+		return nil
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	id := binaryId{uint64(st.Dev), st.Ino}
+	if o, ok := p.binaries[id]; ok {
+		return o
+	}
+	o, err := goroutine.ReadOffsets(exe)
+	if err != nil && !errors.Is(err, goroutine.ErrNotGo) {
+		log.Printf("Failed to read the goroutine offsets of %s: %v", exe, err)
+	}
+	p.binaries[id] = o
+	return o
+}
+
+// update makes the go_procs map hold the processes
+func (p *goProcesses) update(found map[uint32]*goroutine.Offsets) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := make([]byte, 4)
+	value := make([]byte, 16)
+	for pid, o := range found {
+		if p.procs[pid] == o {
+			continue
+		}
+		bpfmap.NativeEndian.PutUint32(key, pid)
+		bpfmap.NativeEndian.PutUint64(value, o.Goid)
+		bpfmap.NativeEndian.PutUint64(value[8:], o.Labels)
+		if err := p.table.Set(key, value); err != nil {
+			return fmt.Errorf("adding Go process %d: %w", pid, err)
+		}
+		p.procs[pid] = o
+	}
+	for pid := range p.procs {
+		if found[pid] == nil {
+			bpfmap.NativeEndian.PutUint32(key, pid)
+			if err := p.table.Delete(key); err != nil {
+				return fmt.Errorf("removing Go process %d: %w", pid, err)
+			}
+			delete(p.procs, pid)
+		}
+	}
+	return nil
+}
+
+func (p *goProcesses) offsets(pid uint32) *goroutine.Offsets {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.procs[pid]
+}
+
+// goroutineSource labels the samples of Go processes with their goroutine id and the
+// labels set with runtime/pprof
+type goroutineSource struct {
+	sampleSource
+	procs *goProcesses
+}
+
+// withGoroutines returns the source as is when goroutines are not recorded
+func withGoroutines(src sampleSource, procs *goProcesses) sampleSource {
+	if procs == nil {
+		return src
+	}
+	return &goroutineSource{src, procs}
+}
+
+// drain labels the streamed samples with their goroutine id and the pprof labels read
+// when they were received
+func (s *goroutineSource) drain() []pprof.Sample {
+	samples := s.sampleSource.drain()
+	for i := range samples {
+		sample := &samples[i]
+		if sample.Goid == 0 {
+			continue
+		}
+		labels := map[string]string{}
+		for k, v := range sample.GoroutineLabels {
+			labels[k] = v
+		}
+		// Labels of the cgroup take precedence over the ones set by the process
+		for k, v := range sample.Labels {
+			labels[k] = v
+		}
+		labels["goroutine"] = strconv.FormatUint(sample.Goid, 10)
+		sample.Labels = labels
+	}
+	return samples
+}
+
+// readGoLabels reads labels out of the memory of the process, opened once per drain. The
+// files of the processes which exited since fail to read rather than reading the ones
+// their pids were reused by.
+func readGoLabels(mems map[uint32]*os.File, pid uint32, addr uint64, format goroutine.LabelsFormat) (map[string]string, error) {
+	mem, ok := mems[pid]
+	if !ok {
+		var err error
+		if mem, err = os.Open(fmt.Sprintf("/proc/%d/mem", pid)); err != nil {
+			return nil, err
+		}
+		mems[pid] = mem
+	}
+	return goroutine.ReadLabels(mem, addr, format)
+}
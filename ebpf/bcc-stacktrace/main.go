@@ -8,328 +8,615 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	_ "embed"
-	"encoding/binary"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
-	"runtime"
-	"sort"
+	"os/signal"
+	"syscall"
 	"time"
-	"unsafe"
 
-	bpf "github.com/iovisor/gobpf/bcc"
 	bcc "github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bcc"
-	"github.com/google/pprof/profile"
-	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/ksym"
-	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/symbol"
-	"golang.org/x/sys/unix"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/cgroup"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/event"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/k8s"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/output"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/target"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/unwind"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/upload"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 //go:embed stack_trace.c
 var source string
 
-const TASK_COMM_LEN int = 16
-const MAX_STACK_DEPTH int = 127
+// uploadQueueSize is how many profiles wait for the one being uploaded, the next ones
+// being spooled
+const uploadQueueSize = 4
 
-// KernStackId/UserStackId can be negative, e.g. -14 if stack not found
-type countsMapKey struct {
-	TaskComm    [TASK_COMM_LEN]byte
-	Pid         uint32
-	KernStackId int32
-	UserStackId int32
-}
-
-type callStack [MAX_STACK_DEPTH]uint64
+// uploadCloseTimeout is how long the profiles queued are uploaded for on exit, the ones
+// left being spooled
+const uploadCloseTimeout = 10 * time.Second
 
 // TODO:
 //   1. Add user symbol resolution
 func main() {
-	target_pid := flag.Int("pid", -1, "PID of the process whose stack traces will be collected. Default to -1, i.e. all processes")
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		runDiff(os.Args[2:])
+		return
+	}
+	os.Exit(profileMain())
+}
+
+// profileMain profiles until interrupted, returning the exit status. Deferred cleanups,
+// e.g. detaching the perf events, run before exiting.
+func profileMain() int {
+	targetPids := flag.String("pid", "", "Comma separated PIDs of the processes whose stack traces will be collected. Default to all processes")
 	duration := flag.Duration("duration", 5*time.Second, "Duration of the profiling. Default to 5s")
-	cgroupDir := flag.String("cgroup", "", "Cgroup directory")
+	count := flag.Int("count", 0, "Number of intervals of -duration profiled before exiting. Default to 0, i.e. until interrupted")
+	once := flag.Bool("once", false, "Profile a single interval and exit, same as -count 1")
+	cgroupDirs := flag.String("cgroup", "", "Comma separated cgroup v2 directories, the processes in them or in their descendants are profiled")
+	comm := flag.String("comm", "", "Regular expression the comm of the processes to profile matches, e.g. ^nginx")
+	cmdline := flag.String("cmdline", "", "Regular expression the command line of the processes to profile matches, arguments being separated by spaces")
+	rediscover := flag.Duration("rediscover", 10*time.Second, "How often processes matching -comm or -cmdline, cgroups created under -cgroup and Go processes with -goroutines, are looked for. Default to 10s")
+	outputDir := flag.String("output-dir", ".", "Directory the profile files are written to. Default to the current directory")
+	outputTemplate := flag.String("output-template", output.DefaultTemplate, "Template of the profile file names, with {{.Pid}}, {{.Time}}, {{.Host}}, {{.Mode}} and {{.Ext}}, the extension of the output format, available")
+	outputMode := flag.String("output-mode", string(output.PerPid), "Either pid, one profile per process, or host, a single merged profile per interval. Default to pid")
+	outputFormat := flag.String("output-format", string(output.Pprof), "Comma separated formats of the profile files, among pprof, folded (collapsed stacks), svg (flame graph) and trace (Chrome trace event JSON, with -stream). Default to pprof")
+	uploadURL := flag.String("upload-url", "", "URL of a Pyroscope compatible server the profiles are pushed to every interval, e.g. http://pyroscope:4040")
+	appName := flag.String("app-name", "bcc-stacktrace", "Application name the uploaded profiles are stored under")
+	uploadLabels := flag.String("upload-labels", "", "Labels attached to the uploaded profiles, e.g. service=api,env=prod. The host label is added automatically")
+	uploadRetries := flag.Int("upload-retries", 3, "Number of retries of a failed upload before the profile is spooled. Default to 3")
+	spoolDir := flag.String("spool-dir", "", "Directory keeping the profiles which failed to upload until the server is back. Default to no spooling")
+	spoolMaxBytes := flag.Int64("spool-max-bytes", 100<<20, "Maximum size of the spool directory, the oldest profiles are dropped first. Default to 100MiB")
+	profileType := flag.String("profile", "cpu", "Either cpu, sampling stacks on the event given by -event, or off-cpu, accounting the time tasks spend blocked. Default to cpu")
+	eventSpec := flag.String("event", "cpu-clock", "Event the stacks are sampled on, e.g. cpu-clock, task-clock, page-faults, context-switches, cycles, cache-misses, r003c (raw hardware event), tracepoint:sched:sched_wakeup or kprobe:tcp_sendmsg. Default to cpu-clock")
+	frequency := flag.Uint64("frequency", 100, "Number of samples per second taken of perf events. Default to 100Hz")
+	period := flag.Uint64("period", 0, "Sample every N occurrences of perf events instead of sampling at -frequency. Default to 0, i.e. sampling at -frequency")
+	maxOverhead := flag.Float64("max-overhead", 0, "Maximum percentage of the cpu time of the host spent profiling, by the profiler and its bpf programs, e.g. 1. Events are then subsampled in the bpf program, the ones recorded standing for the ones skipped. Default to 0, i.e. no limit")
+	mapSize := flag.Int("map-size", 10000, "Number of entries of the counts and stack maps the stacks are counted in. Default to 10000")
+	highWater := flag.Float64("high-water", 0.8, "Fraction of -map-size entries of the counts map at which it is drained before the end of the interval, so that new stacks are not dropped. Stacks colliding in the stack map are dropped whatever its fill level, and counted as lost. Default to 0.8, 0 to only drain every -duration")
+	minBlock := flag.Duration("min-block", time.Microsecond, "Blocks shorter than this are left out of off-cpu profiles. Default to 1us")
+	stream := flag.Bool("stream", false, "Stream every sample with its timestamp, thread and cpu instead of counting them in the kernel, so that profiles keep a timeline. Default to false")
+	dwarfUnwind := flag.Bool("dwarf-unwind", false, "Unwind the user stacks with the call frame information of the binaries, .eh_frame or .debug_frame, so that the ones built without frame pointers get their full stacks. The registers and the top of the user stack are copied with every sample, which needs -stream and a 5.15+ kernel. Default to false")
+	goroutines := flag.Bool("goroutines", false, "Label the samples of Go processes with their goroutine id and the labels set with runtime/pprof, read from the debug info of their binaries. Needs -stream. Default to false")
+	attribute := flag.Bool("k8s", false, "Label the samples with their cgroup, and the pod and container it belongs to. Default to false")
+	cgroupRoot := flag.String("cgroup-root", cgroup.DefaultRoot, "Mount point of the cgroup v2 hierarchy the cgroup ids are resolved in with -k8s. Default to /sys/fs/cgroup")
+	kubeletURL := flag.String("kubelet-url", "", "Read-only API of the kubelet the pod and container names are looked up from with -k8s, e.g. http://localhost:10255. Default to no names, pods are known by their uid")
+	podResourcesSocket := flag.String("pod-resources", "", "Socket of the PodResources API of the kubelet, e.g. "+k8s.DefaultPodResourcesSocket+". With -k8s and -kubelet-url, samples are labeled with the exclusive cpus and the devices of their container, and with outside_cpuset=true when taken outside of its cpuset")
+	recordFile := flag.String("record", "", "File the raw bpf maps of every interval are recorded to, along with /proc/kallsyms and the /proc/<pid>/maps of the processes sampled, to be replayed with -replay. Labels of -k8s and -goroutines are not recorded")
+	replayFile := flag.String("replay", "", "Recording made with -record which is profiled instead of the kernel, e.g. to reproduce an issue offline. Profiles are written or uploaded as they were when recorded")
+	replayRoot := flag.String("replay-root", "/", "Directory the binaries of the replayed processes are looked up in, e.g. a copy of the root filesystem of the recorded host. Default to /")
+	metricsListen := flag.String("metrics-listen", "", "Address to serve Prometheus metrics of the profiler itself on /metrics, e.g. :9090. They are also served on -listen")
+	listen := flag.String("listen", "", "Address to serve /debug/pprof/profile?seconds=N&pid=P&cgroup=DIR on, e.g. :6060. Perf events are only attached while a profile is requested, the bpf program recording the processes requested")
 	flag.Parse()
+	if *once {
+		*count = 1
+	}
 
-	extraFlags := 0
-	target := *target_pid
+	// When uploading, profiles are only written to files if asked for explicitly
+	writeFiles := *uploadURL == ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "output-dir" {
+			writeFiles = true
+		}
+	})
 
-	if *cgroupDir != "" {
-		cgroup, err := os.Open(*cgroupDir)
+	var writer *output.Writer
+	var err error
+	if writeFiles {
+		formats, err := output.ParseFormats(*outputFormat)
+		if err != nil {
+			log.Printf("Failed to parse output formats: %v", err)
+			return 1
+		}
+		writer, err = output.NewWriter(*outputDir, *outputTemplate, output.Mode(*outputMode), formats)
 		if err != nil {
-			log.Fatalf("Failed to open cgroup directory %s: %v", *cgroupDir, err)
+			log.Printf("Failed to set up output: %v", err)
+			return 1
 		}
-		target = int(cgroup.Fd())
-		extraFlags |= unix.PERF_FLAG_PID_CGROUP
 	}
-	cflags := []string{}
 
-	m := bcc.NewModule(source, cflags)
-	defer m.Close()
+	var uploads *upload.Queue
+	if *uploadURL != "" {
+		labels, err := upload.ParseLabels(*uploadLabels)
+		if err != nil {
+			log.Printf("Failed to parse upload labels: %v", err)
+			return 1
+		}
+		uploader, err := upload.NewUploader(upload.Config{
+			URL:           *uploadURL,
+			AppName:       *appName,
+			Labels:        labels,
+			MaxRetries:    *uploadRetries,
+			Backoff:       time.Second,
+			MaxBackoff:    *duration / 2,
+			SpoolDir:      *spoolDir,
+			SpoolMaxBytes: *spoolMaxBytes,
+		})
+		if err != nil {
+			log.Printf("Failed to set up uploader: %v", err)
+			return 1
+		}
+		// A slow or unreachable server must not hold up the draining of the maps
+		uploads = upload.NewQueue(uploader, uploadQueueSize, func(err error) {
+			log.Printf("Uploading profile: %v", err)
+			uploadFailures.Inc()
+		})
+	}
 
-	// Load the bpf program with type BPF_PROG_TYPE_PERF_EVENT
-	fd, err := m.LoadPerfEvent("bpf_prog1")
-	if err != nil {
-		log.Fatalf("Failed to load bpf_prog1: %v\n", err)
+	http.Handle("/metrics", promhttp.Handler())
+	if *metricsListen != "" {
+		// Only the metrics are served there, not the profiles and /debug/vars of -listen
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			if err := http.ListenAndServe(*metricsListen, mux); err != nil {
+				log.Printf("Failed to serve metrics: %v", err)
+			}
+		}()
 	}
 
-	// Open a perf event of type PERF_TYPE_SOFTWARE, setting sample rate to 100Hz(i.e. 100 samples/s) for process with target_pid
-	// on any CPU. And attach the bpf program to it.
-	cpus := runtime.NumCPU()
-	for i := 0; i < cpus; i++ {
-		attr := &unix.PerfEventAttr{
-			Type:   unix.PERF_TYPE_SOFTWARE,
-			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
-			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
-			Sample: 100,
-			Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
+	if *replayFile != "" {
+		return replayMain(*replayFile, *replayRoot, writer, uploads)
+	}
+	if *recordFile != "" && (*stream || *listen != "") {
+		log.Printf("Recording is not supported with -stream or -listen")
+		return 1
+	}
+	// The tables drained are recorded with -record
+	var rec *recorder
+	defer func() {
+		if rec != nil {
+			rec.close()
 		}
-		err = m.AttachPerfEventRaw(fd, attr, target, i, -1, extraFlags)
+	}()
+	recorded := func(types pprof.ValueTypes, src sampleSource) (sampleSource, error) {
+		if *recordFile == "" {
+			return src, nil
+		}
+		// Samples are counted in the tables, streaming is not supported
+		r, err := newRecorder(*recordFile, types, src.(*bpfTables))
 		if err != nil {
-			log.Fatalf("Failed to attach to perf event: %v\n", err)
+			return nil, err
 		}
+		rec = r
+		return rec, nil
 	}
 
-	countsTable := bpf.NewTable(m.Module.TableId("counts"), m.Module)
-	stackmapTable := bpf.NewTable(m.Module.TableId("stackmap"), m.Module)
+	if *mapSize <= 0 {
+		log.Printf("-map-size should be positive")
+		return 1
+	}
+	if *highWater < 0 || *highWater > 1 {
+		log.Printf("-high-water should be between 0 and 1")
+		return 1
+	}
+	setMapCapacity(*mapSize)
+	mapCflags := []string{fmt.Sprintf("-DMAP_SIZE=%d", *mapSize)}
+	highWaterEntries := uint64(*highWater * float64(*mapSize))
 
-	// Read, process and clean counts/stackmap table
-	ticker := time.NewTicker(*duration)
-	defer ticker.Stop()
+	sel, err := target.NewSelector(*targetPids, *cgroupDirs, *comm, *cmdline)
+	if err != nil {
+		log.Printf("Failed to parse targets: %v", err)
+		return 1
+	}
 
-	for range ticker.C {
-		itCounts := countsTable.Iter()
-		var countsKeyBytes, countsValueBytes []byte
-		var countsKey countsMapKey
-		var countsValue uint64
-		// It is possible that we see same call stack with different stackId, because stackId is
-		// not derived from call stack alone. It is also possible that different processes have the
-		// exact same call stack.
-		pSamples := map[uint32]map[[2]callStack]*profile.Sample{}
-		// Map from pid to locations, functions and location Ids
-		pLocations := map[uint32][]*profile.Location{}
-		pFunctions := map[uint32][]*profile.Function{}
-		pLocationIds := map[uint32]map[uint64]int{}
-
-		// Each entry in counts map is a sample in pprof
-		for itCounts.Next() {
-			// parse entries from bpf maps
-			countsKeyBytes = itCounts.Key()
-			countsValueBytes = itCounts.Leaf()
-			err := binary.Read(bytes.NewBuffer(countsKeyBytes), binary.LittleEndian, &countsKey)
+	var attributor *k8s.Attributor
+	if *attribute {
+		var kubelet *k8s.Kubelet
+		if *kubeletURL != "" {
+			kubelet = k8s.NewKubelet(*kubeletURL)
+		}
+		var resources *k8s.PodResources
+		if *podResourcesSocket != "" {
+			if kubelet == nil {
+				log.Printf("-pod-resources needs -kubelet-url to name the containers")
+				return 1
+			}
+			resources, err = k8s.DialPodResources(*podResourcesSocket)
 			if err != nil {
-				log.Printf("decoding counts map key: %v", countsKey)
+				log.Printf("Failed to connect to the PodResources API: %v", err)
+				return 1
 			}
-			err = binary.Read(bytes.NewBuffer(countsValueBytes), binary.LittleEndian, &countsValue)
+			defer resources.Close()
+			cpus, err := resources.Allocatable()
 			if err != nil {
-				log.Printf("decoding counts map value: %v", countsKey)
+				log.Printf("Failed to query the PodResources API, is KubeletPodResourcesGetAllocatable enabled? %v", err)
+				return 1
 			}
+			log.Printf("Allocatable cpus: %s", k8s.FormatCPUs(cpus))
+		}
+		attributor = k8s.NewAttributor(cgroup.NewResolver(*cgroupRoot), kubelet, resources)
+	}
+	// The cpuset of the containers is checked on the cpu of each sample
+	checkCPU := *podResourcesSocket != ""
 
-			log.Println("==============================================================================================================")
-			log.Printf("kernel stack id: %v; user stack id: %v; seen times: %d", countsKey.KernStackId, countsKey.UserStackId, countsValue)
-
-			var userStackBytes, kernStackBytes []byte
-			var userStack, kernStack callStack
+	// Interrupting flushes the last partial interval
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	profile := func(types pprof.ValueTypes, src sampleSource, stop func()) int {
+		status := 0
+		if err := run(ctx, *duration, *count, stop, types, src, writer, uploads); err != nil {
+			log.Printf("%v", err)
+			status = 1
+		}
+		if err := closeUploads(uploads); err != nil {
+			log.Printf("%v", err)
+			status = 1
+		}
+		return status
+	}
 
-			bs := make([]byte, 4)
-			binary.LittleEndian.PutUint32(bs, uint32(countsKey.KernStackId))
-			kernStackBytes, err = stackmapTable.Get(bs)
-			if err != nil {
-				log.Printf("Failed to lookup kernel stack with id: %d, %v", countsKey.KernStackId, err)
-			} else {
-				err = binary.Read(bytes.NewBuffer(kernStackBytes), binary.LittleEndian, &kernStack)
-				if err != nil {
-					log.Printf("decoding kernel stack: %v", countsKey.KernStackId)
-				}
+	switch *profileType {
+	case "cpu":
+	case "off-cpu":
+		if *listen != "" {
+			log.Printf("Serving profiles on demand is only supported for cpu profiles")
+			return 1
+		}
+		if *stream || *dwarfUnwind {
+			log.Printf("Streaming samples is only supported for cpu profiles")
+			return 1
+		}
+		if *goroutines {
+			log.Printf("Goroutines are only recorded in cpu profiles")
+			return 1
+		}
+		if *maxOverhead > 0 {
+			log.Printf("The overhead can only be capped for cpu profiles")
+			return 1
+		}
+		m := bcc.NewModule(offCPUSource, append(offCPUFlags(sel, *minBlock), mapCflags...))
+		defer m.Close()
+		if !sel.All() {
+			if err := followTargets(sel, newTargets(m.Module), *rediscover); err != nil {
+				log.Printf("Failed to set targets: %v", err)
+				return 1
 			}
+		}
 
-			binary.LittleEndian.PutUint32(bs, uint32(countsKey.UserStackId))
-			userStackBytes, err = stackmapTable.Get(bs)
-			if err != nil {
-				log.Printf("Failed to lookup user stack with id: %d, %v", countsKey.UserStackId, err)
-			} else {
-				err = binary.Read(bytes.NewBuffer(userStackBytes), binary.LittleEndian, &userStack)
-				if err != nil {
-					log.Printf("decoding user stack: %v", countsKey.UserStackId)
-				}
+		fd, err := m.LoadTracepoint("tracepoint__sched__sched_switch")
+		if err != nil {
+			log.Printf("Failed to load tracepoint__sched__sched_switch: %v", err)
+			return 1
+		}
+		if err := m.AttachTracepoint("sched:sched_switch", fd); err != nil {
+			log.Printf("Failed to attach to sched:sched_switch: %v", err)
+			return 1
+		}
+		tables := newOffCPUTables(m.Module)
+		tables.watch(highWaterEntries, highWaterPoll)
+		src, err := recorded(pprof.OffCPU, tables)
+		if err != nil {
+			log.Printf("Failed to start recording: %v", err)
+			return 1
+		}
+		return profile(pprof.OffCPU, withAttribution(src, attributor, false), m.DetachProbes)
+	default:
+		log.Printf("Unknown profile type %s", *profileType)
+		return 1
+	}
+
+	ev, err := event.Parse(*eventSpec)
+	if err != nil {
+		log.Printf("Failed to parse event: %v", err)
+		return 1
+	}
+	if *period == 0 && *frequency == 0 {
+		log.Printf("Either -frequency or -period should be positive")
+		return 1
+	}
+	if err := ev.Check(*frequency, *period); err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
+	types := ev.ValueTypes(*frequency, *period)
+
+	// Options stack_trace.c is compiled with, whatever the event
+	sourceCflags := mapCflags
+	if *stream {
+		sourceCflags = append(sourceCflags, streamFlags(*dwarfUnwind)...)
+	}
+	var unwinder *unwind.Unwinder
+	if *dwarfUnwind {
+		if !*stream {
+			log.Printf("-dwarf-unwind needs -stream, the user stacks being copied with every sample")
+			return 1
+		}
+		cflags, err := unwindFlags()
+		if err != nil {
+			log.Printf("%v", err)
+			return 1
+		}
+		sourceCflags = append(sourceCflags, cflags...)
+		if unwinder, err = newUnwinder(); err != nil {
+			log.Printf("%v", err)
+			return 1
+		}
+	}
+	if checkCPU {
+		sourceCflags = append(sourceCflags, "-DRECORD_CPU")
+	}
+	if *goroutines {
+		if !*stream {
+			log.Printf("-goroutines needs -stream, counting the samples by goroutine would split the counts of every stack")
+			return 1
+		}
+		cflags, err := goroutineFlags()
+		if err != nil {
+			log.Printf("%v", err)
+			return 1
+		}
+		sourceCflags = append(sourceCflags, cflags...)
+	}
+	// The sampling of the program loaded with fd is adjusted with -max-overhead
+	capOverhead := func(m *bcc.BPFModule, fd int) error {
+		if *maxOverhead <= 0 {
+			return nil
+		}
+		return followOverhead(m.Module, []int{fd}, *maxOverhead/100, *duration)
+	}
+	// Go processes are looked for once stack_trace.c is loaded
+	followGoroutines := func(m *bcc.BPFModule) (*goProcesses, error) {
+		if !*goroutines {
+			return nil, nil
+		}
+		procs := newGoProcesses(m.Module)
+		if err := followGoProcesses(procs, *rediscover); err != nil {
+			return nil, err
+		}
+		return procs, nil
+	}
+
+	if ev.Kind != event.Perf {
+		if *listen != "" {
+			log.Printf("Serving profiles on demand is only supported for perf events")
+			return 1
+		}
+		// Tracepoints and kprobes fire for all processes, the bpf program filters them
+		m := bcc.NewModule(source, append(filterFlags(sel), sourceCflags...))
+		defer m.Close()
+		if !sel.All() {
+			if err := followTargets(sel, newTargets(m.Module), *rediscover); err != nil {
+				log.Printf("Failed to set targets: %v", err)
+				return 1
 			}
+		}
+		procs, err := followGoroutines(m)
+		if err != nil {
+			log.Printf("Failed to look for Go processes: %v", err)
+			return 1
+		}
 
-			// Get data per process
-			locations, ok := pLocations[countsKey.Pid]
-			if !ok {
-				locations = []*profile.Location{}
+		var fd int
+		if ev.Kind == event.Tracepoint {
+			fd, err = m.LoadTracepoint("tracepoint_event")
+			if err != nil {
+				log.Printf("Failed to load tracepoint_event: %v", err)
+				return 1
 			}
-			functions, ok := pFunctions[countsKey.Pid]
-			if !ok {
-				functions = []*profile.Function{}
+			if err := m.AttachTracepoint(ev.Target, fd); err != nil {
+				log.Printf("Failed to attach to tracepoint %s: %v", ev.Target, err)
+				return 1
 			}
-			samplesMap, ok := pSamples[countsKey.Pid]
-			if !ok {
-				samplesMap = map[[2]callStack]*profile.Sample{}
+		} else {
+			fd, err = m.LoadKprobe("kprobe_event")
+			if err != nil {
+				log.Printf("Failed to load kprobe_event: %v", err)
+				return 1
 			}
-			locationIdMap, ok := pLocationIds[countsKey.Pid]
-			if !ok {
-				locationIdMap = map[uint64]int{}
+			if err := m.AttachKprobe(ev.Target, fd, -1); err != nil {
+				log.Printf("Failed to attach kprobe to %s, is it a kernel function that can be probed? %v", ev.Target, err)
+				return 1
 			}
+		}
+		if err := capOverhead(m, fd); err != nil {
+			log.Printf("Failed to cap the overhead: %v", err)
+			return 1
+		}
+		src, closeSource, err := newSource(m.Module, *stream, unwinder, procs, highWaterEntries)
+		if err != nil {
+			log.Printf("Failed to stream samples: %v", err)
+			return 1
+		}
+		defer closeSource()
+		if src, err = recorded(types, src); err != nil {
+			log.Printf("Failed to start recording: %v", err)
+			return 1
+		}
+		src = withGoroutines(withAttribution(src, attributor, checkCPU), procs)
+		return profile(types, src, m.DetachProbes)
+	}
 
-			sampleKey := [2]callStack{
-				kernStack,
-				userStack,
-			}
-			// If we've seen the stack trace with different stack id, simply add to sample value
-			s, ok := samplesMap[sampleKey]
-			if ok {
-				s.Value[0] += int64(countsValue)
-				continue
-			}
+	// Perf events are opened once per online CPU for all processes, the bpf program filters
+	// the targets, which can then change without opening the perf events again. When
+	// serving profiles, the targets are the ones requested, unless selected here.
+	filter := filterFlags(sel)
+	serveTargets := *listen != "" && sel.All()
+	if serveTargets {
+		filter = []string{"-DFILTER_TARGETS"}
+	}
+	m := bcc.NewModule(source, append(filter, sourceCflags...))
+	defer m.Close()
+	if !sel.All() {
+		if err := followTargets(sel, newTargets(m.Module), *rediscover); err != nil {
+			log.Printf("Failed to set targets: %v", err)
+			return 1
+		}
+	}
+	procs, err := followGoroutines(m)
+	if err != nil {
+		log.Printf("Failed to look for Go processes: %v", err)
+		return 1
+	}
 
-			// Build sample locations
-			var kernAddrs []uint64
-			sampleLocations := []*profile.Location{}
-			for _, addr := range kernStack {
-				if addr != uint64(0) {
-					id, ok := locationIdMap[addr]
-					if !ok {
-						id = len(locationIdMap)
-						l := &profile.Location{
-							ID: uint64(id + 1),
-							Address: addr,
-						}
-						locationIdMap[addr] = id
-						locations = append(locations, l)
-						kernAddrs = append(kernAddrs, addr)
-					}
-					sampleLocations = append(sampleLocations, locations[id])
-				}
-			}
-			// print stack
-			log.Println("Kernel stack:")
-			for _, addr := range kernStack {
-				if addr != uint64(0) {
-					log.Printf("\t0x%x", addr)
-				}
-			}
-			log.Println("User stack:")
-			for _, addr := range userStack {
-				if addr != uint64(0) {
-					log.Printf("\t0x%x", addr)
-				}
-			}
+	// Load the bpf program with type BPF_PROG_TYPE_PERF_EVENT
+	fd, err := m.LoadPerfEvent("bpf_prog1")
+	if err != nil {
+		log.Printf("Failed to load bpf_prog1: %v", err)
+		return 1
+	}
+	if err := capOverhead(m, fd); err != nil {
+		log.Printf("Failed to cap the overhead: %v", err)
+		return 1
+	}
 
-			// Sort kernel address for symbol resolution
-			sort.Slice(kernAddrs, func(i, j int) bool { return kernAddrs[i] < kernAddrs[j] })
-			syms := ksym.ResolveAddrs(kernAddrs)
-			for i, addr := range kernAddrs {
-				index, ok := locationIdMap[addr]
-				// Address is successfully resolved
-				if ok {
-					log.Printf("Adding function with: 0x%x\t%s", addr, syms[i])
-					f := &profile.Function{
-						ID: uint64(len(functions) + 1),
-						Name: syms[i],
-						SystemName: "kernel",
-					}
-					// Assuming no duplicate functions
-					functions = append(functions, f)
-					locations[index].Line = []profile.Line{
-						{
-							Function: f,
-						},
-					}
-				}
-			}
+	// Open the perf event, sampling at the given frequency or period, for all processes on each
+	// online CPU. And attach the bpf program to it.
+	attach := func() error {
+		attr := ev.Attr(*frequency, *period)
+		if err := m.AttachPerfEventRaw(fd, attr, -1, -1, -1, 0); err != nil {
+			return fmt.Errorf("failed to attach to perf event %s: %v", ev.Name, err)
+		}
+		return nil
+	}
 
-			var userAddrs []uint64
-			for _, addr := range userStack {
-				if addr != uint64(0) {
-					userAddrs = append(userAddrs, addr)
-				}
-			}
-			syms = symbol.ResolveGoSyms(countsKey.Pid, userAddrs)
-			for i, addr := range userAddrs {
-				id, ok := locationIdMap[addr]
-				if !ok {
-					id = len(locationIdMap)
-					// TODO: try to resolve user stack symbols
-					f := &profile.Function{
-						ID: uint64(len(functions) + 1),
-						Name: syms[i],
-						SystemName: "User",
-					}
-					functions = append(functions, f)
-					l := &profile.Location{
-						ID: uint64(id + 1),
-						Address: addr,
-						Line: []profile.Line{
-							{
-								Function: f,
-							},
-						},
-					}
-					locationIdMap[addr] = id
-					locations = append(locations, l)
+	src, closeSource, err := newSource(m.Module, *stream, unwinder, procs, highWaterEntries)
+	if err != nil {
+		log.Printf("Failed to stream samples: %v", err)
+		return 1
+	}
+	defer closeSource()
+	if src, err = recorded(types, src); err != nil {
+		log.Printf("Failed to start recording: %v", err)
+		return 1
+	}
+	src = withGoroutines(withAttribution(src, attributor, checkCPU), procs)
+
+	if *listen != "" {
+		// Perf events are attached on demand, the bpf program recording the pids and cgroups
+		// requested. Requests then keep their own samples.
+		var retarget func(bool, map[uint32]bool, map[uint64]bool) error
+		if serveTargets {
+			targets := newTargets(m.Module)
+			retarget = func(all bool, pids map[uint32]bool, cgroups map[uint64]bool) error {
+				if err := targets.update(pids, cgroups); err != nil {
+					return err
 				}
-				sampleLocations = append(sampleLocations, locations[id])
+				return setAllTargets(m.Module, all)
 			}
+		}
+		s := newSampler(
+			attach,
+			m.DetachPerfEvents,
+			func() []pprof.Sample {
+				// Keep the error counters on /debug/vars up to date
+				src.readErrors()
+				return src.drain()
+			},
+			retarget,
+		)
+		http.HandleFunc("/debug/pprof/profile", profileHandler(s, types))
+		server := &http.Server{Addr: *listen}
+		go func() {
+			<-ctx.Done()
+			server.Shutdown(context.Background())
+		}()
+		log.Printf("Serving profiles on %s/debug/pprof/profile", *listen)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("Failed to serve profiles: %v", err)
+			return 1
+		}
+		return 0
+	}
 
-			sample := &profile.Sample{
-				Location: sampleLocations,
-				Value: []int64{int64(countsValue)},
-			}
-			samplesMap[sampleKey] = sample
-			log.Printf("%+v", sample)
-			log.Println("==============================================================================================================")
+	if err := attach(); err != nil {
+		log.Printf("%v", err)
+		return 1
+	}
 
-			pLocations[countsKey.Pid] = locations
-			pFunctions[countsKey.Pid] = functions
-			pSamples[countsKey.Pid] = samplesMap
-			pLocationIds[countsKey.Pid] = locationIdMap
+	return profile(types, src, m.DetachPerfEvents)
+}
+
+// run reads, processes and cleans counts/stackmap table every interval, until count
+// intervals were profiled or ctx is done. The last partial interval is then profiled too,
+// once stop, if any, stopped the sampling. It fails if any profile was not written or
+// queued for upload.
+func run(ctx context.Context, interval time.Duration, count int, stop func(), types pprof.ValueTypes, src sampleSource, writer *output.Writer, uploads *upload.Queue) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failed := 0
+	start := time.Now()
+	for n := 0; count == 0 || n < count; n++ {
+		var now time.Time
+		stopping := false
+		select {
+		case now = <-ticker.C:
+		case <-ctx.Done():
+			log.Printf("Stopping, flushing the last %v", time.Since(start).Round(time.Millisecond))
+			if stop != nil {
+				stop()
+			}
+			now = time.Now()
+			stopping = true
 		}
-		// Clean the bpf tables
-		err = countsTable.DeleteAll()
-		if err != nil {
-			log.Printf("Failed to clean counts table: %v", err)
+		if !flush(start, now, types, src, hostSymbols, writer, uploads) {
+			failed++
 		}
-		err = stackmapTable.DeleteAll()
-		if err != nil {
-			log.Printf("Failed to clean stackmap table: %v", err)
+		if stopping {
+			break
 		}
+		start = now
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d intervals could not be written or uploaded", failed)
+	}
+	return nil
+}
 
-		for pid, samplesMap := range pSamples {
-			// Build profile and write to pprof file
-			var samples []*profile.Sample
-			for _, s := range samplesMap {
-				samples = append(samples, s)
-			}
+// flush builds the profiles of the samples since start, symbolized with sym, writes them
+// and queues them for upload
+func flush(start, now time.Time, types pprof.ValueTypes, src sampleSource, sym pprof.Symbolizer, writer *output.Writer, uploads *upload.Queue) bool {
+	defer func(begin time.Time) {
+		intervalSeconds.Observe(time.Since(begin).Seconds())
+	}(time.Now())
+	samples := src.drain()
+	profiles := pprof.BuildProfiles(samples, start, now.Sub(start), types, sym)
 
-			p := profile.Profile{
-				PeriodType: &profile.ValueType{
-					Type: "cpu",
-					Unit: "nanoseconds",
-				},
-				Period: 10000000,
-				SampleType: []*profile.ValueType{
-					{
-						Type: "samples",
-						Unit: "count",
-					},
-				},
-				Sample: samples,
-				Location: pLocations[pid],
-				Function: pFunctions[pid],
-			}
-			log.Printf("%+v", p)
+	// Samples lost in the bpf programs are reported along with the profiles
+	comments := errorComments(src.readErrors())
+	if len(comments) > 0 {
+		log.Printf("%s", comments[0])
+	}
+	for _, p := range profiles {
+		p.Comments = append(p.Comments, comments...)
+	}
 
-			pprofFileName := fmt.Sprintf("profile.pb.gz-%d-%s", pid, time.Now().Format("20060102150405"))
-			f, err := os.Create(pprofFileName)
-			if err != nil {
-				log.Printf("Creating pprof file: %v", err)
-			}
-			// Write the profile to the file.
-			if err := p.Write(f); err != nil {
-				log.Printf("Writing to pprof file: %v", err)
-			}
+	ok := true
+	if writer != nil {
+		if err := writer.Write(profiles, now); err != nil {
+			log.Printf("Writing profiles: %v", err)
+			ok = false
+		}
+	}
+	if uploads != nil && len(profiles) > 0 {
+		p, err := output.Merge(profiles)
+		if err != nil {
+			log.Printf("Merging profiles for upload: %v", err)
+			return false
 		}
+		if err := uploads.Put(p); err != nil {
+			log.Printf("Uploading profile: %v", err)
+			uploadFailures.Inc()
+			ok = false
+		}
+	}
+	return ok
+}
+
+// closeUploads waits for the profiles queued, if uploading, to be uploaded, for at most
+// uploadCloseTimeout
+func closeUploads(uploads *upload.Queue) error {
+	if uploads == nil {
+		return nil
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), uploadCloseTimeout)
+	defer cancel()
+	return uploads.Close(ctx)
 }
@@ -0,0 +1,100 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/ksym"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	samplesCollected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bcc_stacktrace_samples_total",
+		Help: "Samples read from the bpf maps or streamed.",
+	})
+	samplesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bcc_stacktrace_samples_dropped_total",
+		Help: "Samples, or their stacks, lost in the bpf programs by reason.",
+	}, []string{"reason"})
+	mapEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bcc_stacktrace_map_entries",
+		Help: "Entries of the counts and stack maps as of the last drain.",
+	}, []string{"map"})
+	mapCapacities = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "bcc_stacktrace_map_capacity",
+		Help: "Maximum number of entries of the counts and stack maps.",
+	}, []string{"map"})
+	symbolized = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bcc_stacktrace_symbolized_total",
+		Help: "Addresses symbolized, by source, kernel or user, and result, hit or miss.",
+	}, []string{"source", "result"})
+	intervalSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "bcc_stacktrace_interval_seconds",
+		Help:    "Time taken to drain, symbolize and write or upload the profiles of an interval.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	})
+	uploadFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bcc_stacktrace_upload_failures_total",
+		Help: "Intervals whose profile failed to upload after retries.",
+	})
+	earlyDrains = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bcc_stacktrace_early_drains_total",
+		Help: "Drains of the counts and stack maps before the end of the interval, as they reached -high-water.",
+	})
+)
+
+// The cpu time of the profiler is exported as process_cpu_seconds_total by the process
+// collector of the default registry
+
+// setMapCapacity exposes the number of entries of the counts and stack maps
+func setMapCapacity(size int) {
+	mapCapacities.WithLabelValues("counts").Set(float64(size))
+	mapCapacities.WithLabelValues("stackmap").Set(float64(size))
+}
+
+// cpuSeconds is the cpu time used by the profiler so far
+func cpuSeconds() float64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()).Seconds()
+}
+
+// hostSymbols resolves the addresses on this host, accounting the addresses left unresolved
+var hostSymbols pprof.Symbolizer = countedSymbolizer{pprof.Host}
+
+type countedSymbolizer struct {
+	pprof.Symbolizer
+}
+
+func (s countedSymbolizer) Kernel(addrs []uint64) []string {
+	syms := s.Symbolizer.Kernel(addrs)
+	countSymbols("kernel", syms, func(sym string) bool { return sym == ksym.UnresolvedSym })
+	return syms
+}
+
+func (s countedSymbolizer) User(pid uint32, addrs []uint64) []string {
+	syms := s.Symbolizer.User(pid, addrs)
+	// Unresolved addresses are kept as hexadecimal
+	countSymbols("user", syms, func(sym string) bool { return strings.HasPrefix(sym, "0x") })
+	return syms
+}
+
+func countSymbols(source string, syms []string, missed func(string) bool) {
+	var misses int
+	for _, sym := range syms {
+		if missed(sym) {
+			misses++
+		}
+	}
+	symbolized.WithLabelValues(source, "hit").Add(float64(len(syms) - misses))
+	symbolized.WithLabelValues(source, "miss").Add(float64(misses))
+}
@@ -0,0 +1,291 @@
+// +build ignore
+
+#include <uapi/linux/ptrace.h>
+#include <linux/errno.h>
+#include <linux/sched.h>
+
+#ifndef TASK_COMM_LEN
+#define TASK_COMM_LEN 16
+#endif
+// Max depth of each stack trace to track
+#define PERF_MAX_STACK_DEPTH 127
+// Number of entries of the counts and stack maps of each set, set with -DMAP_SIZE
+#ifndef MAP_SIZE
+#define MAP_SIZE 10000
+#endif
+
+// Blocks shorter than MIN_BLOCK_NS are not recorded, can be overridden with -DMIN_BLOCK_NS
+#ifndef MIN_BLOCK_NS
+#define MIN_BLOCK_NS 1000
+#endif
+
+// Same key as stack_trace.c, so that both are drained the same way
+struct key_t {
+  char comm[TASK_COMM_LEN];
+  u32 pid;
+  int kernstack;
+  int userstack;
+  // Left to zero
+  u32 cpu;
+  // Id of the cgroup v2 of the task, i.e. the inode number of its directory
+  u64 cgroup;
+  // Left to zero, goroutines are only recorded by stack_trace.c
+  u64 goid;
+  u64 labels;
+};
+
+// A task which was switched out, along with its stack at that time and the set of maps
+// the stack was recorded in
+struct blocked_t {
+  struct key_t key;
+  u32 buf;
+  u32 pad;
+  u64 ts;
+};
+
+// Number of blocks of a key and the nanoseconds they add up to, as struct value_t of
+// stack_trace.c
+struct value_t {
+  u64 count;
+  u64 weight;
+};
+
+// Blocked nanoseconds by stack, double buffered the same way as stack_trace.c
+BPF_HASH(counts_0, struct key_t, struct value_t, MAP_SIZE);
+BPF_STACK_TRACE(stackmap_0, MAP_SIZE);
+BPF_HASH(counts_1, struct key_t, struct value_t, MAP_SIZE);
+BPF_STACK_TRACE(stackmap_1, MAP_SIZE);
+BPF_ARRAY(active, u32, 1);
+// Entries added to the counts map of each set, for user space to drain the active set
+// before the end of the interval when it fills up
+BPF_ARRAY(occupancy, u64, 2);
+// Programs writing to each set, as in stack_trace.c. Switch-ins are counted in the set of
+// the blocked task until they added its time.
+BPF_ARRAY(inflight, u64, 2);
+// Tasks currently switched out, by thread id. Tasks which are never switched back in, e.g.
+// killed while blocked, are evicted once it fills up rather than keeping it full.
+BPF_TABLE("lru_hash", u32, struct blocked_t, blocked, 10240);
+
+// Same error counters as stack_trace.c
+enum error_t {
+  ERR_KERN_EEXIST,
+  ERR_KERN_EFAULT,
+  ERR_KERN_ENOMEM,
+  ERR_KERN_OTHER,
+  ERR_USER_EEXIST,
+  ERR_USER_EFAULT,
+  ERR_USER_ENOMEM,
+  ERR_USER_OTHER,
+  ERR_COUNTS_FULL,
+  ERR_EVENTS_LOST,
+  ERR_FLIPPED,
+  ERR_BLOCKED_FULL,
+  NUM_ERRORS,
+};
+BPF_PERCPU_ARRAY(errors, u64, NUM_ERRORS);
+
+#define KERN_STACKID_FLAGS (0 | BPF_F_FAST_STACK_CMP)
+#define USER_STACKID_FLAGS (0 | BPF_F_FAST_STACK_CMP | BPF_F_USER_STACK)
+
+#ifdef FILTER_TARGETS
+// Processes and cgroups to profile, kept up to date by user space
+BPF_HASH(target_pids, u32, u8, 10240);
+BPF_HASH(target_cgroups, u64, u8, 10240);
+#endif
+
+// Targets are filtered with -DFILTER_TARGETS, the current task being profiled if its
+// process or its cgroup is in the target maps
+static inline int wanted(u32 tgid)
+{
+#ifdef FILTER_TARGETS
+  u64 cgroup;
+
+  if (target_pids.lookup(&tgid))
+    return 1;
+  cgroup = bpf_get_current_cgroup_id();
+  if (target_cgroups.lookup(&cgroup))
+    return 1;
+  return 0;
+#else
+  return 1;
+#endif
+}
+
+static inline void occupied(u32 idx)
+{
+  u64 *val = occupancy.lookup(&idx);
+
+  if (val)
+    __sync_fetch_and_add(val, 1);
+}
+
+static inline void count_error(int index)
+{
+  u64 *val = errors.lookup(&index);
+
+  if (val)
+    (*val)++;
+}
+
+// enter_set counts the current program in the set idx, returning 0 if the set is not
+// the active one anymore, see stack_trace.c
+static inline int enter_set(u32 idx)
+{
+  int zero = 0;
+  u64 *n = inflight.lookup(&idx);
+  u32 *buf;
+
+  if (n)
+    __sync_fetch_and_add(n, 1);
+  buf = active.lookup(&zero);
+  if ((buf ? *buf : 0) == idx)
+    return 1;
+  if (n)
+    __sync_fetch_and_add(n, -1);
+  return 0;
+}
+
+// enter returns the index of the active set, counted in inflight until leave, or -1
+static inline int enter(void)
+{
+  int zero = 0;
+  u32 *buf = active.lookup(&zero);
+  u32 idx = buf ? *buf : 0;
+
+  if (enter_set(idx))
+    return idx;
+  if (enter_set(1 - idx))
+    return 1 - idx;
+  count_error(ERR_FLIPPED);
+  return -1;
+}
+
+static inline void leave(u32 idx)
+{
+  u64 *n = inflight.lookup(&idx);
+
+  if (n)
+    __sync_fetch_and_add(n, -1);
+}
+
+// count_stack_error accounts a negative stack id, base being ERR_KERN_EEXIST or ERR_USER_EEXIST
+static inline void count_stack_error(int stackid, int base)
+{
+  switch (stackid) {
+  case -EEXIST:
+    count_error(base);
+    break;
+  case -EFAULT:
+    count_error(base + 1);
+    break;
+  case -ENOMEM:
+    count_error(base + 2);
+    break;
+  default:
+    count_error(base + 3);
+  }
+}
+
+// blocked_state tells whether a task switched out with state is blocked rather than
+// preempted or exiting. sched_switch does not report preempted tasks as TASK_RUNNING:
+// since 4.14 it reports them as TASK_REPORT_MAX, and older kernels set TASK_STATE_MAX on
+// their state. Exiting tasks are never switched back in.
+static inline int blocked_state(long state)
+{
+#if defined(TASK_REPORT_MAX)
+  if (state & TASK_REPORT_MAX)
+    return 0;
+#elif defined(TASK_STATE_MAX)
+  if (state & TASK_STATE_MAX)
+    return 0;
+#endif
+  if (state & (EXIT_DEAD | EXIT_ZOMBIE | TASK_DEAD))
+    return 0;
+  return state != TASK_RUNNING;
+}
+
+TRACEPOINT_PROBE(sched, sched_switch)
+{
+  u64 ts = bpf_ktime_get_ns();
+  u64 id = bpf_get_current_pid_tgid();
+  u32 tgid = id >> 32;
+  u32 prev = args->prev_pid;
+  u32 next = args->next_pid;
+  struct blocked_t b = {};
+  struct blocked_t *bp;
+  struct key_t key;
+  struct value_t *val, first;
+  u64 delta, *n;
+  int set;
+  u32 idx;
+
+  // The current task is still the one being switched out. Preempted tasks are left
+  // out, they are still runnable rather than blocked.
+  if (prev != 0 && blocked_state(args->prev_state) && wanted(tgid) && (set = enter()) >= 0) {
+    b.buf = set;
+    bpf_get_current_comm(&b.key.comm, sizeof(b.key.comm));
+    b.key.pid = tgid;
+    b.key.cgroup = bpf_get_current_cgroup_id();
+    if (b.buf) {
+      b.key.kernstack = stackmap_1.get_stackid(args, KERN_STACKID_FLAGS);
+      b.key.userstack = stackmap_1.get_stackid(args, USER_STACKID_FLAGS);
+    } else {
+      b.key.kernstack = stackmap_0.get_stackid(args, KERN_STACKID_FLAGS);
+      b.key.userstack = stackmap_0.get_stackid(args, USER_STACKID_FLAGS);
+    }
+    if (b.key.kernstack < 0)
+      count_stack_error(b.key.kernstack, ERR_KERN_EEXIST);
+    if (b.key.userstack < 0)
+      count_stack_error(b.key.userstack, ERR_USER_EEXIST);
+    b.ts = ts;
+    // The time the task is blocked is lost, and its stacks are not kept across drains
+    if (blocked.update(&prev, &b) != 0)
+      count_error(ERR_BLOCKED_FULL);
+    leave(set);
+  }
+
+  // Account the time the task being switched in was blocked
+  bp = blocked.lookup(&next);
+  if (bp == 0)
+    return 0;
+  key = bp->key;
+  idx = bp->buf;
+  delta = ts - bp->ts;
+  // Counted before the task is removed from blocked: user space keeps the stacks of the
+  // blocked tasks and of the counts it finds once the set is idle, this one being either
+  n = inflight.lookup(&idx);
+  if (n)
+    __sync_fetch_and_add(n, 1);
+  blocked.delete(&next);
+
+  if (delta < MIN_BLOCK_NS) {
+    leave(idx);
+    return 0;
+  }
+  first.count = 1;
+  first.weight = delta;
+  // The time goes to the set holding the stacks, even if it is not the active one anymore:
+  // user space keeps the stacks of blocked tasks around, and reads the count on its next
+  // drain of that set. Blocks whose stacks were lost are still counted, see stack_trace.c
+  if (idx) {
+    val = counts_1.lookup(&key);
+    if (val) {
+      __sync_fetch_and_add(&val->count, 1);
+      __sync_fetch_and_add(&val->weight, delta);
+    } else if (counts_1.update(&key, &first) != 0)
+      count_error(ERR_COUNTS_FULL);
+    else
+      occupied(1);
+  } else {
+    val = counts_0.lookup(&key);
+    if (val) {
+      __sync_fetch_and_add(&val->count, 1);
+      __sync_fetch_and_add(&val->weight, delta);
+    } else if (counts_0.update(&key, &first) != 0)
+      count_error(ERR_COUNTS_FULL);
+    else
+      occupied(0);
+  }
+  leave(idx);
+  return 0;
+}
@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"time"
+
+	bpf "github.com/iovisor/gobpf/bcc"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/target"
+)
+
+//go:embed off_cpu.c
+var offCPUSource string
+
+// offCPUFlags compiles the target filter and the minimum block duration into off_cpu.c
+func offCPUFlags(sel *target.Selector, minBlock time.Duration) []string {
+	return append(filterFlags(sel), fmt.Sprintf("-DMIN_BLOCK_NS=%dULL", minBlock.Nanoseconds()))
+}
+
+// newOffCPUTables returns the tables of off_cpu.c, which keep the stacks of blocked tasks
+// across drains
+func newOffCPUTables(m *bpf.Module) *bpfTables {
+	t := newTables(m)
+	t.blocked = bpf.NewTable(m.TableId("blocked"), m)
+	return t
+}
@@ -2,6 +2,7 @@ package bcc
 
 import (
 	"fmt"
+	"strings"
 	"unsafe"
 
 	bpf "github.com/iovisor/gobpf/bcc"
@@ -12,6 +13,7 @@ import (
 /*
 #cgo CFLAGS: -I/usr/include/bcc/compat
 #cgo LDFLAGS: -lbcc
+#include <stdlib.h>
 #include <bcc/bcc_common.h>
 #include <bcc/libbpf.h>
 */
@@ -20,6 +22,9 @@ import "C"
 type BPFModule struct {
 	*bpf.Module
 	perfEvents     []int
+	// Perf event fds of the tracepoints and kprobes attached, by category:name or event name
+	tracepoints    map[string]int
+	kprobes        map[string]int
 }
 
 func NewModule(code string, cflags []string) *BPFModule {
@@ -27,17 +32,89 @@ func NewModule(code string, cflags []string) *BPFModule {
 	module := &BPFModule{
 		m,
 		[]int{},
+		map[string]int{},
+		map[string]int{},
 	}
 
 	return module
 }
 
 func (m *BPFModule) Close() {
-	for v := range m.perfEvents {
-		C.bpf_close_perf_event_fd((C.int)(v))
+	m.DetachPerfEvents()
+	m.DetachProbes()
+	m.Module.Close()
+}
+
+// AttachTracepoint attaches the program to the tracepoint category:name. Unlike the one of
+// bpf.Module, it can be detached with DetachProbes while the maps are still read.
+func (m *BPFModule) AttachTracepoint(name string, fd int) error {
+	if _, ok := m.tracepoints[name]; ok {
+		return nil
 	}
+	parts := strings.SplitN(name, ":", 2)
+	if len(parts) < 2 {
+		return fmt.Errorf("failed to parse tracepoint name, expected %q, got %q", "category:name", name)
+	}
+	categoryCS := C.CString(parts[0])
+	nameCS := C.CString(parts[1])
+	defer C.free(unsafe.Pointer(categoryCS))
+	defer C.free(unsafe.Pointer(nameCS))
 
-	m.Module.Close()
+	r, err := C.bpf_attach_tracepoint(C.int(fd), categoryCS, nameCS)
+	if r < 0 {
+		return fmt.Errorf("failed to attach BPF tracepoint: %v", err)
+	}
+	m.tracepoints[name] = int(r)
+	return nil
+}
+
+// AttachKprobe attaches the program to the entry of the kernel function fnName. Unlike the
+// one of bpf.Module, it can be detached with DetachProbes while the maps are still read.
+func (m *BPFModule) AttachKprobe(fnName string, fd int, maxActive int) error {
+	evName := "p_" + strings.NewReplacer("+", "_", ".", "_").Replace(fnName)
+	if _, ok := m.kprobes[evName]; ok {
+		return nil
+	}
+	evNameCS := C.CString(evName)
+	fnNameCS := C.CString(fnName)
+	defer C.free(unsafe.Pointer(evNameCS))
+	defer C.free(unsafe.Pointer(fnNameCS))
+
+	r, err := C.bpf_attach_kprobe(C.int(fd), C.BPF_PROBE_ENTRY, evNameCS, fnNameCS, 0, C.int(maxActive))
+	if r < 0 {
+		return fmt.Errorf("failed to attach BPF kprobe: %v", err)
+	}
+	m.kprobes[evName] = int(r)
+	return nil
+}
+
+// DetachProbes detaches the tracepoints and kprobes attached so far, the bpf programs stay loaded
+func (m *BPFModule) DetachProbes() {
+	for name, fd := range m.tracepoints {
+		C.bpf_close_perf_event_fd((C.int)(fd))
+		parts := strings.SplitN(name, ":", 2)
+		categoryCS := C.CString(parts[0])
+		nameCS := C.CString(parts[1])
+		C.bpf_detach_tracepoint(categoryCS, nameCS)
+		C.free(unsafe.Pointer(categoryCS))
+		C.free(unsafe.Pointer(nameCS))
+	}
+	for evName, fd := range m.kprobes {
+		C.bpf_close_perf_event_fd((C.int)(fd))
+		evNameCS := C.CString(evName)
+		C.bpf_detach_kprobe(evNameCS)
+		C.free(unsafe.Pointer(evNameCS))
+	}
+	m.tracepoints = map[string]int{}
+	m.kprobes = map[string]int{}
+}
+
+// DetachPerfEvents closes all the perf events attached so far, the bpf programs stay loaded
+func (m *BPFModule) DetachPerfEvents() {
+	for _, fd := range m.perfEvents {
+		C.bpf_close_perf_event_fd((C.int)(fd))
+	}
+	m.perfEvents = []int{}
 }
 
 func (m *BPFModule) AttachPerfEventRaw(progfd int, attr *unix.PerfEventAttr, pid, cpu, groupFd int, extraFlags int) error {
@@ -59,7 +136,11 @@ func (m *BPFModule) AttachPerfEventRaw(progfd int, attr *unix.PerfEventAttr, pid
 		for _, i := range cpus {
 			r, err := C.bpf_attach_perf_event_raw(C.int(progfd), unsafe.Pointer(attr), C.pid_t(pid), C.int(i), C.int(groupFd), C.ulong(extraFlags))
 			if r < 0 {
-				return fmt.Errorf("failed to attach BPF perf event: %v", err)
+				// The events attached on the other cpus are not tracked, close them
+				for _, fd := range res {
+					C.bpf_close_perf_event_fd((C.int)(fd))
+				}
+				return fmt.Errorf("failed to attach BPF perf event on cpu %d: %v", i, err)
 			}
 
 			res = append(res, int(r))
@@ -0,0 +1,151 @@
+// Package bpfmap decodes the entries of the counts and stack maps of stack_trace.c and
+// off_cpu.c into samples, whether they are read from the kernel or replayed
+package bpfmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"unsafe"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+)
+
+// NativeEndian is the byte order of the host, the one the bpf programs write the maps in
+var NativeEndian = nativeEndian()
+
+func nativeEndian() binary.ByteOrder {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// ByteOrder returns the byte order named by its String, e.g. recorded on another host
+func ByteOrder(name string) (binary.ByteOrder, error) {
+	switch name {
+	case binary.LittleEndian.String():
+		return binary.LittleEndian, nil
+	case binary.BigEndian.String():
+		return binary.BigEndian, nil
+	}
+	return nil, fmt.Errorf("unknown byte order %q", name)
+}
+
+// TaskCommLen is the size of the comm of a task, NUL padded
+const TaskCommLen = 16
+
+// CountsKey is struct key_t. KernStackId/UserStackId can be negative, e.g. -14 if stack not found
+type CountsKey struct {
+	TaskComm    [TaskCommLen]byte
+	Pid         uint32
+	KernStackId int32
+	UserStackId int32
+	Cpu         uint32
+	CgroupId    uint64
+	Goid        uint64
+	GoLabels    uint64
+}
+
+// CountsValue is struct value_t, the number of samples of a key and their weight
+type CountsValue struct {
+	Count  uint64
+	Weight uint64
+}
+
+// BlockedValue is struct blocked_t of off_cpu.c, a task switched out along with its key
+// and the set its stacks were recorded in
+type BlockedValue struct {
+	Key CountsKey
+	Buf uint32
+	_   uint32
+	Ts  uint64
+}
+
+// Stack is a stack of the stack map, leaf first and zero padded
+type Stack [pprof.MaxStackDepth]uint64
+
+// Decoder decodes the entries of the maps written in a byte order
+type Decoder struct {
+	Order binary.ByteOrder
+}
+
+// Native decodes the maps of the host
+var Native = Decoder{NativeEndian}
+
+// StackKey returns the key of the stack map of the stack id
+func (d Decoder) StackKey(stackId int32) []byte {
+	key := make([]byte, 4)
+	d.Order.PutUint32(key, uint32(stackId))
+	return key
+}
+
+// DecodeStack returns the addresses of a stack map value, without the zero padding
+func (d Decoder) DecodeStack(value []byte) ([]uint64, error) {
+	var stack Stack
+	if err := binary.Read(bytes.NewReader(value), d.Order, &stack); err != nil {
+		return nil, err
+	}
+	var addrs []uint64
+	for _, addr := range stack {
+		if addr != 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// DecodeBlocked returns the task of an entry of the blocked map of off_cpu.c
+func (d Decoder) DecodeBlocked(value []byte) (BlockedValue, error) {
+	var v BlockedValue
+	if err := binary.Read(bytes.NewReader(value), d.Order, &v); err != nil {
+		return BlockedValue{}, fmt.Errorf("decoding blocked map value: %w", err)
+	}
+	return v, nil
+}
+
+// DecodeSample returns the sample of an entry of the counts map, its stacks being looked
+// up in the stack map with lookup. Stacks which can't be looked up are left empty.
+func (d Decoder) DecodeSample(key, value []byte, lookup func(key []byte) ([]byte, error)) (pprof.Sample, error) {
+	var k CountsKey
+	var v CountsValue
+	if err := binary.Read(bytes.NewReader(key), d.Order, &k); err != nil {
+		return pprof.Sample{}, fmt.Errorf("decoding counts map key: %w", err)
+	}
+	if err := binary.Read(bytes.NewReader(value), d.Order, &v); err != nil {
+		return pprof.Sample{}, fmt.Errorf("decoding counts map value: %w", err)
+	}
+	return pprof.Sample{
+		Pid:         k.Pid,
+		Comm:        string(bytes.TrimRight(k.TaskComm[:], "\x00")),
+		KernStackId: k.KernStackId,
+		UserStackId: k.UserStackId,
+		KernStack:   d.lookupStack(lookup, k.KernStackId, "kernel"),
+		UserStack:   d.lookupStack(lookup, k.UserStackId, "user"),
+		Count:       v.Count,
+		Weight:      v.Weight,
+		Cpu:         k.Cpu,
+		CgroupId:    k.CgroupId,
+		Goid:        k.Goid,
+		GoLabels:    k.GoLabels,
+	}, nil
+}
+
+func (d Decoder) lookupStack(lookup func(key []byte) ([]byte, error), stackId int32, kind string) []uint64 {
+	// Negative ids are the errors of bpf_get_stackid, accounted in the errors table
+	if stackId < 0 {
+		return nil
+	}
+	value, err := lookup(d.StackKey(stackId))
+	if err != nil {
+		log.Printf("Failed to lookup %s stack with id: %d, %v", kind, stackId, err)
+		return nil
+	}
+	addrs, err := d.DecodeStack(value)
+	if err != nil {
+		log.Printf("decoding %s stack %d: %v", kind, stackId, err)
+	}
+	return addrs
+}
@@ -0,0 +1,127 @@
+package bpfmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+)
+
+func encode(t *testing.T, order binary.ByteOrder, v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, order, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNativeEndian(t *testing.T) {
+	want := binary.ByteOrder(binary.LittleEndian)
+	switch runtime.GOARCH {
+	case "mips", "mips64", "ppc64", "s390x", "sparc64":
+		want = binary.BigEndian
+	}
+	if NativeEndian != want {
+		t.Errorf("native byte order %v on %s, want %v", NativeEndian, runtime.GOARCH, want)
+	}
+}
+
+// TestDecodeSample decodes the maps as written by the bpf programs of a little endian
+// host, e.g. amd64 or arm64, and of a big endian one, e.g. s390x
+func TestDecodeSample(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			d := Decoder{order}
+			key := CountsKey{Pid: 42, KernStackId: 7, UserStackId: -14, Cpu: 3, CgroupId: 0x1122334455667788, Goid: 17, GoLabels: 0xc000010000}
+			copy(key.TaskComm[:], "api")
+			var kern Stack
+			copy(kern[:], []uint64{0xffffffff81001010, 0xffffffff81002020})
+			stacks := map[string][]byte{string(d.StackKey(7)): encode(t, order, kern)}
+			lookup := func(key []byte) ([]byte, error) {
+				value, ok := stacks[string(key)]
+				if !ok {
+					return nil, errors.New("not found")
+				}
+				return value, nil
+			}
+
+			got, err := d.DecodeSample(encode(t, order, key), encode(t, order, CountsValue{Count: 2, Weight: 20000000}), lookup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := pprof.Sample{
+				Pid:         42,
+				Comm:        "api",
+				KernStackId: 7,
+				UserStackId: -14,
+				KernStack:   []uint64{0xffffffff81001010, 0xffffffff81002020},
+				Count:       2,
+				Weight:      20000000,
+				Cpu:         3,
+				CgroupId:    0x1122334455667788,
+				Goid:        17,
+				GoLabels:    0xc000010000,
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// TestDecodeBlocked decodes a task switched out by off_cpu.c, then the entry its block is
+// counted in once it is switched back in
+func TestDecodeBlocked(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			d := Decoder{order}
+			key := CountsKey{Pid: 42, KernStackId: 7, UserStackId: 8, CgroupId: 0x1122334455667788}
+			copy(key.TaskComm[:], "api")
+			got, err := d.DecodeBlocked(encode(t, order, BlockedValue{Key: key, Buf: 1, Ts: 123456789}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (BlockedValue{Key: key, Buf: 1, Ts: 123456789}); got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if _, err := d.DecodeBlocked([]byte{1, 2, 3}); err == nil {
+				t.Error("decoded a truncated blocked map value")
+			}
+
+			// Its stacks were cleaned while it was blocked elsewhere, the block is kept
+			lookup := func(key []byte) ([]byte, error) { return nil, errors.New("not found") }
+			sample, err := d.DecodeSample(encode(t, order, got.Key), encode(t, order, CountsValue{Count: 3, Weight: 4500000}), lookup)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sample.Count != 3 || sample.Weight != 4500000 || sample.CgroupId != key.CgroupId || sample.Comm != "api" {
+				t.Errorf("got sample %+v", sample)
+			}
+		})
+	}
+}
+
+func TestStackKey(t *testing.T) {
+	if got, want := (Decoder{binary.LittleEndian}).StackKey(0x01020304), []byte{4, 3, 2, 1}; !bytes.Equal(got, want) {
+		t.Errorf("little endian key %v, want %v", got, want)
+	}
+	if got, want := (Decoder{binary.BigEndian}).StackKey(0x01020304), []byte{1, 2, 3, 4}; !bytes.Equal(got, want) {
+		t.Errorf("big endian key %v, want %v", got, want)
+	}
+}
+
+func TestByteOrder(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		got, err := ByteOrder(order.String())
+		if err != nil || got != order {
+			t.Errorf("ByteOrder(%q) = %v, %v", order.String(), got, err)
+		}
+	}
+	if _, err := ByteOrder("middle"); err == nil {
+		t.Error("unknown byte order accepted")
+	}
+}
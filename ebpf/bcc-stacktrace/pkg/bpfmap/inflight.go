@@ -0,0 +1,30 @@
+package bpfmap
+
+import (
+	"fmt"
+	"time"
+)
+
+// WaitIdle waits for the programs still writing to a set, as counted by its entry of the
+// inflight map of the bpf programs, to be done. inflight reads the entry, which is polled
+// every poll until it drops to zero or timeout elapsed.
+//
+// The programs count themselves in the set they read from the active map, then read it
+// again and move to the other set if it was flipped in between. Once WaitIdle returns
+// after a flip, no program writes to the set it was flipped from anymore.
+func WaitIdle(inflight func() (uint64, error), poll, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		n, err := inflight()
+		if err != nil {
+			return fmt.Errorf("reading the programs in flight: %w", err)
+		}
+		if n == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d programs still in flight after %v", n, timeout)
+		}
+		time.Sleep(poll)
+	}
+}
@@ -0,0 +1,34 @@
+package bpfmap
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitIdle(t *testing.T) {
+	var n int64 = 1
+	inflight := func() (uint64, error) { return uint64(atomic.LoadInt64(&n)), nil }
+	done := make(chan error)
+	go func() { done <- WaitIdle(inflight, time.Millisecond, time.Minute) }()
+	select {
+	case err := <-done:
+		t.Fatalf("WaitIdle returned %v with a program in flight", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	atomic.StoreInt64(&n, 0)
+	if err := <-done; err != nil {
+		t.Errorf("WaitIdle: %v", err)
+	}
+
+	atomic.StoreInt64(&n, 1)
+	if err := WaitIdle(inflight, time.Millisecond, 5*time.Millisecond); err == nil {
+		t.Error("WaitIdle returned without error while the program never left")
+	}
+
+	failing := func() (uint64, error) { return 0, errors.New("no such map") }
+	if err := WaitIdle(failing, time.Millisecond, time.Minute); err == nil {
+		t.Error("WaitIdle ignored the error of the map")
+	}
+}
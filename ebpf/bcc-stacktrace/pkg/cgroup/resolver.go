@@ -0,0 +1,97 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultRoot is where the cgroup v2 hierarchy is usually mounted
+const DefaultRoot = "/sys/fs/cgroup"
+
+// Resolver maps cgroup ids, i.e. the inode numbers of the cgroup v2 directories as returned
+// by bpf_get_current_cgroup_id, to their paths
+type Resolver struct {
+	root string
+	// minRescan limits how often the hierarchy is walked when an id is not known
+	minRescan time.Duration
+
+	mu       sync.Mutex
+	paths    map[uint64]string
+	lastScan time.Time
+}
+
+func NewResolver(root string) *Resolver {
+	return &Resolver{
+		root:      root,
+		minRescan: time.Second,
+		paths:     map[uint64]string{},
+	}
+}
+
+// Path returns the path of the cgroup relative to the root of the hierarchy, e.g.
+// /kubepods/burstable/pod<uid>/<container id>
+func (r *Resolver) Path(id uint64) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if path, ok := r.paths[id]; ok {
+		return path, nil
+	}
+	// New cgroups show up all the time, e.g. when containers start
+	if time.Since(r.lastScan) >= r.minRescan {
+		if err := r.scan(); err != nil {
+			return "", err
+		}
+		if path, ok := r.paths[id]; ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("unknown cgroup id %d", id)
+}
+
+// Exists tells whether the cgroup of the id is still at path, cgroups being removed
+// along with their pods and containers
+func (r *Resolver) Exists(id uint64, path string) bool {
+	fi, err := os.Stat(filepath.Join(r.root, path))
+	if err != nil {
+		return false
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Ino == id
+}
+
+func (r *Resolver) scan() error {
+	r.lastScan = time.Now()
+	paths := map[uint64]string{}
+	err := filepath.Walk(r.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Cgroups removed during the walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("failed to get the inode of %s", path)
+		}
+		rel, err := filepath.Rel(r.root, path)
+		if err != nil {
+			return err
+		}
+		paths[st.Ino] = filepath.Join("/", rel)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walking cgroups: %w", err)
+	}
+	r.paths = paths
+	return nil
+}
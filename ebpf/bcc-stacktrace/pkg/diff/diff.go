@@ -0,0 +1,307 @@
+// Package diff compares two profiles, e.g. two intervals or two builds of a program, to
+// find out what got slower.
+package diff
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/google/pprof/profile"
+)
+
+// Options tell what is compared
+type Options struct {
+	// SampleType is the type of the values compared, the last one by default as in pprof
+	SampleType string
+	// MatchSymbols aligns functions by name and file only, across binaries with different
+	// build ids, rather than within the same binary
+	MatchSymbols bool
+}
+
+// Load reads a pprof file, or merges the pprof files of a directory, e.g. the profiles
+// written every interval. Other files of the directory, like flame graphs, are skipped
+// and logged.
+func Load(path string) (*profile.Profile, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return parseFile(path)
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var ps []*profile.Profile
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		p, err := parseFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			log.Printf("Skipping %v", err)
+			continue
+		}
+		ps = append(ps, p)
+	}
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("no pprof file in %s", path)
+	}
+	merged, err := profile.Merge(ps)
+	if err != nil {
+		return nil, fmt.Errorf("merging the profiles of %s: %w", path, err)
+	}
+	return merged, nil
+}
+
+func parseFile(path string) (*profile.Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := profile.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Diff returns the difference of the current profile and the base one, base being normalized
+// to the same totals first. As with pprof -diff_base, the base samples are negated and
+// labeled pprof::base=true, so that pprof shows the diff as such.
+func Diff(base, cur *profile.Profile, opts Options) (*profile.Profile, error) {
+	if err := compatible(base, cur); err != nil {
+		return nil, err
+	}
+	b, n := base.Copy(), cur.Copy()
+	if opts.MatchSymbols {
+		stripAddresses(b)
+		stripAddresses(n)
+	}
+	ratios := make([]float64, len(b.SampleType))
+	for i := range ratios {
+		ratios[i] = -normalization(base, cur, i)
+	}
+	if err := b.ScaleN(ratios); err != nil {
+		return nil, err
+	}
+	for _, s := range b.Sample {
+		if s.Label == nil {
+			s.Label = map[string][]string{}
+		}
+		s.Label["pprof::base"] = []string{"true"}
+	}
+	diff, err := profile.Merge([]*profile.Profile{n, b})
+	if err != nil {
+		return nil, fmt.Errorf("merging the profiles: %w", err)
+	}
+	return diff, nil
+}
+
+// compatible makes sure both profiles measure the same things
+func compatible(base, cur *profile.Profile) error {
+	if len(base.SampleType) != len(cur.SampleType) {
+		return fmt.Errorf("profiles have %d and %d sample types", len(base.SampleType), len(cur.SampleType))
+	}
+	for i := range base.SampleType {
+		b, n := base.SampleType[i], cur.SampleType[i]
+		if b.Type != n.Type || b.Unit != n.Unit {
+			return fmt.Errorf("profiles have different sample types, %s/%s and %s/%s", b.Type, b.Unit, n.Type, n.Unit)
+		}
+	}
+	return nil
+}
+
+// stripAddresses leaves the functions as the only identity of the locations, so that the
+// locations of different builds are merged
+func stripAddresses(p *profile.Profile) {
+	for _, m := range p.Mapping {
+		m.BuildID = ""
+	}
+	for _, l := range p.Location {
+		l.Address = 0
+	}
+}
+
+// normalization is the factor the values of type i in base are scaled by to add up to
+// the same total as in cur
+func normalization(base, cur *profile.Profile, i int) float64 {
+	baseTotal, newTotal := total(base, i), total(cur, i)
+	if baseTotal == 0 || newTotal == 0 {
+		return 1
+	}
+	return float64(newTotal) / float64(baseTotal)
+}
+
+func total(p *profile.Profile, i int) int64 {
+	var t int64
+	for _, s := range p.Sample {
+		t += s.Value[i]
+	}
+	return t
+}
+
+// Entry compares the values of a function in both profiles, the base ones being normalized
+type Entry struct {
+	Function string
+	File     string
+	// Flat values are the samples in the function itself, cumulative ones include its callees
+	BaseFlat, NewFlat int64
+	BaseCum, NewCum   int64
+}
+
+// Delta is how much more the function itself takes in the new profile
+func (e *Entry) Delta() int64 {
+	return e.NewFlat - e.BaseFlat
+}
+
+// Report has the functions of both profiles, ranked from the worst regression
+type Report struct {
+	Type    *profile.ValueType
+	Total   int64
+	Ratio   float64
+	Entries []*Entry
+}
+
+// Compare aligns the functions of both profiles by name and file, and by binary unless
+// opts.MatchSymbols is set
+func Compare(base, cur *profile.Profile, opts Options) (*Report, error) {
+	if err := compatible(base, cur); err != nil {
+		return nil, err
+	}
+	i := len(cur.SampleType) - 1
+	if opts.SampleType != "" {
+		i = -1
+		for j, st := range cur.SampleType {
+			if st.Type == opts.SampleType {
+				i = j
+			}
+		}
+		if i < 0 {
+			return nil, fmt.Errorf("no sample type %s in the profiles", opts.SampleType)
+		}
+	}
+
+	r := &Report{Type: cur.SampleType[i], Total: total(cur, i), Ratio: normalization(base, cur, i)}
+	entries := map[string]*Entry{}
+	add := func(p *profile.Profile, scale float64, isBase bool) {
+		for _, s := range p.Sample {
+			v := int64(float64(s.Value[i]) * scale)
+			seen := map[*Entry]bool{}
+			first := true
+			for _, l := range s.Location {
+				lines := l.Line
+				if len(lines) == 0 {
+					// Known by its address only
+					lines = []profile.Line{{}}
+				}
+				for _, line := range lines {
+					e := entry(entries, l, line, opts.MatchSymbols)
+					if first {
+						if isBase {
+							e.BaseFlat += v
+						} else {
+							e.NewFlat += v
+						}
+						first = false
+					}
+					// Recursive functions count once in their cumulative value
+					if seen[e] {
+						continue
+					}
+					seen[e] = true
+					if isBase {
+						e.BaseCum += v
+					} else {
+						e.NewCum += v
+					}
+				}
+			}
+		}
+	}
+	add(base, r.Ratio, true)
+	add(cur, 1, false)
+
+	for _, e := range entries {
+		r.Entries = append(r.Entries, e)
+	}
+	sort.Slice(r.Entries, func(a, b int) bool {
+		ea, eb := r.Entries[a], r.Entries[b]
+		if ea.Delta() != eb.Delta() {
+			return ea.Delta() > eb.Delta()
+		}
+		if ea.NewCum-ea.BaseCum != eb.NewCum-eb.BaseCum {
+			return ea.NewCum-ea.BaseCum > eb.NewCum-eb.BaseCum
+		}
+		return ea.Function < eb.Function
+	})
+	return r, nil
+}
+
+// entry returns the entry of the function of a line, creating it the first time
+func entry(entries map[string]*Entry, l *profile.Location, line profile.Line, matchSymbols bool) *Entry {
+	name, file := fmt.Sprintf("0x%x", l.Address), ""
+	if line.Function != nil {
+		name, file = line.Function.Name, line.Function.Filename
+	}
+	key := name + "\x00" + file
+	if !matchSymbols && l.Mapping != nil {
+		key += "\x00" + l.Mapping.BuildID
+	}
+	e, ok := entries[key]
+	if !ok {
+		e = &Entry{Function: name, File: file}
+		entries[key] = e
+	}
+	return e
+}
+
+// Write writes the top regressions of the report, i.e. the functions which take more in
+// the new profile, up to top of them
+func (r *Report) Write(w io.Writer, top int) error {
+	unit := r.Type.Type + "/" + r.Type.Unit
+	if _, err := fmt.Fprintf(w, "Comparing %s, base scaled by %.3f to the new total of %d\n", unit, r.Ratio, r.Total); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "flat delta\tflat delta%\tbase flat\tnew flat\tcum delta\t\t")
+	n := 0
+	for _, e := range r.Entries {
+		if n == top || e.Delta() <= 0 {
+			break
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%d\t\t%s\n", e.Delta(), percent(e.Delta(), r.Total), e.BaseFlat, e.NewFlat, e.NewCum-e.BaseCum, describe(e))
+		n++
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if n == 0 {
+		_, err := fmt.Fprintln(w, "No regression")
+		return err
+	}
+	return nil
+}
+
+func percent(v, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", 100*float64(v)/float64(total))
+}
+
+func describe(e *Entry) string {
+	if e.File == "" {
+		return e.Function
+	}
+	return fmt.Sprintf("%s (%s)", e.Function, e.File)
+}
@@ -0,0 +1,157 @@
+package diff
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+// newProfile returns a cpu profile of a binary with the build id, with main calling foo
+// and bar the given numbers of times
+func newProfile(buildID string, foo, bar int64) *profile.Profile {
+	m := &profile.Mapping{ID: 1, File: "/usr/bin/api", BuildID: buildID}
+	p := &profile.Profile{
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     10000000,
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Mapping:    []*profile.Mapping{m},
+	}
+	var addr uint64 = 0x1000
+	if buildID != "b1" {
+		// Another build has other addresses
+		addr = 0x2000
+	}
+	location := func(name string) *profile.Location {
+		f := &profile.Function{ID: uint64(len(p.Function) + 1), Name: name, SystemName: name, Filename: "main.go"}
+		p.Function = append(p.Function, f)
+		l := &profile.Location{ID: uint64(len(p.Location) + 1), Mapping: m, Address: addr, Line: []profile.Line{{Function: f}}}
+		addr += 0x10
+		p.Location = append(p.Location, l)
+		return l
+	}
+	main, fooLoc, barLoc := location("main.main"), location("main.foo"), location("main.bar")
+	p.Sample = []*profile.Sample{
+		{Location: []*profile.Location{fooLoc, main}, Value: []int64{foo, foo * 10000000}},
+		{Location: []*profile.Location{barLoc, main}, Value: []int64{bar, bar * 10000000}},
+	}
+	return p
+}
+
+func TestCompare(t *testing.T) {
+	// bar went from half to three quarters of the time, base being scaled by 2
+	base, cur := newProfile("b1", 10, 10), newProfile("b1", 10, 30)
+	r, err := Compare(base, cur, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Ratio != 2 || r.Type.Type != "cpu" {
+		t.Errorf("ratio %v of %s, want 2 of cpu", r.Ratio, r.Type.Type)
+	}
+	first := r.Entries[0]
+	if first.Function != "main.bar" || first.Delta() != 100000000 || first.BaseFlat != 200000000 {
+		t.Errorf("worst regression: %+v", first)
+	}
+	last := r.Entries[len(r.Entries)-1]
+	if last.Function != "main.foo" || last.Delta() != -100000000 {
+		t.Errorf("best improvement: %+v", last)
+	}
+	for _, e := range r.Entries {
+		if e.Function == "main.main" && (e.BaseCum != e.NewCum || e.NewFlat != 0) {
+			t.Errorf("main: %+v", e)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := r.Write(&out, 10); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "main.bar (main.go)") || strings.Contains(out.String(), "main.foo") {
+		t.Errorf("report:\n%s", out.String())
+	}
+
+	// Another build is only aligned by symbol with MatchSymbols
+	rebuilt := newProfile("b2", 10, 30)
+	r, err = Compare(base, rebuilt, Options{SampleType: "samples"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Entries[0].Function != "main.bar" || r.Entries[0].BaseFlat != 0 {
+		t.Errorf("worst regression across builds: %+v", r.Entries[0])
+	}
+	r, err = Compare(base, rebuilt, Options{SampleType: "samples", MatchSymbols: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Entries[0].Function != "main.bar" || r.Entries[0].Delta() != 10 {
+		t.Errorf("worst regression matching symbols: %+v", r.Entries[0])
+	}
+
+	if _, err := Compare(base, cur, Options{SampleType: "alloc_space"}); err == nil {
+		t.Error("expected an error for an unknown sample type")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	base, rebuilt := newProfile("b1", 10, 10), newProfile("b2", 10, 30)
+	d, err := Diff(base, rebuilt, Options{MatchSymbols: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+	var sum, bar int64
+	for _, s := range d.Sample {
+		sum += s.Value[0]
+		if s.Location[0].Line[0].Function.Name == "main.bar" {
+			bar += s.Value[0]
+		}
+		if s.Value[0] < 0 && s.Label["pprof::base"][0] != "true" {
+			t.Errorf("base sample without its label: %v", s)
+		}
+	}
+	if sum != 0 || bar != 10 {
+		t.Errorf("diff totals %d, of bar %d, want 0 and 10", sum, bar)
+	}
+	// Locations of both builds are merged
+	if len(d.Location) != 3 {
+		t.Errorf("%d locations, want 3", len(d.Location))
+	}
+	// The profiles are left as they were
+	if base.Location[0].Address == 0 || base.Sample[0].Value[0] != 10 {
+		t.Error("base profile was modified")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	for i, p := range []*profile.Profile{newProfile("b1", 1, 2), newProfile("b1", 3, 4)} {
+		f, err := os.Create(filepath.Join(dir, "profile.pb.gz-42-"+string(rune('0'+i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Write(f); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "profile.pb.gz-42-0.svg"), []byte("<svg/>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := total(p, 0); got != 10 {
+		t.Errorf("merged total %d, want 10", got)
+	}
+	if _, err := Load(t.TempDir()); err == nil {
+		t.Error("expected an error for a directory without profiles")
+	}
+}
@@ -0,0 +1,189 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/google/pprof/profile"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"golang.org/x/sys/unix"
+)
+
+// Kind tells how the bpf program is attached to the event
+type Kind int
+
+const (
+	// Perf events are opened on every cpu with perf_event_open and sampled
+	Perf Kind = iota
+	// Tracepoint events fire on every hit of a kernel tracepoint
+	Tracepoint
+	// Kprobe events fire on every call of a kernel function
+	Kprobe
+)
+
+// Event is a perf-style event specifier, e.g. cpu-clock, cache-misses, r003c for a raw
+// hardware event, tracepoint:sched:sched_wakeup or kprobe:tcp_sendmsg
+type Event struct {
+	Name string
+	Kind Kind
+	// Type and Config of the perf event, for Perf events
+	Type   uint32
+	Config uint64
+	// Target is the tracepoint as category:name, or the kernel function of a kprobe
+	Target string
+}
+
+type perfEvent struct {
+	typ    uint32
+	config uint64
+}
+
+var perfEvents = map[string]perfEvent{
+	"cpu-clock":           {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_CPU_CLOCK},
+	"task-clock":          {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_TASK_CLOCK},
+	"page-faults":         {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_PAGE_FAULTS},
+	"faults":              {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_PAGE_FAULTS},
+	"minor-faults":        {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_PAGE_FAULTS_MIN},
+	"major-faults":        {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_PAGE_FAULTS_MAJ},
+	"context-switches":    {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_CONTEXT_SWITCHES},
+	"cs":                  {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_CONTEXT_SWITCHES},
+	"cpu-migrations":      {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_CPU_MIGRATIONS},
+	"migrations":          {unix.PERF_TYPE_SOFTWARE, unix.PERF_COUNT_SW_CPU_MIGRATIONS},
+	"cycles":              {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_CPU_CYCLES},
+	"cpu-cycles":          {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_CPU_CYCLES},
+	"instructions":        {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_INSTRUCTIONS},
+	"cache-references":    {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_CACHE_REFERENCES},
+	"cache-misses":        {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_CACHE_MISSES},
+	"branches":            {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_BRANCH_INSTRUCTIONS},
+	"branch-instructions": {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_BRANCH_INSTRUCTIONS},
+	"branch-misses":       {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_BRANCH_MISSES},
+	"bus-cycles":          {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_BUS_CYCLES},
+	"ref-cycles":          {unix.PERF_TYPE_HARDWARE, unix.PERF_COUNT_HW_REF_CPU_CYCLES},
+}
+
+// tracefsDirs are where the tracepoints are listed, depending on how tracefs is mounted
+var tracefsDirs = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// Parse parses a perf-style event specifier
+func Parse(spec string) (*Event, error) {
+	switch {
+	case strings.HasPrefix(spec, "tracepoint:"):
+		parts := strings.Split(strings.TrimPrefix(spec, "tracepoint:"), ":")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed tracepoint %q, expecting tracepoint:<category>:<name>", spec)
+		}
+		return &Event{Name: spec, Kind: Tracepoint, Target: parts[0] + ":" + parts[1]}, nil
+	case strings.HasPrefix(spec, "kprobe:"):
+		fn := strings.TrimPrefix(spec, "kprobe:")
+		if fn == "" {
+			return nil, fmt.Errorf("malformed kprobe %q, expecting kprobe:<function>", spec)
+		}
+		return &Event{Name: spec, Kind: Kprobe, Target: fn}, nil
+	}
+
+	e, ok := perfEvents[spec]
+	if !ok {
+		// Raw events of the pmu, r<hex config>, e.g. r003c
+		config, err := strconv.ParseUint(strings.TrimPrefix(spec, "r"), 16, 64)
+		if !strings.HasPrefix(spec, "r") || err != nil {
+			return nil, fmt.Errorf("unknown event %q", spec)
+		}
+		e = perfEvent{unix.PERF_TYPE_RAW, config}
+	}
+	return &Event{Name: spec, Kind: Perf, Type: e.typ, Config: e.config}, nil
+}
+
+// IsClock tells whether the event counts time in nanoseconds rather than occurrences
+func (e *Event) IsClock() bool {
+	return e.Kind == Perf && e.Type == unix.PERF_TYPE_SOFTWARE &&
+		(e.Config == unix.PERF_COUNT_SW_CPU_CLOCK || e.Config == unix.PERF_COUNT_SW_TASK_CLOCK)
+}
+
+// Attr returns the attributes of the perf event, sampling every period events if period
+// is positive and freq times per second otherwise
+func (e *Event) Attr(freq, period uint64) *unix.PerfEventAttr {
+	attr := &unix.PerfEventAttr{
+		Type:   e.Type,
+		Config: e.Config,
+		Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		Sample: freq,
+		Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
+	}
+	if period > 0 {
+		attr.Sample = period
+		attr.Bits = unix.PerfBitDisabled
+	}
+	return attr
+}
+
+// Check makes sure the event is available on this host, so that it fails early and clearly
+// rather than when attaching the bpf program
+func (e *Event) Check(freq, period uint64) error {
+	switch e.Kind {
+	case Tracepoint:
+		parts := strings.SplitN(e.Target, ":", 2)
+		for _, dir := range tracefsDirs {
+			if _, err := os.Stat(filepath.Join(dir, "events", parts[0], parts[1])); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("tracepoint %s does not exist on this host, or tracefs is not mounted", e.Target)
+	case Kprobe:
+		// Kprobes can only be checked by attaching them
+		return nil
+	}
+
+	// Open the event on the current process and close it right away
+	fd, err := unix.PerfEventOpen(e.Attr(freq, period), 0, -1, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		if (e.Type == unix.PERF_TYPE_HARDWARE || e.Type == unix.PERF_TYPE_RAW) && (errors.Is(err, unix.ENOENT) || errors.Is(err, unix.EOPNOTSUPP)) {
+			return fmt.Errorf("hardware event %s is not supported on this host, hardware counters are usually not available in virtual machines: %w", e.Name, err)
+		}
+		return fmt.Errorf("event %s is not supported on this host: %w", e.Name, err)
+	}
+	return unix.Close(fd)
+}
+
+// ValueTypes returns what the samples of the event measure. Samples are counted, and perf
+// events also weighted by the number of events they stand for, e.g. in cpu nanoseconds for
+// clocks, the way runtime/pprof cpu profiles are.
+func (e *Event) ValueTypes(freq, period uint64) pprof.ValueTypes {
+	samples := &profile.ValueType{Type: "samples", Unit: "count"}
+	switch {
+	case e.IsClock():
+		// The nominal period, samples weigh what was actually measured
+		if period == 0 {
+			period = 1000000000 / freq
+		}
+		return pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+			Period:     int64(period),
+			SampleType: []*profile.ValueType{samples, {Type: "cpu", Unit: "nanoseconds"}},
+			Weighted:   []bool{false, true},
+		}
+	case e.Kind == Perf:
+		// The period of events sampled at a frequency is adjusted by the kernel as it goes
+		if period == 0 {
+			period = 1
+		}
+		return pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: e.Name, Unit: "count"},
+			Period:     int64(period),
+			SampleType: []*profile.ValueType{samples, {Type: e.Name, Unit: "count"}},
+			Weighted:   []bool{false, true},
+		}
+	default:
+		// Tracepoints and kprobes record every hit
+		return pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: e.Name, Unit: "count"},
+			Period:     1,
+			SampleType: []*profile.ValueType{samples},
+			Weighted:   []bool{false},
+		}
+	}
+}
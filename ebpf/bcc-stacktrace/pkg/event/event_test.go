@@ -0,0 +1,171 @@
+package event
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"golang.org/x/sys/unix"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want *Event
+	}{
+		{"cpu-clock", &Event{Name: "cpu-clock", Kind: Perf, Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_CPU_CLOCK}},
+		{"page-faults", &Event{Name: "page-faults", Kind: Perf, Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_PAGE_FAULTS}},
+		{"cs", &Event{Name: "cs", Kind: Perf, Type: unix.PERF_TYPE_SOFTWARE, Config: unix.PERF_COUNT_SW_CONTEXT_SWITCHES}},
+		{"cache-misses", &Event{Name: "cache-misses", Kind: Perf, Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_CACHE_MISSES}},
+		{"ref-cycles", &Event{Name: "ref-cycles", Kind: Perf, Type: unix.PERF_TYPE_HARDWARE, Config: unix.PERF_COUNT_HW_REF_CPU_CYCLES}},
+		{"r003c", &Event{Name: "r003c", Kind: Perf, Type: unix.PERF_TYPE_RAW, Config: 0x3c}},
+		{"r1A8", &Event{Name: "r1A8", Kind: Perf, Type: unix.PERF_TYPE_RAW, Config: 0x1a8}},
+		{"tracepoint:sched:sched_wakeup", &Event{Name: "tracepoint:sched:sched_wakeup", Kind: Tracepoint, Target: "sched:sched_wakeup"}},
+		{"kprobe:tcp_sendmsg", &Event{Name: "kprobe:tcp_sendmsg", Kind: Kprobe, Target: "tcp_sendmsg"}},
+	} {
+		got, err := Parse(tc.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"cpu",
+		"r",
+		"rxyz",
+		"tracepoint:",
+		"tracepoint:sched",
+		"tracepoint:sched:",
+		"tracepoint::sched_wakeup",
+		"tracepoint:sched:sched_wakeup:extra",
+		"kprobe:",
+	} {
+		if e, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) = %+v, want an error", spec, e)
+		}
+	}
+}
+
+func TestAttr(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		spec         string
+		freq, period uint64
+		sample       uint64
+		bits         uint64
+	}{
+		{"frequency", "cpu-clock", 99, 0, 99, unix.PerfBitDisabled | unix.PerfBitFreq},
+		{"period", "cpu-clock", 99, 10000000, 10000000, unix.PerfBitDisabled},
+		{"hardware period", "cache-misses", 0, 10000, 10000, unix.PerfBitDisabled},
+		{"raw frequency", "r003c", 1000, 0, 1000, unix.PerfBitDisabled | unix.PerfBitFreq},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := Parse(tc.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attr := e.Attr(tc.freq, tc.period)
+			if attr.Type != e.Type || attr.Config != e.Config {
+				t.Errorf("type/config %d/%#x, want %d/%#x", attr.Type, attr.Config, e.Type, e.Config)
+			}
+			if attr.Sample != tc.sample {
+				t.Errorf("sample %d, want %d", attr.Sample, tc.sample)
+			}
+			if attr.Bits != tc.bits {
+				t.Errorf("bits %#x, want %#x", attr.Bits, tc.bits)
+			}
+			if attr.Size == 0 {
+				t.Error("size of the attributes left to zero")
+			}
+		})
+	}
+}
+
+func TestValueTypes(t *testing.T) {
+	samples := &profile.ValueType{Type: "samples", Unit: "count"}
+	for _, tc := range []struct {
+		name         string
+		spec         string
+		freq, period uint64
+		want         pprof.ValueTypes
+	}{
+		{"clock at a frequency", "cpu-clock", 100, 0, pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+			Period:     10000000,
+			SampleType: []*profile.ValueType{samples, {Type: "cpu", Unit: "nanoseconds"}},
+			Weighted:   []bool{false, true},
+		}},
+		{"clock with a period", "task-clock", 100, 2000000, pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+			Period:     2000000,
+			SampleType: []*profile.ValueType{samples, {Type: "cpu", Unit: "nanoseconds"}},
+			Weighted:   []bool{false, true},
+		}},
+		{"hardware counter at a frequency", "cycles", 100, 0, pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: "cycles", Unit: "count"},
+			Period:     1,
+			SampleType: []*profile.ValueType{samples, {Type: "cycles", Unit: "count"}},
+			Weighted:   []bool{false, true},
+		}},
+		{"software event with a period", "page-faults", 0, 100, pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: "page-faults", Unit: "count"},
+			Period:     100,
+			SampleType: []*profile.ValueType{samples, {Type: "page-faults", Unit: "count"}},
+			Weighted:   []bool{false, true},
+		}},
+		{"raw event", "r003c", 0, 1000, pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: "r003c", Unit: "count"},
+			Period:     1000,
+			SampleType: []*profile.ValueType{samples, {Type: "r003c", Unit: "count"}},
+			Weighted:   []bool{false, true},
+		}},
+		{"tracepoint", "tracepoint:sched:sched_wakeup", 100, 0, pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: "tracepoint:sched:sched_wakeup", Unit: "count"},
+			Period:     1,
+			SampleType: []*profile.ValueType{samples},
+			Weighted:   []bool{false},
+		}},
+		{"kprobe", "kprobe:tcp_sendmsg", 0, 10, pprof.ValueTypes{
+			PeriodType: &profile.ValueType{Type: "kprobe:tcp_sendmsg", Unit: "count"},
+			Period:     1,
+			SampleType: []*profile.ValueType{samples},
+			Weighted:   []bool{false},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := Parse(tc.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.ValueTypes(tc.freq, tc.period); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestIsClock(t *testing.T) {
+	for spec, want := range map[string]bool{
+		"cpu-clock":          true,
+		"task-clock":         true,
+		"page-faults":        false,
+		"cycles":             false,
+		"kprobe:tcp_sendmsg": false,
+	} {
+		e, err := Parse(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.IsClock(); got != want {
+			t.Errorf("%s: IsClock() = %v, want %v", spec, got, want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package flamegraph
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// KernelSuffix marks kernel frames in folded stacks, as stackcollapse-perf.pl --kernel does
+const KernelSuffix = "_[k]"
+
+// Stack is a folded stack, root first, and the sum of the values of its samples
+type Stack struct {
+	Frames []string
+	Count  int64
+}
+
+// ValueIndex returns the index of the sample values the stacks of the profile are folded
+// with: the ones of its period type, e.g. the cpu or blocked nanoseconds the samples weigh
+// rather than their number, or the last ones as pprof defaults to
+func ValueIndex(p *profile.Profile) int {
+	if p.PeriodType != nil {
+		for i, st := range p.SampleType {
+			if st.Type == p.PeriodType.Type && st.Unit == p.PeriodType.Unit {
+				return i
+			}
+		}
+	}
+	if len(p.SampleType) == 0 {
+		return 0
+	}
+	return len(p.SampleType) - 1
+}
+
+// valueName is what the values of the index measure, e.g. samples or nanoseconds
+func valueName(p *profile.Profile, index int) string {
+	if index >= len(p.SampleType) {
+		return "samples"
+	}
+	if st := p.SampleType[index]; st.Unit != "count" {
+		return st.Unit
+	}
+	return p.SampleType[index].Type
+}
+
+// Fold collapses the samples of the profile into folded stacks, the comm of the process
+// being the root frame, summing their values of the index. The stacks are sorted,
+// identical stacks are aggregated.
+func Fold(p *profile.Profile, index int) []Stack {
+	counts := map[string]int64{}
+	for _, s := range p.Sample {
+		counts[strings.Join(Frames(s), ";")] += s.Value[index]
+	}
+
+	stacks := make([]Stack, 0, len(counts))
+	for folded, count := range counts {
+		stacks = append(stacks, Stack{
+			Frames: strings.Split(folded, ";"),
+			Count:  count,
+		})
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		return strings.Join(stacks[i].Frames, ";") < strings.Join(stacks[j].Frames, ";")
+	})
+	return stacks
+}
+
+// Frames returns the frames of the sample root first, the comm of the process being the root
+func Frames(s *profile.Sample) []string {
+	var frames []string
+	if comm := s.Label["comm"]; len(comm) > 0 {
+		frames = append(frames, escape(comm[0]))
+	}
+	// Locations are leaf first, the lines of a location innermost first
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		l := s.Location[i]
+		if len(l.Line) == 0 {
+			frames = append(frames, fmt.Sprintf("0x%x", l.Address))
+			continue
+		}
+		for j := len(l.Line) - 1; j >= 0; j-- {
+			frames = append(frames, frameName(l, l.Line[j]))
+		}
+	}
+	return frames
+}
+
+// WriteFolded writes the profile as Brendan Gregg's collapsed stacks, i.e. "comm;func1;func2 count",
+// the count being the sum of the values of the index
+func WriteFolded(w io.Writer, p *profile.Profile, index int) error {
+	bw := bufio.NewWriter(w)
+	for _, s := range Fold(p, index) {
+		if _, err := fmt.Fprintf(bw, "%s %d\n", strings.Join(s.Frames, ";"), s.Count); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func frameName(l *profile.Location, line profile.Line) string {
+	name := fmt.Sprintf("0x%x", l.Address)
+	if line.Function != nil && line.Function.Name != "" {
+		name = line.Function.Name
+	}
+	name = escape(name)
+	if isKernel(l, line) {
+		name += KernelSuffix
+	}
+	return name
+}
+
+// escape replaces ';', which separates frames, and ' ', which separates the count
+func escape(name string) string {
+	return strings.NewReplacer(";", ":", " ", "_").Replace(name)
+}
+
+func isKernel(l *profile.Location, line profile.Line) bool {
+	if line.Function != nil && line.Function.SystemName == "kernel" {
+		return true
+	}
+	return l.Mapping != nil && l.Mapping.File == "[kernel.kallsyms]"
+}
@@ -0,0 +1,140 @@
+package flamegraph
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteFolded(t *testing.T) {
+	kernel := &profile.Mapping{ID: 1, File: "[kernel.kallsyms]"}
+	user := &profile.Mapping{ID: 2, File: "/usr/bin/app"}
+	functions := []*profile.Function{
+		{ID: 1, Name: "do_syscall_64", SystemName: "kernel"},
+		{ID: 2, Name: "main.work", SystemName: "User"},
+		{ID: 3, Name: "main.main", SystemName: "User"},
+		{ID: 4, Name: "runtime.main", SystemName: "User"},
+	}
+	var locations []*profile.Location
+	for i, f := range functions {
+		m := user
+		if f.SystemName == "kernel" {
+			m = kernel
+		}
+		locations = append(locations, &profile.Location{
+			ID:      uint64(i + 1),
+			Mapping: m,
+			Address: uint64(0x1000 * (i + 1)),
+			Line:    []profile.Line{{Function: f}},
+		})
+	}
+	comm := map[string][]string{"comm": {"app"}}
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: locations, Value: []int64{3}, Label: comm},
+			{Location: locations[1:], Value: []int64{2}, Label: comm},
+			// Same stack as the first one, e.g. seen with a different stack id
+			{Location: locations, Value: []int64{1}, Label: comm},
+			// Unsymbolized frame
+			{Location: []*profile.Location{{ID: 5, Address: 0xdead}, locations[3]}, Value: []int64{4}, Label: comm},
+		},
+		Mapping:  []*profile.Mapping{kernel, user},
+		Location: locations,
+		Function: functions,
+	}
+
+	var buf bytes.Buffer
+	if err := WriteFolded(&buf, p, 0); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"app;runtime.main;0xdead 4",
+		"app;runtime.main;main.main;main.work 2",
+		"app;runtime.main;main.main;main.work;do_syscall_64_[k] 4",
+		"",
+	}, "\n")
+	if got := buf.String(); got != want {
+		t.Errorf("folded stacks:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := WriteSVG(&buf, p, "test", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "do_syscall_64_[k] (4 samples") {
+		t.Errorf("flame graph misses the kernel frame:\n%s", buf.String())
+	}
+}
+
+func TestFoldWeighted(t *testing.T) {
+	work := &profile.Function{ID: 1, Name: "main.work"}
+	wait := &profile.Function{ID: 2, Name: "main.wait"}
+	locations := []*profile.Location{
+		{ID: 1, Address: 0x1000, Line: []profile.Line{{Function: work}}},
+		{ID: 2, Address: 0x2000, Line: []profile.Line{{Function: wait}}},
+	}
+	comm := map[string][]string{"comm": {"app"}}
+	p := &profile.Profile{
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Sample: []*profile.Sample{
+			// Seen more often, but for less time
+			{Location: locations[:1], Value: []int64{3, 3000}, Label: comm},
+			{Location: locations[1:], Value: []int64{1, 50000}, Label: comm},
+		},
+		Location: locations,
+		Function: []*profile.Function{work, wait},
+	}
+
+	index := ValueIndex(p)
+	if index != 1 {
+		t.Fatalf("value index %d, want the cpu nanoseconds", index)
+	}
+	var buf bytes.Buffer
+	if err := WriteFolded(&buf, p, index); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "app;main.wait 50000\napp;main.work 3000\n"; got != want {
+		t.Errorf("folded stacks:\n%s\nwant:\n%s", got, want)
+	}
+
+	buf.Reset()
+	if err := WriteSVG(&buf, p, "test", index); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "main.wait (50000 nanoseconds") {
+		t.Errorf("flame graph misses the weighted frame:\n%s", buf.String())
+	}
+
+	// Without a period type, the last values are used like pprof does
+	p.PeriodType = nil
+	if got := ValueIndex(p); got != 1 {
+		t.Errorf("value index %d without period type, want 1", got)
+	}
+}
+
+func TestFoldedComm(t *testing.T) {
+	f := &profile.Function{ID: 1, Name: "main.main"}
+	l := &profile.Location{ID: 1, Address: 0x1000, Line: []profile.Line{{Function: f}}}
+	s := &profile.Sample{Location: []*profile.Location{l}, Value: []int64{1}, Label: map[string][]string{"comm": {"my app;1"}}}
+	if got, want := strings.Join(Frames(s), ";"), "my_app:1;main.main"; got != want {
+		t.Errorf("folded stack %q, want %q", got, want)
+	}
+}
+
+func TestLabel(t *testing.T) {
+	// Wide enough for 6 characters
+	width := float64(6 + 6*charWidth)
+	if got, want := label("main.main", width), "main.."; got != want {
+		t.Errorf("label %q, want %q", got, want)
+	}
+	if got, want := label("héllo·wörld", width), "héll.."; got != want {
+		t.Errorf("label %q, want %q", got, want)
+	}
+	if got, want := label("héllo", width), "héllo"; got != want {
+		t.Errorf("label %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,188 @@
+package flamegraph
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+const (
+	width       = 1200
+	frameHeight = 16
+	fontSize    = 12
+	// Average glyph width of the font, used to truncate the labels to the frame width
+	charWidth  = 7
+	padTop     = 30
+	padBottom  = 10
+	padSide    = 10
+	minWidthPx = 0.1
+)
+
+// node is a frame in the flame graph, its value includes the values of its children
+type node struct {
+	name     string
+	value    int64
+	children map[string]*node
+}
+
+func (n *node) child(name string) *node {
+	c, ok := n.children[name]
+	if !ok {
+		c = &node{name: name, children: map[string]*node{}}
+		n.children[name] = c
+	}
+	return c
+}
+
+// sortedChildren returns the children sorted by name, like flamegraph.pl does
+func (n *node) sortedChildren() []*node {
+	children := make([]*node, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	return children
+}
+
+func (n *node) depth() int {
+	d := 0
+	for _, c := range n.children {
+		if cd := c.depth() + 1; cd > d {
+			d = cd
+		}
+	}
+	return d
+}
+
+// WriteSVG renders the profile as a self-contained interactive flame graph, click a frame
+// to zoom into it. Kernel frames are orange, Go runtime frames aqua and other user frames red/yellow.
+// The frames are as wide as the sum of the values of the index of their samples.
+func WriteSVG(w io.Writer, p *profile.Profile, title string, index int) error {
+	root := &node{name: "all", children: map[string]*node{}}
+	for _, s := range Fold(p, index) {
+		root.value += s.Count
+		n := root
+		for _, f := range s.Frames {
+			n = n.child(f)
+			n.value += s.Count
+		}
+	}
+
+	height := (root.depth()+1)*frameHeight + padTop + padBottom
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, svgHeader, width, height, width, height)
+	fmt.Fprintf(bw, `<text x="%d" y="20" text-anchor="middle" font-size="16">%s</text>`+"\n", width/2, html.EscapeString(title))
+	fmt.Fprintf(bw, `<text id="reset" x="%d" y="20" onclick="unzoom()" style="cursor:pointer;display:none">Reset Zoom</text>`+"\n", padSide)
+	if root.value > 0 {
+		writeFrames(bw, root, 0, 0, root.value, height, valueName(p, index))
+	}
+	fmt.Fprintf(bw, svgFooter, width, padSide, charWidth)
+	return bw.Flush()
+}
+
+// writeFrames writes the frame and its children, x being the position of the frame in
+// values, which measure unit
+func writeFrames(w io.Writer, n *node, depth int, x, total int64, height int, unit string) {
+	scale := float64(width-2*padSide) / float64(total)
+	fw := float64(n.value) * scale
+	if fw < minWidthPx {
+		return
+	}
+	fx := float64(padSide) + float64(x)*scale
+	fy := height - padBottom - (depth+1)*frameHeight
+
+	name := html.EscapeString(n.name)
+	fmt.Fprintf(w, `<g class="f" data-x="%d" data-w="%d" data-d="%d" onclick="zoom(this)">`, x, n.value, depth)
+	fmt.Fprintf(w, `<title>%s (%d %s, %.2f%%)</title>`, name, n.value, unit, 100*float64(n.value)/float64(total))
+	fmt.Fprintf(w, `<rect x="%.1f" y="%d" width="%.1f" height="%d" fill="%s" rx="2" ry="2"/>`, fx, fy, fw, frameHeight-1, color(n.name))
+	fmt.Fprintf(w, `<text x="%.1f" y="%d" data-name="%s">%s</text>`, fx+3, fy+fontSize, name, html.EscapeString(label(n.name, fw)))
+	fmt.Fprintln(w, `</g>`)
+
+	for _, c := range n.sortedChildren() {
+		writeFrames(w, c, depth+1, x, total, height, unit)
+		x += c.value
+	}
+}
+
+// label truncates the name to what fits in a frame of the width
+func label(name string, width float64) string {
+	chars := int((width - 6) / charWidth)
+	if chars < 3 {
+		return ""
+	}
+	// Truncated by runes, not to split a multibyte one
+	runes := []rune(name)
+	if len(runes) <= chars {
+		return name
+	}
+	return string(runes[:chars-2]) + ".."
+}
+
+// color picks a color by the kind of the frame, varied by a hash of its name so that
+// neighbouring frames can be told apart
+func color(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	v := float64(h.Sum32()%1000) / 1000
+
+	switch {
+	case strings.HasSuffix(name, KernelSuffix):
+		return fmt.Sprintf("rgb(%d,%d,%d)", 230+int(25*v), 120+int(60*v), 40)
+	case strings.HasPrefix(name, "runtime.") || strings.HasPrefix(name, "runtime/"):
+		return fmt.Sprintf("rgb(%d,%d,%d)", 50+int(60*v), 180+int(50*v), 200+int(55*v))
+	default:
+		return fmt.Sprintf("rgb(%d,%d,%d)", 205+int(50*v), int(230*v), int(55*v))
+	}
+}
+
+const svgHeader = `<?xml version="1.0" standalone="no"?>
+<svg version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg" font-family="Verdana, sans-serif" font-size="12">
+<style>
+.f text { pointer-events: none; }
+.f:hover rect { stroke: black; stroke-width: 0.5; cursor: pointer; }
+</style>
+<rect x="0" y="0" width="100%%" height="100%%" fill="rgb(248,248,248)"/>
+`
+
+const svgFooter = `<script type="text/ecmascript"><![CDATA[
+var width = %d, pad = %d, charWidth = %d;
+var frames = document.getElementsByClassName("f");
+var total = 0;
+for (var i = 0; i < frames.length; i++) {
+	if (frames[i].dataset.d == "0") total = +frames[i].dataset.w;
+}
+function layout(x0, w0, d0) {
+	var scale = (width - 2 * pad) / w0;
+	for (var i = 0; i < frames.length; i++) {
+		var f = frames[i], x = +f.dataset.x, w = +f.dataset.w, d = +f.dataset.d;
+		// Ancestors of the zoomed frame span the whole width, the others are its descendants
+		var visible = d < d0 ? x <= x0 && x + w >= x0 + w0 : x + w > x0 && x < x0 + w0;
+		f.style.display = visible ? "" : "none";
+		if (!visible) continue;
+		var rect = f.getElementsByTagName("rect")[0], text = f.getElementsByTagName("text")[0];
+		var fx = pad + (Math.max(x, x0) - x0) * scale;
+		var fw = (Math.min(x + w, x0 + w0) - Math.max(x, x0)) * scale;
+		rect.setAttribute("x", fx.toFixed(1));
+		rect.setAttribute("width", fw.toFixed(1));
+		text.setAttribute("x", (fx + 3).toFixed(1));
+		var name = text.dataset.name, chars = Math.floor((fw - 6) / charWidth);
+		text.textContent = chars < 3 ? "" : (name.length <= chars ? name : name.substring(0, chars - 2) + "..");
+	}
+}
+function zoom(f) {
+	layout(+f.dataset.x, +f.dataset.w, +f.dataset.d);
+	document.getElementById("reset").style.display = "";
+}
+function unzoom() {
+	layout(0, total, 0);
+	document.getElementById("reset").style.display = "none";
+}
+]]></script>
+</svg>
+`
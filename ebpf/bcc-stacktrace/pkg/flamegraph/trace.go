@@ -0,0 +1,123 @@
+package flamegraph
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// traceEvent is an event of the Chrome trace event format, times being in microseconds
+type traceEvent struct {
+	Name string            `json:"name"`
+	Ph   string            `json:"ph"`
+	Ts   float64           `json:"ts"`
+	Dur  float64           `json:"dur,omitempty"`
+	Pid  int64             `json:"pid"`
+	Tid  int64             `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+type thread struct {
+	pid, tid int64
+}
+
+type timedStack struct {
+	time   int64
+	frames []string
+}
+
+type openFrame struct {
+	name  string
+	start int64
+}
+
+// WriteTrace writes the samples of the profile as Chrome trace event JSON, a flame chart
+// per thread to be opened in chrome://tracing or Perfetto. Only the samples with timestamp,
+// pid and tid labels are written. Consecutive samples sharing frames are joined, each
+// sample lasting the period of the profile if it is a time, or until the next sample.
+func WriteTrace(w io.Writer, p *profile.Profile) error {
+	stacks := map[thread][]timedStack{}
+	comms := map[thread]string{}
+	for _, s := range p.Sample {
+		if len(s.NumLabel["timestamp"]) == 0 || len(s.NumLabel["pid"]) == 0 || len(s.NumLabel["tid"]) == 0 {
+			continue
+		}
+		th := thread{pid: s.NumLabel["pid"][0], tid: s.NumLabel["tid"][0]}
+		frames := Frames(s)
+		if comm := s.Label["comm"]; len(comm) > 0 {
+			// The comm is the name of the thread rather than a frame
+			comms[th] = comm[0]
+			frames = frames[1:]
+		}
+		stacks[th] = append(stacks[th], timedStack{time: s.NumLabel["timestamp"][0], frames: frames})
+	}
+
+	var period int64
+	if p.PeriodType != nil && p.PeriodType.Unit == "nanoseconds" {
+		period = p.Period
+	}
+	micros := func(t int64) float64 { return float64(t-p.TimeNanos) / 1000 }
+
+	threads := make([]thread, 0, len(stacks))
+	for th := range stacks {
+		threads = append(threads, th)
+	}
+	sort.Slice(threads, func(i, j int) bool {
+		if threads[i].pid != threads[j].pid {
+			return threads[i].pid < threads[j].pid
+		}
+		return threads[i].tid < threads[j].tid
+	})
+
+	events := []traceEvent{}
+	for _, th := range threads {
+		if comm, ok := comms[th]; ok {
+			events = append(events, traceEvent{Name: "thread_name", Ph: "M", Pid: th.pid, Tid: th.tid, Args: map[string]string{"name": comm}})
+		}
+		samples := stacks[th]
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].time < samples[j].time })
+
+		var open []openFrame
+		var end int64
+		closeFrames := func(depth int, at int64) {
+			for i := len(open) - 1; i >= depth; i-- {
+				events = append(events, traceEvent{
+					Name: open[i].name,
+					Ph:   "X",
+					Ts:   micros(open[i].start),
+					Dur:  float64(at-open[i].start) / 1000,
+					Pid:  th.pid,
+					Tid:  th.tid,
+				})
+			}
+			open = open[:depth]
+		}
+		for i, s := range samples {
+			dur := period
+			if dur == 0 && i+1 < len(samples) {
+				dur = samples[i+1].time - s.time
+			}
+			// A gap in the samples, e.g. the thread was not running
+			if s.time > end+period/2 {
+				closeFrames(0, end)
+			}
+			depth := 0
+			for depth < len(open) && depth < len(s.frames) && open[depth].name == s.frames[depth] {
+				depth++
+			}
+			closeFrames(depth, s.time)
+			for _, name := range s.frames[depth:] {
+				open = append(open, openFrame{name: name, start: s.time})
+			}
+			end = s.time + dur
+		}
+		closeFrames(0, end)
+	}
+
+	return json.NewEncoder(w).Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ns"})
+}
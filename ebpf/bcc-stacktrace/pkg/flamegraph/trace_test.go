@@ -0,0 +1,67 @@
+package flamegraph
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteTrace(t *testing.T) {
+	var functions []*profile.Function
+	var locations []*profile.Location
+	for i, name := range []string{"main.a", "main.b", "main.main"} {
+		f := &profile.Function{ID: uint64(i + 1), Name: name}
+		functions = append(functions, f)
+		locations = append(locations, &profile.Location{ID: uint64(i + 1), Line: []profile.Line{{Function: f}}})
+	}
+	a, b, root := locations[0], locations[1], locations[2]
+	sample := func(ms int64, locs ...*profile.Location) *profile.Sample {
+		return &profile.Sample{
+			Location: locs,
+			Value:    []int64{1},
+			Label:    map[string][]string{"comm": {"app"}},
+			NumLabel: map[string][]int64{"pid": {1}, "tid": {2}, "timestamp": {1000000 * ms}},
+		}
+	}
+	p := &profile.Profile{
+		PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:     1000000,
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			// Out of order on purpose
+			sample(1, b, root),
+			sample(0, a, root),
+			// Not contiguous with the previous ones
+			sample(5, a, root),
+			// Sampled without the timestamp, left out
+			{Location: []*profile.Location{a}, Value: []int64{1}},
+		},
+		Location: locations,
+		Function: functions,
+	}
+
+	var buf bytes.Buffer
+	if err := WriteTrace(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		TraceEvents []traceEvent
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []traceEvent{
+		{Name: "thread_name", Ph: "M", Pid: 1, Tid: 2, Args: map[string]string{"name": "app"}},
+		{Name: "main.a", Ph: "X", Ts: 0, Dur: 1000, Pid: 1, Tid: 2},
+		{Name: "main.b", Ph: "X", Ts: 1000, Dur: 1000, Pid: 1, Tid: 2},
+		{Name: "main.main", Ph: "X", Ts: 0, Dur: 2000, Pid: 1, Tid: 2},
+		{Name: "main.a", Ph: "X", Ts: 5000, Dur: 1000, Pid: 1, Tid: 2},
+		{Name: "main.main", Ph: "X", Ts: 5000, Dur: 1000, Pid: 1, Tid: 2},
+	}
+	if !reflect.DeepEqual(got.TraceEvents, want) {
+		t.Errorf("trace events:\n%+v\nwant:\n%+v", got.TraceEvents, want)
+	}
+}
@@ -0,0 +1,280 @@
+// Package goroutine finds where the Go runtime of a binary keeps the goroutine id and the
+// runtime/pprof labels, and reads these labels out of the memory of a process.
+package goroutine
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// LabelsFormat is how runtime/pprof stores the labels of a goroutine, which changed
+// across Go versions
+type LabelsFormat int
+
+const (
+	// NoLabels is for binaries not linking runtime/pprof, no labels can be set
+	NoLabels LabelsFormat = iota
+	// MapLabels is a map[string]string, up to Go 1.23
+	MapLabels
+	// SliceLabels is a slice of key/value pairs sorted by key, since Go 1.24
+	SliceLabels
+)
+
+// Offsets are where the goroutine id and the labels are in struct g of a binary
+type Offsets struct {
+	Goid   uint64
+	Labels uint64
+	Format LabelsFormat
+}
+
+// ErrNotGo is returned for binaries without a Go runtime, or stripped of their DWARF
+var ErrNotGo = errors.New("no runtime.g in the debug info")
+
+// ReadOffsets reads the offsets from the DWARF of the binary
+func ReadOffsets(path string) (*Offsets, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if f.Section(".go.buildinfo") == nil && f.Section(".gopclntab") == nil {
+		return nil, ErrNotGo
+	}
+	d, err := f.DWARF()
+	if err != nil {
+		return nil, ErrNotGo
+	}
+
+	var o *Offsets
+	// Named types have a typedef, a named struct has its struct type as well
+	var labelMap, labelStruct bool
+	var swiss bool
+	r := d.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, fmt.Errorf("reading DWARF of %s: %w", path, err)
+		}
+		if e == nil {
+			break
+		}
+		switch e.Tag {
+		case dwarf.TagCompileUnit:
+			continue
+		case dwarf.TagStructType, dwarf.TagTypedef:
+			switch e.Val(dwarf.AttrName) {
+			case "runtime.g":
+				if e.Tag != dwarf.TagStructType || !e.Children {
+					break
+				}
+				if o, err = readG(r); err != nil {
+					return nil, fmt.Errorf("reading runtime.g of %s: %w", path, err)
+				}
+				continue
+			case "runtime/pprof.labelMap":
+				labelMap = true
+				labelStruct = labelStruct || e.Tag == dwarf.TagStructType
+			case "internal/runtime/maps.Map":
+				swiss = true
+			}
+		}
+		r.SkipChildren()
+	}
+	if o == nil {
+		return nil, ErrNotGo
+	}
+
+	switch {
+	case labelStruct:
+		o.Format = SliceLabels
+	case labelMap && !swiss:
+		o.Format = MapLabels
+	case labelMap:
+		return nil, fmt.Errorf("labels of %s are kept in swiss tables, which are not supported", path)
+	}
+	return o, nil
+}
+
+// readG reads the offsets of the members of runtime.g, the reader being at its first one
+func readG(r *dwarf.Reader) (*Offsets, error) {
+	o := &Offsets{}
+	var goid, labels bool
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil || e.Tag == 0 {
+			break
+		}
+		off, ok := e.Val(dwarf.AttrDataMemberLoc).(int64)
+		switch e.Val(dwarf.AttrName) {
+		case "goid":
+			o.Goid, goid = uint64(off), ok
+		case "labels":
+			o.Labels, labels = uint64(off), ok
+		}
+		r.SkipChildren()
+	}
+	if !goid || !labels {
+		return nil, errors.New("missing goid or labels")
+	}
+	return o, nil
+}
+
+// Bounds of what is read from the process, labels are a few short strings
+const (
+	maxLabels    = 64
+	maxStringLen = 1024
+	// A map of maxLabels has 2^4 buckets
+	maxBucketsLog = 4
+	maxOverflows  = 8
+)
+
+// ReadLabels reads the labels the goroutine of a process had, addr being the labels
+// pointer of its struct g, mem the memory of the process, e.g. /proc/<pid>/mem
+func ReadLabels(mem io.ReaderAt, addr uint64, format LabelsFormat) (map[string]string, error) {
+	if addr == 0 {
+		return nil, nil
+	}
+	switch format {
+	case SliceLabels:
+		return readSliceLabels(mem, addr)
+	case MapLabels:
+		return readMapLabels(mem, addr)
+	}
+	return nil, nil
+}
+
+// readSliceLabels reads a labelMap holding a []struct{Key, Value string}
+func readSliceLabels(mem io.ReaderAt, addr uint64) (map[string]string, error) {
+	header, err := readWords(mem, addr, 3)
+	if err != nil {
+		return nil, err
+	}
+	n := header[1]
+	if n > maxLabels {
+		return nil, fmt.Errorf("%d labels at 0x%x", n, addr)
+	}
+	pairs, err := readWords(mem, header[0], int(n)*4)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string, n)
+	for i := 0; i < len(pairs); i += 4 {
+		if err := addLabel(mem, labels, pairs[i:i+4]); err != nil {
+			return nil, err
+		}
+	}
+	return labels, nil
+}
+
+// Layout of the buckets of a map[string]string before swiss tables: 8 top hashes,
+// 8 keys, 8 values and the overflow bucket
+const (
+	bucketSize   = 8
+	minTopHash   = 5
+	sameSizeGrow = 8
+)
+
+// readMapLabels reads a labelMap holding a map[string]string, walking its buckets
+func readMapLabels(mem io.ReaderAt, addr uint64) (map[string]string, error) {
+	hmap, err := readWords(mem, addr, 1)
+	if err != nil {
+		return nil, err
+	}
+	// count, flags|B|noverflow|hash0, buckets, oldbuckets
+	header, err := readWords(mem, hmap[0], 4)
+	if err != nil {
+		return nil, err
+	}
+	b := (header[1] >> 8) & 0xff
+	if b > maxBucketsLog {
+		return nil, fmt.Errorf("map of 2^%d buckets at 0x%x", b, hmap[0])
+	}
+	labels := map[string]string{}
+	// Entries not yet moved while the map grows are still in the old buckets
+	for i, buckets := range []uint64{header[2], header[3]} {
+		n := uint64(1) << b
+		if i == 1 && header[1]&sameSizeGrow == 0 {
+			n >>= 1
+		}
+		for j := uint64(0); buckets != 0 && j < n; j++ {
+			if err := readBuckets(mem, buckets+j*bucketBytes, labels); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return labels, nil
+}
+
+const bucketBytes = bucketSize + bucketSize*16*2 + 8
+
+// readBuckets adds the entries of a bucket and its overflow buckets
+func readBuckets(mem io.ReaderAt, addr uint64, labels map[string]string) error {
+	for i := 0; addr != 0 && i <= maxOverflows; i++ {
+		buf := make([]byte, bucketBytes)
+		if _, err := mem.ReadAt(buf, int64(addr)); err != nil {
+			return fmt.Errorf("reading bucket at 0x%x: %w", addr, err)
+		}
+		words := make([]uint64, (bucketBytes-bucketSize)/8)
+		for j := range words {
+			words[j] = binary.LittleEndian.Uint64(buf[bucketSize+j*8:])
+		}
+		for j := 0; j < bucketSize; j++ {
+			if buf[j] < minTopHash {
+				continue
+			}
+			pair := []uint64{words[j*2], words[j*2+1], words[(bucketSize+j)*2], words[(bucketSize+j)*2+1]}
+			if err := addLabel(mem, labels, pair); err != nil {
+				return err
+			}
+		}
+		addr = words[len(words)-1]
+	}
+	return nil
+}
+
+// addLabel reads the key and the value strings, given by their pointers and lengths
+func addLabel(mem io.ReaderAt, labels map[string]string, pair []uint64) error {
+	key, err := readString(mem, pair[0], pair[1])
+	if err != nil {
+		return err
+	}
+	value, err := readString(mem, pair[2], pair[3])
+	if err != nil {
+		return err
+	}
+	labels[key] = value
+	return nil
+}
+
+func readString(mem io.ReaderAt, addr, n uint64) (string, error) {
+	if n == 0 {
+		return "", nil
+	}
+	if n > maxStringLen {
+		return "", fmt.Errorf("string of %d bytes at 0x%x", n, addr)
+	}
+	buf := make([]byte, n)
+	if _, err := mem.ReadAt(buf, int64(addr)); err != nil {
+		return "", fmt.Errorf("reading string at 0x%x: %w", addr, err)
+	}
+	return string(buf), nil
+}
+
+func readWords(mem io.ReaderAt, addr uint64, n int) ([]uint64, error) {
+	buf := make([]byte, n*8)
+	if _, err := mem.ReadAt(buf, int64(addr)); err != nil {
+		return nil, fmt.Errorf("reading 0x%x: %w", addr, err)
+	}
+	words := make([]uint64, n)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint64(buf[i*8:])
+	}
+	return words, nil
+}
@@ -0,0 +1,125 @@
+package goroutine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadOffsets(t *testing.T) {
+	// Test binaries are built without debug info
+	exe := filepath.Join(t.TempDir(), "labels")
+	out, err := exec.Command("go", "build", "-o", exe, "./testdata/labels").CombinedOutput()
+	if err != nil {
+		t.Fatalf("building testdata/labels: %v\n%s", err, out)
+	}
+	o, err := ReadOffsets(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Goid == 0 || o.Labels == 0 || o.Goid == o.Labels {
+		t.Errorf("offsets: goid %d, labels %d", o.Goid, o.Labels)
+	}
+	if o.Format == NoLabels {
+		t.Error("labels format not found")
+	}
+
+	if _, err := ReadOffsets("/bin/sh"); err != ErrNotGo {
+		t.Errorf("reading offsets of /bin/sh: %v, want %v", err, ErrNotGo)
+	}
+}
+
+// fakeMem is the memory of a process, from base on
+type fakeMem struct {
+	base uint64
+	buf  []byte
+}
+
+func (m *fakeMem) ReadAt(p []byte, off int64) (int, error) {
+	start := uint64(off) - m.base
+	if uint64(off) < m.base || start+uint64(len(p)) > uint64(len(m.buf)) {
+		return 0, fmt.Errorf("bad address 0x%x", off)
+	}
+	return copy(p, m.buf[start:]), nil
+}
+
+// alloc copies the bytes to memory, returning their address
+func (m *fakeMem) alloc(b []byte) uint64 {
+	addr := m.base + uint64(len(m.buf))
+	m.buf = append(m.buf, b...)
+	// Keep the words aligned
+	for len(m.buf)%8 != 0 {
+		m.buf = append(m.buf, 0)
+	}
+	return addr
+}
+
+func (m *fakeMem) words(words ...uint64) uint64 {
+	b := make([]byte, len(words)*8)
+	for i, w := range words {
+		binary.LittleEndian.PutUint64(b[i*8:], w)
+	}
+	return m.alloc(b)
+}
+
+// str returns a string header, i.e. the address and length of the string
+func (m *fakeMem) str(s string) []uint64 {
+	return []uint64{m.alloc([]byte(s)), uint64(len(s))}
+}
+
+func TestReadLabels(t *testing.T) {
+	want := map[string]string{"handler": "/api/users", "tenant": "acme"}
+
+	mem := &fakeMem{base: 0xc000010000}
+	var pairs []uint64
+	for _, kv := range [][2]string{{"handler", "/api/users"}, {"tenant", "acme"}} {
+		pairs = append(pairs, mem.str(kv[0])...)
+		pairs = append(pairs, mem.str(kv[1])...)
+	}
+	list := mem.words(pairs...)
+	labelMap := mem.words(list, 2, 2)
+	got, err := ReadLabels(mem, labelMap, SliceLabels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("slice labels: %v, want %v", got, want)
+	}
+
+	// A map of a single bucket, with an empty slot then the two labels, the second one
+	// in an overflow bucket
+	mem = &fakeMem{base: 0xc000010000}
+	bucket := func(tophash []byte, keys, values [][]uint64, overflow uint64) uint64 {
+		b := make([]byte, bucketBytes)
+		copy(b, tophash)
+		for i := range keys {
+			binary.LittleEndian.PutUint64(b[bucketSize+i*16:], keys[i][0])
+			binary.LittleEndian.PutUint64(b[bucketSize+i*16+8:], keys[i][1])
+			binary.LittleEndian.PutUint64(b[bucketSize+bucketSize*16+i*16:], values[i][0])
+			binary.LittleEndian.PutUint64(b[bucketSize+bucketSize*16+i*16+8:], values[i][1])
+		}
+		binary.LittleEndian.PutUint64(b[bucketBytes-8:], overflow)
+		return mem.alloc(b)
+	}
+	overflow := bucket([]byte{0x9a}, [][]uint64{mem.str("tenant")}, [][]uint64{mem.str("acme")}, 0)
+	buckets := bucket([]byte{1, 0x42}, [][]uint64{{0, 0}, mem.str("handler")}, [][]uint64{{0, 0}, mem.str("/api/users")}, overflow)
+	// count, flags 0 and B 0, buckets, oldbuckets
+	hmap := mem.words(2, 0, buckets, 0)
+	got, err = ReadLabels(mem, mem.words(hmap), MapLabels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("map labels: %v, want %v", got, want)
+	}
+
+	if got, err := ReadLabels(mem, 0, SliceLabels); got != nil || err != nil {
+		t.Errorf("no labels: %v, %v", got, err)
+	}
+	if _, err := ReadLabels(mem, 0x10, SliceLabels); err == nil {
+		t.Error("expected an error for an unmapped address")
+	}
+}
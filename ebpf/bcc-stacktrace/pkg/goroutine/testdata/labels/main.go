@@ -0,0 +1,14 @@
+// labels is a Go program setting pprof labels, for its debug info to be read in tests
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+)
+
+func main() {
+	pprof.Do(context.Background(), pprof.Labels("handler", "/api/users"), func(ctx context.Context) {
+		fmt.Println(pprof.Label(ctx, "handler"))
+	})
+}
@@ -0,0 +1,156 @@
+package k8s
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/cgroup"
+)
+
+// Attributor labels the samples of a cgroup with the pod and the container it belongs to
+type Attributor struct {
+	cgroups *cgroup.Resolver
+	// kubelet is optional, pods are then only known by their uid
+	kubelet *Kubelet
+	// resources is optional, it needs the kubelet to name the containers
+	resources *PodResources
+
+	mu      sync.Mutex
+	entries map[uint64]*entry
+	// The entries of the cgroups removed since are dropped every sweepInterval
+	lastSweep time.Time
+}
+
+// retryDelay is how long the entries missing some names are kept before trying again
+const retryDelay = 10 * time.Second
+
+// sweepInterval is how often the entries of the cgroups which were removed are dropped,
+// so that the entries do not pile up as pods come and go
+const sweepInterval = time.Minute
+
+// entry is what is known of a cgroup
+type entry struct {
+	// Path of the cgroup, empty if it could not be resolved
+	path       string
+	labels     map[string]string
+	assignment *Assignment
+	// Zero for complete entries
+	retryAt time.Time
+}
+
+func NewAttributor(cgroups *cgroup.Resolver, kubelet *Kubelet, resources *PodResources) *Attributor {
+	return &Attributor{
+		cgroups:   cgroups,
+		kubelet:   kubelet,
+		resources: resources,
+		entries:   map[uint64]*entry{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Labels returns the labels of the cgroup: its path, and for the cgroups of pods pod_uid,
+// container_id and qos_class, along with pod, namespace and container when the kubelet
+// knows them, and exclusive_cpus and devices when the container holds some
+func (a *Attributor) Labels(id uint64) map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.lookup(id).labels
+}
+
+// OutsideCPUSet tells whether the cgroup running on the cpu breaks the cpuset of its
+// container, see PodResources.Outside
+func (a *Attributor) OutsideCPUSet(id uint64, cpu uint32) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e := a.lookup(id)
+	if e.assignment == nil {
+		return false
+	}
+	return a.resources.Outside(e.assignment, int64(cpu))
+}
+
+// sweep drops the entries of the cgroups which do not exist anymore, and the ones which
+// could not be resolved and are due to be tried again. Must be called with mu held.
+func (a *Attributor) sweep(now time.Time) {
+	a.lastSweep = now
+	for id, e := range a.entries {
+		if e.path == "" {
+			if !now.Before(e.retryAt) {
+				delete(a.entries, id)
+			}
+			continue
+		}
+		if !a.cgroups.Exists(id, e.path) {
+			delete(a.entries, id)
+		}
+	}
+}
+
+// lookup returns what is known of the cgroup. Must be called with mu held.
+func (a *Attributor) lookup(id uint64) *entry {
+	if now := time.Now(); now.Sub(a.lastSweep) >= sweepInterval {
+		a.sweep(now)
+	}
+	if e, ok := a.entries[id]; ok && (e.retryAt.IsZero() || time.Now().Before(e.retryAt)) {
+		return e
+	}
+	path, err := a.cgroups.Path(id)
+	if err != nil {
+		log.Printf("Failed to resolve cgroup: %v", err)
+		e := &entry{retryAt: time.Now().Add(retryDelay)}
+		a.entries[id] = e
+		return e
+	}
+	e := &entry{path: path, labels: map[string]string{"cgroup": path}}
+	c, ok := ParseCgroupPath(path)
+	if !ok {
+		a.entries[id] = e
+		return e
+	}
+	e.labels["pod_uid"] = c.PodUID
+	e.labels["qos_class"] = c.QOSClass
+	if c.ContainerID != "" {
+		e.labels["container_id"] = c.ContainerID
+	}
+	if a.kubelet == nil {
+		a.entries[id] = e
+		return e
+	}
+
+	// Entries missing some names are tried again later, the kubelet may not list the pod
+	// or the container yet
+	a.entries[id] = e
+	if err := a.kubelet.Lookup(c); err != nil {
+		log.Printf("Failed to look up pod in the kubelet: %v", err)
+		e.retryAt = time.Now().Add(retryDelay)
+		return e
+	}
+	e.labels["pod"] = c.PodName
+	e.labels["namespace"] = c.Namespace
+	if c.ContainerName == "" {
+		if c.ContainerID != "" {
+			e.retryAt = time.Now().Add(retryDelay)
+		}
+		return e
+	}
+	e.labels["container"] = c.ContainerName
+	if a.resources != nil {
+		assignment, err := a.resources.Assignment(c.Namespace, c.PodName, c.ContainerName)
+		if err != nil {
+			log.Printf("Failed to look up container resources: %v", err)
+			e.retryAt = time.Now().Add(retryDelay)
+			return e
+		}
+		e.assignment = assignment
+		if len(assignment.CPUs) > 0 {
+			e.labels["exclusive_cpus"] = FormatCPUs(assignment.CPUs)
+		}
+		if len(assignment.Devices) > 0 {
+			e.labels["devices"] = FormatDevices(assignment.Devices)
+		}
+	}
+	return e
+}
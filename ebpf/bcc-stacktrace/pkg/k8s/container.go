@@ -0,0 +1,66 @@
+package k8s
+
+import (
+	"regexp"
+	"strings"
+)
+
+// QoS classes of the pods, as named in their status
+const (
+	Guaranteed = "Guaranteed"
+	Burstable  = "Burstable"
+	BestEffort = "BestEffort"
+)
+
+// Container is a container of a pod, as found from its cgroup and the kubelet
+type Container struct {
+	PodUID      string
+	ContainerID string
+	QOSClass    string
+	// Known from the kubelet only
+	PodName       string
+	Namespace     string
+	ContainerName string
+}
+
+var (
+	// Pod uids have dashes replaced by underscores with the systemd driver
+	podRegexp       = regexp.MustCompile(`pod([0-9a-fA-F]{8}[-_][0-9a-fA-F]{4}[-_][0-9a-fA-F]{4}[-_][0-9a-fA-F]{4}[-_][0-9a-fA-F]{12})$`)
+	containerRegexp = regexp.MustCompile(`^(?:[a-z-]+-)?([0-9a-f]{64})$`)
+)
+
+// ParseCgroupPath extracts the pod and the container from the path of a cgroup, for both
+// the cgroupfs driver, e.g. /kubepods/burstable/pod<uid>/<container id>, and the systemd
+// one, e.g. /kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice/cri-containerd-<container id>.scope.
+// Prefixes such as the /kubelet root of kind nodes are skipped. It returns false for the
+// cgroups outside of any pod.
+func ParseCgroupPath(path string) (*Container, bool) {
+	var c *Container
+	kubepods := false
+	qos := Guaranteed
+	for _, part := range strings.Split(path, "/") {
+		name := strings.TrimSuffix(strings.TrimSuffix(part, ".slice"), ".scope")
+		switch {
+		case c != nil:
+			// The container is right below its pod
+			if m := containerRegexp.FindStringSubmatch(name); m != nil {
+				c.ContainerID = m[1]
+			}
+			return c, true
+		case !kubepods:
+			kubepods = name == "kubepods" || strings.HasSuffix(name, "-kubepods")
+		case strings.HasSuffix(name, "burstable"):
+			qos = Burstable
+		case strings.HasSuffix(name, "besteffort"):
+			qos = BestEffort
+		default:
+			if m := podRegexp.FindStringSubmatch(name); m != nil {
+				c = &Container{
+					PodUID:   strings.ReplaceAll(m[1], "_", "-"),
+					QOSClass: qos,
+				}
+			}
+		}
+	}
+	return c, c != nil
+}
@@ -0,0 +1,144 @@
+package k8s
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/cgroup"
+)
+
+const (
+	podUID      = "0d5a3a4e-6b1c-4c6f-9a47-2f0e3c1b9d21"
+	containerID = "5f4dcc3b5aa765d61d8327deb882cf995f4dcc3b5aa765d61d8327deb882cf99"
+)
+
+func TestParseCgroupPath(t *testing.T) {
+	systemdUID := "0d5a3a4e_6b1c_4c6f_9a47_2f0e3c1b9d21"
+	tests := []struct {
+		path string
+		want *Container
+	}{
+		// cgroupfs driver
+		{"/kubepods/burstable/pod" + podUID + "/" + containerID, &Container{PodUID: podUID, ContainerID: containerID, QOSClass: Burstable}},
+		{"/kubepods/pod" + podUID + "/" + containerID, &Container{PodUID: podUID, ContainerID: containerID, QOSClass: Guaranteed}},
+		{"/kubelet/kubepods/besteffort/pod" + podUID + "/" + containerID, &Container{PodUID: podUID, ContainerID: containerID, QOSClass: BestEffort}},
+		// systemd driver
+		{"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + systemdUID + ".slice/cri-containerd-" + containerID + ".scope",
+			&Container{PodUID: podUID, ContainerID: containerID, QOSClass: Burstable}},
+		{"/kubepods.slice/kubepods-pod" + systemdUID + ".slice/docker-" + containerID + ".scope",
+			&Container{PodUID: podUID, ContainerID: containerID, QOSClass: Guaranteed}},
+		{"/kubelet.slice/kubelet-kubepods.slice/kubelet-kubepods-besteffort.slice/kubelet-kubepods-besteffort-pod" + systemdUID + ".slice/crio-" + containerID + ".scope",
+			&Container{PodUID: podUID, ContainerID: containerID, QOSClass: BestEffort}},
+		// The pod itself
+		{"/kubepods/burstable/pod" + podUID, &Container{PodUID: podUID, QOSClass: Burstable}},
+		// Outside of pods
+		{"/system.slice/containerd.service", nil},
+		{"/kubepods/burstable", nil},
+		{"/user.slice/pod" + podUID, nil},
+	}
+	for _, test := range tests {
+		got, ok := ParseCgroupPath(test.path)
+		if ok != (test.want != nil) || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseCgroupPath(%s) = %+v, %v, want %+v", test.path, got, ok, test.want)
+		}
+	}
+}
+
+func TestAttributor(t *testing.T) {
+	root := t.TempDir()
+	podDir := filepath.Join(root, "kubepods", "burstable", "pod"+podUID)
+	containerDir := filepath.Join(podDir, containerID)
+	otherDir := filepath.Join(root, "system.slice", "containerd.service")
+	for _, dir := range []string{containerDir, otherDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requests := 0
+	kubelet := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"kind":"PodList","items":[{"metadata":{"name":"api-7d9f","namespace":"prod","uid":%q},
+			"status":{"containerStatuses":[{"name":"api","containerID":"containerd://%s"}]}}]}`, podUID, containerID)
+	}))
+	defer kubelet.Close()
+
+	a := NewAttributor(cgroup.NewResolver(root), NewKubelet(kubelet.URL), nil)
+	want := map[string]string{
+		"cgroup":       "/kubepods/burstable/pod" + podUID + "/" + containerID,
+		"pod_uid":      podUID,
+		"container_id": containerID,
+		"qos_class":    Burstable,
+		"pod":          "api-7d9f",
+		"namespace":    "prod",
+		"container":    "api",
+	}
+	if got := a.Labels(inode(t, containerDir)); !reflect.DeepEqual(got, want) {
+		t.Errorf("labels of the container: %v, want %v", got, want)
+	}
+	// Cached
+	a.Labels(inode(t, containerDir))
+	if requests != 1 {
+		t.Errorf("kubelet was requested %d times, want 1", requests)
+	}
+
+	want = map[string]string{"cgroup": "/system.slice/containerd.service"}
+	if got := a.Labels(inode(t, otherDir)); !reflect.DeepEqual(got, want) {
+		t.Errorf("labels outside of pods: %v, want %v", got, want)
+	}
+}
+
+func TestAttributorSweep(t *testing.T) {
+	root := t.TempDir()
+	gone := filepath.Join(root, "kubepods", "burstable", "pod"+podUID)
+	kept := filepath.Join(root, "system.slice", "containerd.service")
+	for _, dir := range []string{gone, kept} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	goneId, keptId := inode(t, gone), inode(t, kept)
+
+	a := NewAttributor(cgroup.NewResolver(root), nil, nil)
+	a.Labels(goneId)
+	a.Labels(keptId)
+	// Never resolved
+	a.Labels(1)
+	if len(a.entries) != 3 {
+		t.Fatalf("%d entries, want 3", len(a.entries))
+	}
+
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	// Not swept before sweepInterval
+	a.Labels(keptId)
+	if len(a.entries) != 3 {
+		t.Fatalf("%d entries before the sweep, want 3", len(a.entries))
+	}
+	a.lastSweep = time.Now().Add(-sweepInterval)
+	a.entries[1].retryAt = time.Now()
+	a.Labels(keptId)
+	if _, ok := a.entries[keptId]; !ok || len(a.entries) != 1 {
+		t.Errorf("entries %v after the sweep, want only the one of %d", a.entries, keptId)
+	}
+}
+
+func inode(t *testing.T, dir string) uint64 {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino
+}
@@ -0,0 +1,118 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// podList is the part of the v1.PodList returned by the kubelet that is needed here
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+			UID       string `json:"uid"`
+		} `json:"metadata"`
+		Status struct {
+			ContainerStatuses     []containerStatus `json:"containerStatuses"`
+			InitContainerStatuses []containerStatus `json:"initContainerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type containerStatus struct {
+	Name string `json:"name"`
+	// ContainerID is prefixed by the runtime, e.g. containerd://<id>
+	ContainerID string `json:"containerID"`
+}
+
+type podInfo struct {
+	name       string
+	namespace  string
+	containers map[string]string
+}
+
+// Kubelet names the pods and containers of the node from the pods listed by the kubelet
+type Kubelet struct {
+	url    string
+	client *http.Client
+	// minRefresh limits how often the pods are listed when a pod is not known
+	minRefresh time.Duration
+
+	mu          sync.Mutex
+	pods        map[string]*podInfo
+	lastRefresh time.Time
+}
+
+func NewKubelet(url string) *Kubelet {
+	return &Kubelet{
+		url:        strings.TrimSuffix(url, "/"),
+		client:     &http.Client{Timeout: 5 * time.Second},
+		minRefresh: 10 * time.Second,
+		pods:       map[string]*podInfo{},
+	}
+}
+
+// Lookup fills in the pod name, namespace and container name of the container
+func (k *Kubelet) Lookup(c *Container) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	pod, ok := k.pods[c.PodUID]
+	if (!ok || pod.containers[c.ContainerID] == "") && time.Since(k.lastRefresh) >= k.minRefresh {
+		if err := k.refresh(); err != nil {
+			return err
+		}
+		pod, ok = k.pods[c.PodUID]
+	}
+	if !ok {
+		return fmt.Errorf("unknown pod %s", c.PodUID)
+	}
+	c.PodName = pod.name
+	c.Namespace = pod.namespace
+	c.ContainerName = pod.containers[c.ContainerID]
+	return nil
+}
+
+func (k *Kubelet) refresh() error {
+	k.lastRefresh = time.Now()
+	resp, err := k.client.Get(k.url + "/pods")
+	if err != nil {
+		return fmt.Errorf("listing pods: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("listing pods: %s", resp.Status)
+	}
+	var list podList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("decoding pods: %w", err)
+	}
+
+	pods := map[string]*podInfo{}
+	for _, item := range list.Items {
+		pod := &podInfo{
+			name:       item.Metadata.Name,
+			namespace:  item.Metadata.Namespace,
+			containers: map[string]string{},
+		}
+		for _, statuses := range [][]containerStatus{item.Status.ContainerStatuses, item.Status.InitContainerStatuses} {
+			for _, status := range statuses {
+				id := status.ContainerID
+				if i := strings.Index(id, "://"); i >= 0 {
+					id = id[i+3:]
+				}
+				if id != "" {
+					pod.containers[id] = status.Name
+				}
+			}
+		}
+		pods[item.Metadata.UID] = pod
+	}
+	k.pods = pods
+	return nil
+}
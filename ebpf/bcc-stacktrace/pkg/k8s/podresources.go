@@ -0,0 +1,175 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// DefaultPodResourcesSocket is where the kubelet serves the PodResources API
+const DefaultPodResourcesSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+
+// Assignment is what the kubelet allocated to a container
+type Assignment struct {
+	// CPUs are the exclusive cpus of the container, empty if it runs in the shared pool
+	CPUs []int64
+	// Devices are the ids of the devices, by resource name
+	Devices map[string][]string
+}
+
+type containerKey struct {
+	namespace, pod, container string
+}
+
+// PodResources is a client of the PodResources API of the kubelet, which tells the cpus
+// and devices the containers of the node hold
+type PodResources struct {
+	conn    *grpc.ClientConn
+	client  podresources.PodResourcesListerClient
+	timeout time.Duration
+	// minRefresh limits how often the resources are listed when a container is not known
+	minRefresh time.Duration
+
+	mu          sync.Mutex
+	assignments map[containerKey]*Assignment
+	// exclusive are the cpus allocated exclusively, and who to
+	exclusive   map[int64]*Assignment
+	lastRefresh time.Time
+}
+
+// DialPodResources connects to the PodResources API on the unix socket of the kubelet
+func DialPodResources(socket string) (*PodResources, error) {
+	conn, err := grpc.Dial("unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", socket, err)
+	}
+	return &PodResources{
+		conn:        conn,
+		client:      podresources.NewPodResourcesListerClient(conn),
+		timeout:     5 * time.Second,
+		minRefresh:  10 * time.Second,
+		assignments: map[containerKey]*Assignment{},
+		exclusive:   map[int64]*Assignment{},
+	}, nil
+}
+
+func (p *PodResources) Close() error {
+	return p.conn.Close()
+}
+
+// Allocatable returns the cpus the kubelet can allocate to containers
+func (p *PodResources) Allocatable() ([]int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	resp, err := p.client.GetAllocatableResources(ctx, &podresources.AllocatableResourcesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("getting allocatable resources: %w", err)
+	}
+	return resp.CpuIds, nil
+}
+
+// Assignment returns what the container was allocated
+func (p *PodResources) Assignment(namespace, pod, container string) (*Assignment, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := containerKey{namespace, pod, container}
+	a, ok := p.assignments[key]
+	if !ok && time.Since(p.lastRefresh) >= p.minRefresh {
+		if err := p.refresh(); err != nil {
+			return nil, err
+		}
+		a, ok = p.assignments[key]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown container %s/%s/%s", namespace, pod, container)
+	}
+	return a, nil
+}
+
+// Outside tells whether a container running on the cpu breaks its cpuset: containers with
+// exclusive cpus are expected to run on them only, the others are expected to stay off the
+// exclusive cpus of other containers
+func (p *PodResources) Outside(a *Assignment, cpu int64) bool {
+	if len(a.CPUs) > 0 {
+		for _, c := range a.CPUs {
+			if c == cpu {
+				return false
+			}
+		}
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.exclusive[cpu]
+	return ok
+}
+
+func (p *PodResources) refresh() error {
+	p.lastRefresh = time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	resp, err := p.client.List(ctx, &podresources.ListPodResourcesRequest{})
+	if err != nil {
+		return fmt.Errorf("listing pod resources: %w", err)
+	}
+
+	assignments := map[containerKey]*Assignment{}
+	exclusive := map[int64]*Assignment{}
+	for _, pod := range resp.PodResources {
+		for _, c := range pod.Containers {
+			a := &Assignment{
+				CPUs:    c.CpuIds,
+				Devices: map[string][]string{},
+			}
+			for _, d := range c.Devices {
+				a.Devices[d.ResourceName] = append(a.Devices[d.ResourceName], d.DeviceIds...)
+			}
+			for _, cpu := range c.CpuIds {
+				exclusive[cpu] = a
+			}
+			assignments[containerKey{pod.Namespace, pod.Name, c.Name}] = a
+		}
+	}
+	p.assignments = assignments
+	p.exclusive = exclusive
+	return nil
+}
+
+// FormatCPUs formats cpus as a cpu list, e.g. 0-3,8
+func FormatCPUs(cpus []int64) string {
+	sorted := append([]int64(nil), cpus...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		part := strconv.FormatInt(sorted[i], 10)
+		if j > i {
+			part += "-" + strconv.FormatInt(sorted[j], 10)
+		}
+		parts = append(parts, part)
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
+
+// FormatDevices formats the devices as resource=id1+id2, sorted by resource
+func FormatDevices(devices map[string][]string) string {
+	var parts []string
+	for name, ids := range devices {
+		parts = append(parts, name+"="+strings.Join(ids, "+"))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
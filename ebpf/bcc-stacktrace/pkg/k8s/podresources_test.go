@@ -0,0 +1,134 @@
+package k8s
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	podresources "k8s.io/kubelet/pkg/apis/podresources/v1"
+)
+
+// fakeLister stands in for the kubelet
+type fakeLister struct {
+	podresources.UnimplementedPodResourcesListerServer
+	lists int
+}
+
+func (f *fakeLister) List(context.Context, *podresources.ListPodResourcesRequest) (*podresources.ListPodResourcesResponse, error) {
+	f.lists++
+	return &podresources.ListPodResourcesResponse{
+		PodResources: []*podresources.PodResources{
+			{
+				Name:      "api-7d9f",
+				Namespace: "prod",
+				Containers: []*podresources.ContainerResources{
+					{
+						Name:   "api",
+						CpuIds: []int64{3, 2},
+						Devices: []*podresources.ContainerDevices{
+							{ResourceName: "nvidia.com/gpu", DeviceIds: []string{"GPU-1"}},
+						},
+					},
+				},
+			},
+			{
+				Name:       "web-5c8b",
+				Namespace:  "prod",
+				Containers: []*podresources.ContainerResources{{Name: "web"}},
+			},
+		},
+	}, nil
+}
+
+func (f *fakeLister) GetAllocatableResources(context.Context, *podresources.AllocatableResourcesRequest) (*podresources.AllocatableResourcesResponse, error) {
+	return &podresources.AllocatableResourcesResponse{CpuIds: []int64{1, 2, 3}}, nil
+}
+
+func TestPodResources(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "kubelet.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	lister := &fakeLister{}
+	podresources.RegisterPodResourcesListerServer(server, lister)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	p, err := DialPodResources(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	cpus, err := p.Allocatable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := FormatCPUs(cpus); got != "1-3" {
+		t.Errorf("allocatable cpus: %s, want 1-3", got)
+	}
+
+	api, err := p.Assignment("prod", "api-7d9f", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := FormatCPUs(api.CPUs); got != "2-3" {
+		t.Errorf("exclusive cpus of api: %s, want 2-3", got)
+	}
+	if got := FormatDevices(api.Devices); got != "nvidia.com/gpu=GPU-1" {
+		t.Errorf("devices of api: %s, want nvidia.com/gpu=GPU-1", got)
+	}
+	web, err := p.Assignment("prod", "web-5c8b", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Assignment("prod", "db-0", "db"); err == nil {
+		t.Error("expected an error for an unknown container")
+	}
+	// Unknown containers are listed again at most every minRefresh
+	if lister.lists != 1 {
+		t.Errorf("resources were listed %d times, want 1", lister.lists)
+	}
+
+	tests := []struct {
+		name string
+		a    *Assignment
+		cpu  int64
+		want bool
+	}{
+		{"api on its cpu", api, 2, false},
+		{"api on the shared pool", api, 1, true},
+		{"web on the shared pool", web, 1, false},
+		{"web on a cpu of api", web, 3, true},
+	}
+	for _, test := range tests {
+		if got := p.Outside(test.a, test.cpu); got != test.want {
+			t.Errorf("%s: outside = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFormatCPUs(t *testing.T) {
+	tests := map[string][]int64{
+		"":          nil,
+		"4":         {4},
+		"0-3,8":     {3, 8, 0, 1, 2},
+		"1,3,5-6":   {6, 5, 3, 1},
+		"0-1,10-11": {10, 0, 11, 1},
+	}
+	for want, cpus := range tests {
+		if got := FormatCPUs(cpus); got != want {
+			t.Errorf("FormatCPUs(%v) = %s, want %s", cpus, got, want)
+		}
+	}
+	cpus := []int64{3, 1}
+	FormatCPUs(cpus)
+	if !reflect.DeepEqual(cpus, []int64{3, 1}) {
+		t.Errorf("FormatCPUs sorted its argument: %v", cpus)
+	}
+}
@@ -2,9 +2,11 @@ package ksym
 
 import (
 	"bufio"
+	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const UnresolvedSym string = "Unknown"
@@ -19,23 +21,36 @@ func ResolveAddrs(addrs []uint64) []string {
 		log.Printf("Failed to open /proc/kallsyms: %v", err)
 	}
 	defer f.Close()
+	return ResolveAddrsIn(f, addrs)
+}
 
+// ResolveAddrsIn resolves sorted kernel addresses to the symbols of kallsyms, e.g. a
+// snapshot of /proc/kallsyms
+func ResolveAddrsIn(kallsyms io.Reader, addrs []uint64) []string {
+	if len(addrs) == 0 {
+		return nil
+	}
 	symbols := []string{}
 	lastSymbol := UnresolvedSym
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(kallsyms)
 
-	log.Printf("Resolving kernel address: %+v", addrs)
 	for scanner.Scan() {
-		// Each line in /proc/kallsyms is formatted like the following:
+		// Each line in /proc/kallsyms is formatted like the following, the address being
+		// as wide as the pointers of the kernel, and the symbols of modules followed by
+		// their module:
 		// ffffffff9d000000 T startup_64
-		line := scanner.Bytes()
-		addr, err := strconv.ParseUint(string(line[:16]), 16, 64)
+		// ffffffffc0a01000 t nf_nat_setup_info	[nf_nat]
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			log.Printf("Failed to parse line %s", scanner.Text())
+			continue
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
 		if err != nil {
-			log.Printf("Failed to parse address for line %s", line)
+			log.Printf("Failed to parse address for line %s", scanner.Text())
+			continue
 		}
 		for addr >= addrs[0] {
-			log.Printf("Resolving kernel address %x to %s", addrs[0], lastSymbol)
-
 			symbols = append(symbols, lastSymbol)
 			addrs = addrs[1:]
 			if len(addrs) == 0 {
@@ -43,7 +58,7 @@ func ResolveAddrs(addrs []uint64) []string {
 			}
 		}
 		// Parse symbol for current line
-		lastSymbol = string(line[19:])
+		lastSymbol = strings.Join(fields[2:], " ")
 	}
 	// The rest of the addresses should probably be resolved to the last symbol
 	for i := 0; i < len(addrs); i++ {
@@ -51,10 +66,5 @@ func ResolveAddrs(addrs []uint64) []string {
 	}
 
 out:
-	// Print resolved symbols
-	log.Println("Resolved symbols:")
-	for i := range addrs {
-		log.Printf("\t0x%x: \t%s", addrs[i], symbols[i])
-	}
 	return symbols
 }
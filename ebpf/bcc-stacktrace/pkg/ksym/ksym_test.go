@@ -0,0 +1,45 @@
+package ksym
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveAddrsIn(t *testing.T) {
+	tests := []struct {
+		name     string
+		kallsyms string
+		addrs    []uint64
+		want     []string
+	}{
+		{
+			name: "64-bit",
+			kallsyms: `ffffffff81000000 T _stext
+ffffffff81001000 T native_write_msr
+ffffffff81002000 T do_syscall_64
+ffffffffc0a01000 t nf_nat_setup_info	[nf_nat]
+ffffffffc0a02000 t nf_nat_alloc_null_binding	[nf_nat]
+`,
+			addrs: []uint64{0xffffffff81001010, 0xffffffff81002020, 0xffffffffc0a01010},
+			want:  []string{"native_write_msr", "do_syscall_64", "nf_nat_setup_info [nf_nat]"},
+		},
+		{
+			// e.g. arm or i386, whose addresses are 8 hexadecimal digits
+			name: "32-bit",
+			kallsyms: `c0008000 T _stext
+c0101000 T vector_swi
+c0102000 T sys_read
+`,
+			addrs: []uint64{0xc0101010, 0xc0102020},
+			want:  []string{"vector_swi", "sys_read"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ResolveAddrsIn(strings.NewReader(tt.kallsyms), tt.addrs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
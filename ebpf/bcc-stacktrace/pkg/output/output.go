@@ -0,0 +1,254 @@
+package output
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/flamegraph"
+)
+
+// Mode decides how the profiles collected in one interval are written out
+type Mode string
+
+const (
+	// PerPid writes one profile per process
+	PerPid Mode = "pid"
+	// Host merges the profiles of all processes into a single one per interval
+	Host Mode = "host"
+)
+
+// Format is a file format the profiles are written in
+type Format string
+
+const (
+	// Pprof is the gzipped protobuf format read by go tool pprof
+	Pprof Format = "pprof"
+	// Folded is Brendan Gregg's collapsed stacks, one "comm;func1;func2 count" line per stack
+	Folded Format = "folded"
+	// SVG is a self-contained interactive flame graph
+	SVG Format = "svg"
+	// Trace is Chrome trace event JSON, a timeline of the streamed samples
+	Trace Format = "trace"
+)
+
+// Ext returns the extension of the files of the format
+func (f Format) Ext() string {
+	switch f {
+	case Pprof:
+		return "pb.gz"
+	case Trace:
+		return "trace.json"
+	}
+	return string(f)
+}
+
+// ParseFormats parses a comma separated list of formats
+func ParseFormats(s string) ([]Format, error) {
+	var formats []Format
+	for _, f := range strings.Split(s, ",") {
+		switch format := Format(strings.TrimSpace(f)); format {
+		case Pprof, Folded, SVG, Trace:
+			formats = append(formats, format)
+		default:
+			return nil, fmt.Errorf("unknown output format %q", f)
+		}
+	}
+	return formats, nil
+}
+
+// DefaultTemplate keeps the historical profile.pb.gz-<pid>-<timestamp> naming, the files
+// of the other formats being named profile-<pid>-<timestamp>.<extension of the format>
+const DefaultTemplate = "profile.pb.gz-{{.Pid}}-{{.Time}}"
+
+const timeFormat = "20060102150405"
+
+// NameData is what the file name template is executed against
+type NameData struct {
+	// Pid is the process id, or "host" for merged profiles
+	Pid string
+	// Time is the time the interval ended, formatted as 20060102150405
+	Time string
+	// Host is the hostname of the machine
+	Host string
+	// Mode is the output mode
+	Mode Mode
+	// Ext is the extension of the format of the file, e.g. pb.gz or svg
+	Ext string
+}
+
+// Writer writes the profiles of every interval to files, in each of its formats
+type Writer struct {
+	dir     string
+	mode    Mode
+	formats []Format
+	name    *template.Template
+	host    string
+	// appendExt is set when the template does not use {{.Ext}}, the extension then being
+	// appended to the names of the files of formats other than pprof, in place of the
+	// pprof one if the name has it
+	appendExt bool
+}
+
+// NewWriter returns a writer of the profiles in the formats, named after the template.
+// Templates without {{.Ext}} name the files of formats other than pprof with a .folded,
+// .svg or .trace.json extension appended, the .pb.gz one being dropped, e.g. the default
+// profile.pb.gz-<pid>-<timestamp> is profile-<pid>-<timestamp>.svg for flame graphs.
+func NewWriter(dir, nameTemplate string, mode Mode, formats []Format) (*Writer, error) {
+	if mode != PerPid && mode != Host {
+		return nil, fmt.Errorf("unknown output mode %q", mode)
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing file name template: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating output directory: %w", err)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	w := &Writer{
+		dir:     dir,
+		mode:    mode,
+		formats: formats,
+		name:    tmpl,
+		host:    host,
+	}
+	pprofName, err := w.fileName(NameData{Ext: Pprof.Ext()})
+	if err != nil {
+		return nil, err
+	}
+	svgName, err := w.fileName(NameData{Ext: SVG.Ext()})
+	if err != nil {
+		return nil, err
+	}
+	w.appendExt = pprofName == svgName
+	return w, nil
+}
+
+func (w *Writer) fileName(data NameData) (string, error) {
+	var name bytes.Buffer
+	if err := w.name.Execute(&name, data); err != nil {
+		return "", fmt.Errorf("executing file name template: %w", err)
+	}
+	return name.String(), nil
+}
+
+// Write writes the per process profiles collected in the interval ending at t. The
+// profiles which can be written are, whatever the errors of the other ones.
+func (w *Writer) Write(profiles map[uint32]*profile.Profile, t time.Time) error {
+	if len(profiles) == 0 {
+		return nil
+	}
+	if w.mode == Host {
+		p, err := Merge(profiles)
+		if err != nil {
+			return err
+		}
+		return w.writeFiles("host", p, t)
+	}
+
+	var errs []string
+	for _, pid := range sortedPids(profiles) {
+		if err := w.writeFiles(strconv.Itoa(int(pid)), profiles[pid], t); err != nil {
+			errs = append(errs, fmt.Sprintf("pid %d: %v", pid, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d profiles not written: %s", len(errs), len(profiles), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (w *Writer) writeFiles(pid string, p *profile.Profile, t time.Time) error {
+	var errs []string
+	for _, format := range w.formats {
+		fileName, err := w.fileName(NameData{
+			Pid:  pid,
+			Time: t.Format(timeFormat),
+			Host: w.host,
+			Mode: w.mode,
+			Ext:  format.Ext(),
+		})
+		if err != nil {
+			return err
+		}
+		if w.appendExt && format != Pprof {
+			fileName = strings.Replace(fileName, "."+Pprof.Ext(), "", 1) + "." + format.Ext()
+		}
+		if err := writeFile(filepath.Join(w.dir, fileName), format, p, pid); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func writeFile(path string, format Format, p *profile.Profile, pid string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating %s file: %w", format, err)
+	}
+	if err := Encode(f, format, p, "Flame Graph of "+pid); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s file: %w", format, err)
+	}
+	// Profiles are complete on disk once written, even if the host goes down right after
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing %s file: %w", format, err)
+	}
+	return f.Close()
+}
+
+// Encode writes the profile in the format
+func Encode(w io.Writer, format Format, p *profile.Profile, title string) error {
+	switch format {
+	case Folded:
+		return flamegraph.WriteFolded(w, p, flamegraph.ValueIndex(p))
+	case SVG:
+		return flamegraph.WriteSVG(w, p, title, flamegraph.ValueIndex(p))
+	case Trace:
+		return flamegraph.WriteTrace(w, p)
+	default:
+		return p.Write(w)
+	}
+}
+
+// Merge merges per process profiles into a single host wide profile. Functions and
+// mappings are deduplicated by binary, process identity is kept in the sample labels.
+func Merge(profiles map[uint32]*profile.Profile) (*profile.Profile, error) {
+	var ps []*profile.Profile
+	for _, pid := range sortedPids(profiles) {
+		ps = append(ps, profiles[pid])
+	}
+	merged, err := profile.Merge(ps)
+	if err != nil {
+		return nil, fmt.Errorf("merging profiles: %w", err)
+	}
+	// Merge sums up the durations, while all the profiles cover the same interval
+	merged.DurationNanos = ps[0].DurationNanos
+	return merged, nil
+}
+
+func sortedPids(profiles map[uint32]*profile.Profile) []uint32 {
+	pids := make([]uint32, 0, len(profiles))
+	for pid := range profiles {
+		pids = append(pids, pid)
+	}
+	sort.Slice(pids, func(i, j int) bool { return pids[i] < pids[j] })
+	return pids
+}
@@ -0,0 +1,177 @@
+package output
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// pidProfile is the profile of a process of /usr/bin/api, its samples labeled with its pid
+func pidProfile(pid int64, value int64) *profile.Profile {
+	m := &profile.Mapping{ID: 1, Start: 0x400000, Limit: 0x800000, File: "/usr/bin/api"}
+	f := &profile.Function{ID: 1, Name: "main.handle", SystemName: "main.handle"}
+	l := &profile.Location{ID: 1, Mapping: m, Address: 0x401000, Line: []profile.Line{{Function: f}}}
+	return &profile.Profile{
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        10000000,
+		SampleType:    []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:        []*profile.Sample{{Location: []*profile.Location{l}, Value: []int64{value}, NumLabel: map[string][]int64{"pid": {pid}}}},
+		Mapping:       []*profile.Mapping{m},
+		Location:      []*profile.Location{l},
+		Function:      []*profile.Function{f},
+		TimeNanos:     time.Date(2022, 4, 15, 10, 0, 0, 0, time.UTC).UnixNano(),
+		DurationNanos: (10 * time.Second).Nanoseconds(),
+	}
+}
+
+func TestParseFormats(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []Format
+	}{
+		{"pprof", []Format{Pprof}},
+		{"pprof,svg", []Format{Pprof, SVG}},
+		{" folded , trace", []Format{Folded, Trace}},
+	} {
+		got, err := ParseFormats(tc.in)
+		if err != nil {
+			t.Errorf("ParseFormats(%q): %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseFormats(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+	for _, in := range []string{"", "png", "pprof,", "pprof,json"} {
+		if got, err := ParseFormats(in); err == nil {
+			t.Errorf("ParseFormats(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	merged, err := Merge(map[uint32]*profile.Profile{42: pidProfile(42, 3), 7: pidProfile(7, 5)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The binary is shared by both processes
+	if len(merged.Mapping) != 1 || len(merged.Function) != 1 || len(merged.Location) != 1 {
+		t.Errorf("%d mappings, %d functions and %d locations, want one of each", len(merged.Mapping), len(merged.Function), len(merged.Location))
+	}
+	values := map[int64]int64{}
+	for _, s := range merged.Sample {
+		values[s.NumLabel["pid"][0]] += s.Value[0]
+	}
+	if want := map[int64]int64{42: 3, 7: 5}; !reflect.DeepEqual(values, want) {
+		t.Errorf("values by pid %v, want %v", values, want)
+	}
+	if merged.DurationNanos != (10 * time.Second).Nanoseconds() {
+		t.Errorf("duration %v, want the one of the interval", time.Duration(merged.DurationNanos))
+	}
+}
+
+func listDir(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestWriterNames(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+	end := time.Date(2022, 4, 15, 10, 0, 10, 0, time.Local)
+	for _, tc := range []struct {
+		name     string
+		template string
+		mode     Mode
+		formats  []Format
+		want     []string
+	}{
+		{"default", DefaultTemplate, PerPid, []Format{Pprof, Folded, SVG, Trace}, []string{
+			"profile-42-20220415100010.folded",
+			"profile-42-20220415100010.svg",
+			"profile-42-20220415100010.trace.json",
+			"profile-7-20220415100010.folded",
+			"profile-7-20220415100010.svg",
+			"profile-7-20220415100010.trace.json",
+			"profile.pb.gz-42-20220415100010",
+			"profile.pb.gz-7-20220415100010",
+		}},
+		{"host", "{{.Host}}-{{.Mode}}-{{.Time}}.{{.Ext}}", Host, []Format{Pprof, SVG}, []string{
+			host + "-host-20220415100010.pb.gz",
+			host + "-host-20220415100010.svg",
+		}},
+		{"without extension", "cpu-{{.Pid}}", PerPid, []Format{Pprof, SVG}, []string{
+			"cpu-42",
+			"cpu-42.svg",
+			"cpu-7",
+			"cpu-7.svg",
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "profiles")
+			w, err := NewWriter(dir, tc.template, tc.mode, tc.formats)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Write(map[uint32]*profile.Profile{42: pidProfile(42, 3), 7: pidProfile(7, 5)}, end); err != nil {
+				t.Fatal(err)
+			}
+			if got := listDir(t, dir); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("files %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(dir, "profile-{{.Pid}}.{{.Ext}}", PerPid, []Format{Pprof})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file of pid 7 can't be created
+	if err := os.Mkdir(filepath.Join(dir, "profile-7.pb.gz"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	profiles := map[uint32]*profile.Profile{7: pidProfile(7, 5), 42: pidProfile(42, 3), 99: pidProfile(99, 1)}
+	err = w.Write(profiles, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "pid 7") {
+		t.Errorf("expected the profile of pid 7 to fail, got %v", err)
+	}
+	// The profiles after it are written all the same
+	for _, name := range []string{"profile-42.pb.gz", "profile-99.pb.gz"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("profile not written: %v", err)
+		}
+	}
+}
+
+func TestNewWriterInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewWriter(dir, DefaultTemplate, Mode("cgroup"), []Format{Pprof}); err == nil {
+		t.Error("unknown mode accepted")
+	}
+	if _, err := NewWriter(dir, "{{.Pid", PerPid, []Format{Pprof}); err == nil {
+		t.Error("malformed template accepted")
+	}
+	if _, err := NewWriter(dir, "{{.Container}}", PerPid, []Format{Pprof}); err == nil {
+		t.Error("template with an unknown field accepted")
+	}
+}
@@ -0,0 +1,58 @@
+// Package overhead adapts how many events are sampled to keep the cost of profiling
+// within a budget
+package overhead
+
+import "math"
+
+// Controller chooses the subsampling ratio, i.e. 1 event recorded out of ratio, from the
+// overhead measured with the previous one. Only the cost of the events recorded is
+// assumed to scale with the ratio.
+type Controller struct {
+	// Budget is the fraction of the cpu time of the host profiling may take, e.g. 0.01
+	Budget float64
+	// MaxRatio bounds the ratio, so that some samples are always recorded
+	MaxRatio uint32
+
+	ratio uint32
+}
+
+// NewController returns a controller recording all the events until the budget is exceeded
+func NewController(budget float64, maxRatio uint32) *Controller {
+	return &Controller{Budget: budget, MaxRatio: maxRatio, ratio: 1}
+}
+
+// Ratio is the current subsampling ratio
+func (c *Controller) Ratio() uint32 {
+	return c.ratio
+}
+
+// Update returns the ratio to apply given the overhead measured with the current one, as
+// a fraction of the cpu time of the host. The ratio goes up as soon as the budget is
+// exceeded, and down by half at most once the overhead is well below it, so that it
+// does not oscillate around the budget.
+func (c *Controller) Update(overhead float64) uint32 {
+	// Overhead expected at ratio 1
+	full := overhead * float64(c.ratio)
+	switch {
+	case overhead > c.Budget:
+		c.ratio = c.bound(math.Ceil(full / c.Budget))
+	case overhead < c.Budget/2 && c.ratio > 1:
+		// Aim at three quarters of the budget
+		ratio := math.Ceil(full / (c.Budget * 3 / 4))
+		if half := math.Ceil(float64(c.ratio) / 2); ratio < half {
+			ratio = half
+		}
+		c.ratio = c.bound(ratio)
+	}
+	return c.ratio
+}
+
+func (c *Controller) bound(ratio float64) uint32 {
+	switch {
+	case ratio < 1:
+		return 1
+	case ratio > float64(c.MaxRatio):
+		return c.MaxRatio
+	}
+	return uint32(ratio)
+}
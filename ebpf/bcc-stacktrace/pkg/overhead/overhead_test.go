@@ -0,0 +1,31 @@
+package overhead
+
+import "testing"
+
+func TestController(t *testing.T) {
+	c := NewController(0.01, 64)
+	steps := []struct {
+		overhead float64
+		want     uint32
+	}{
+		// Within budget
+		{0.005, 1},
+		// Three times over, the ratio jumps at once
+		{0.03, 3},
+		// Right below the budget, kept
+		{0.009, 3},
+		// The load dropped, going down by half at most, rounded up
+		{0.001, 2},
+		{0.001, 1},
+		{0.001, 1},
+		// Far over, bounded
+		{1, 64},
+		{0.0001, 32},
+		{0.0001, 16},
+	}
+	for i, s := range steps {
+		if got := c.Update(s.overhead); got != s.want {
+			t.Fatalf("step %d: ratio %d with overhead %v, want %d", i, got, s.overhead, s.want)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package pprof
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/ksym"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/symbol"
+)
+
+// MaxStackDepth is the depth of the stacks in the stack map, deeper stacks are cut
+const MaxStackDepth = 127
+
+// stackRoots are the functions user stacks start from. Stacks not ending with one were
+// cut or unwound through a broken frame pointer chain.
+var stackRoots = map[string]bool{
+	"runtime.goexit": true,
+	"runtime.main":   true,
+	// Go threads on their system stack
+	"runtime.mstart": true,
+	"_start":         true,
+	"clone":          true,
+	"__clone":        true,
+	"clone3":         true,
+	"__clone3":       true,
+	// glibc, unwinding often stops there as it is built without frame pointers
+	"start_thread":           true,
+	"__libc_start_main":      true,
+	"__libc_start_call_main": true,
+}
+
+// unknownRoot tells if a user stack ending with sym misses its root. Only symbolized
+// frames can tell, the ones of native code are not.
+func unknownRoot(sym string) bool {
+	return sym != "" && !strings.HasPrefix(sym, "0x") && !stackRoots[sym]
+}
+
+const (
+	errEFAULT = -14
+	errENOMEM = -12
+	errEEXIST = -17
+)
+
+// Sample is a stack trace read from the bpf maps, before any symbolization
+type Sample struct {
+	Pid  uint32
+	Comm string
+	// Stack ids are negative errnos when bpf_get_stackid failed
+	KernStackId int32
+	UserStackId int32
+	// Kernel and user stacks, leaf first, without the zero padding of the stack map
+	KernStack []uint64
+	UserStack []uint64
+	// Count is the number of samples, or of blocks off-cpu, and Weight what they add up to,
+	// e.g. cpu or blocked nanoseconds
+	Count  uint64
+	Weight uint64
+	// Time the sample was taken at, in nanoseconds since the epoch, along with the thread.
+	// Only known for streamed samples, which are then kept apart in the profiles.
+	Time int64
+	Tid  uint32
+	// Cpu the sample was taken on, for streamed samples or when the counts are per cpu
+	Cpu uint32
+	// CgroupId is the id of the cgroup v2 of the task
+	CgroupId uint64
+	// Goroutine the thread of a Go process was running, and the address of its pprof
+	// labels in the process. Only recorded with the streamed samples.
+	Goid     uint64
+	GoLabels uint64
+	// GoroutineLabels are the pprof labels at GoLabels, read as the sample is received
+	GoroutineLabels map[string]string
+	// Labels describe the sample, e.g. its pod or its goroutine
+	Labels map[string]string
+}
+
+// ValueTypes describes what the sample values of a profile measure
+type ValueTypes struct {
+	PeriodType *profile.ValueType
+	Period     int64
+	SampleType []*profile.ValueType
+	// Weighted tells for each sample type whether the values are the weights of the samples
+	// rather than their counts
+	Weighted []bool
+}
+
+// OffCPU is for the time tasks spent blocked, switched out of the cpu
+var OffCPU = ValueTypes{
+	PeriodType: &profile.ValueType{
+		Type: "off-cpu",
+		Unit: "nanoseconds",
+	},
+	Period: 1,
+	SampleType: []*profile.ValueType{
+		{
+			Type: "off-cpu",
+			Unit: "nanoseconds",
+		},
+	},
+	Weighted: []bool{true},
+}
+
+// Symbolizer resolves the addresses of the samples and finds the binaries of the processes
+type Symbolizer interface {
+	// Kernel resolves sorted kernel addresses
+	Kernel(addrs []uint64) []string
+	// User resolves addresses of the process
+	User(pid uint32, addrs []uint64) []string
+	// ExeMapping returns the executable mapping of the main binary of the process
+	ExeMapping(pid uint32) (*symbol.Mapping, error)
+}
+
+// Host resolves the addresses with the kallsyms and the processes of this host
+var Host Symbolizer = host{}
+
+type host struct{}
+
+func (host) Kernel(addrs []uint64) []string { return ksym.ResolveAddrs(addrs) }
+
+func (host) User(pid uint32, addrs []uint64) []string { return symbol.ResolveGoSyms(pid, addrs) }
+
+func (host) ExeMapping(pid uint32) (*symbol.Mapping, error) { return symbol.ExeMapping(pid) }
+
+// process holds what is being built for a single process
+type process struct {
+	sym         Symbolizer
+	builder     *ProfileBuilder
+	kernMapping *profile.Mapping
+	userMapping *profile.Mapping
+	// userMapped is set once the user mapping was looked for, with the first user stack
+	userMapped bool
+	// Symbols of the addresses resolved so far. It is possible that we see same call stack
+	// with different stackId, because stackId is not derived from call stack alone.
+	kernSyms map[uint64]string
+	userSyms map[uint64]string
+	// Number of samples, and of the ones whose stacks were truncated or have an unknown root
+	samples     uint64
+	truncated   uint64
+	unknownRoot uint64
+}
+
+// BuildProfiles symbolizes the samples with sym and builds one profile per process. It is
+// also possible that different processes have the exact same call stack.
+func BuildProfiles(samples []Sample, start time.Time, duration time.Duration, types ValueTypes, sym Symbolizer) map[uint32]*profile.Profile {
+	processes := map[uint32]*process{}
+	for _, sample := range samples {
+		proc, ok := processes[sample.Pid]
+		if !ok {
+			mappings := newMappings()
+			proc = &process{
+				sym:         sym,
+				builder:     NewProfileBuilder(types, mappings, start, duration),
+				kernMapping: mappings[0],
+				userMapping: mappings[1],
+				kernSyms:    map[uint64]string{},
+				userSyms:    map[uint64]string{},
+			}
+			processes[sample.Pid] = proc
+		}
+		proc.add(sample, types.Weighted)
+	}
+
+	profiles := map[uint32]*profile.Profile{}
+	for pid, proc := range processes {
+		p, err := proc.builder.Build()
+		if err != nil {
+			log.Printf("Failed to build the profile of %d: %v", pid, err)
+			continue
+		}
+		if comment := proc.stackComment(); comment != "" {
+			p.Comments = append(p.Comments, comment)
+		}
+		profiles[pid] = p
+	}
+	return profiles
+}
+
+func (p *process) add(sample Sample, weighted []bool) {
+	kernLost, userLost := lostStacks(sample)
+	b := p.builder
+	p.samples += sample.Count
+	truncated := false
+
+	// Build sample locations, leaf first. The frames telling why a stack is incomplete go
+	// at the root, so that flame graphs are not split between the kernel and user frames.
+	p.resolveKernel(sample.KernStack)
+	var sampleLocations, roots []*profile.Location
+	for _, addr := range sample.KernStack {
+		f := b.Function(p.kernSyms[addr], "kernel", "")
+		sampleLocations = append(sampleLocations, b.Location(p.kernMapping, addr, f))
+	}
+	if kernLost != "" {
+		roots = append(roots, p.synthetic(kernLost))
+	} else if len(sample.KernStack) == MaxStackDepth {
+		roots = append(roots, p.synthetic("[truncated]"))
+		truncated = true
+	}
+
+	p.resolveUser(sample.Pid, sample.Comm, sample.UserStack)
+	for _, addr := range sample.UserStack {
+		f := b.Function(p.userSyms[addr], "User", "")
+		sampleLocations = append(sampleLocations, b.Location(p.userMappingOf(addr), addr, f))
+	}
+	switch {
+	case userLost != "":
+		roots = append(roots, p.synthetic(userLost))
+	case len(sample.UserStack) == MaxStackDepth:
+		if !truncated {
+			roots = append(roots, p.synthetic("[truncated]"))
+		}
+		truncated = true
+	case len(sample.UserStack) > 0 && unknownRoot(p.userSyms[sample.UserStack[len(sample.UserStack)-1]]):
+		roots = append(roots, p.synthetic("[unknown root]"))
+		p.unknownRoot += sample.Count
+	}
+	sampleLocations = append(sampleLocations, roots...)
+	if truncated {
+		p.truncated += sample.Count
+	}
+
+	values := make([]int64, len(weighted))
+	for i := range values {
+		values[i] = sampleValue(sample, weighted[i])
+	}
+	s := &profile.Sample{
+		Location: sampleLocations,
+		Value:    values,
+		// Keep the process identity, which is otherwise lost in merged profiles
+		Label: map[string][]string{
+			"comm": {sample.Comm},
+		},
+		NumLabel: map[string][]int64{
+			"pid": {int64(sample.Pid)},
+		},
+	}
+	for k, v := range sample.Labels {
+		s.Label[k] = []string{v}
+	}
+	if sample.Time != 0 {
+		// A timeline of the samples, pprof still aggregates them by stack
+		s.NumLabel["timestamp"] = []int64{sample.Time}
+		s.NumLabel["tid"] = []int64{int64(sample.Tid)}
+		s.NumLabel["cpu"] = []int64{int64(sample.Cpu)}
+		s.NumUnit = map[string][]string{"timestamp": {"nanoseconds"}}
+	}
+	b.AddSample(s)
+}
+
+// resolveKernel resolves the kernel addresses not seen yet
+func (p *process) resolveKernel(stack []uint64) {
+	var addrs []uint64
+	for _, addr := range stack {
+		if _, ok := p.kernSyms[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	// Sort kernel address for symbol resolution
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	for i, sym := range p.sym.Kernel(addrs) {
+		p.kernSyms[addrs[i]] = sym
+	}
+}
+
+// resolveUser resolves the user addresses not seen yet, and the user mapping along with
+// the first ones
+func (p *process) resolveUser(pid uint32, comm string, stack []uint64) {
+	if len(stack) > 0 && !p.userMapped {
+		p.userMapped = true
+		p.mapUser(pid, comm)
+	}
+	var addrs []uint64
+	for _, addr := range stack {
+		if _, ok := p.userSyms[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return
+	}
+	for i, sym := range p.sym.User(pid, addrs) {
+		p.userSyms[addrs[i]] = sym
+	}
+}
+
+// stackComment describes the samples whose stacks are incomplete, if any
+func (p *process) stackComment() string {
+	if p.truncated == 0 && p.unknownRoot == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d samples with stacks truncated at %d frames, %d with an unknown root", p.truncated, p.samples, MaxStackDepth, p.unknownRoot)
+}
+
+// userMappingOf returns the mapping of a user address: the main binary, or none for the
+// addresses of shared libraries, the JIT or the vdso, which are not mapped from it
+func (p *process) userMappingOf(addr uint64) *profile.Mapping {
+	if p.userMapping.File == "" || addr < p.userMapping.Start || addr >= p.userMapping.Limit {
+		return nil
+	}
+	return p.userMapping
+}
+
+// synthetic returns the location of a frame which is not a code address
+func (p *process) synthetic(name string) *profile.Location {
+	return p.builder.Location(nil, 0, p.builder.Function(name, name, ""))
+}
+
+func sampleValue(sample Sample, weighted bool) int64 {
+	if weighted {
+		return int64(sample.Weight)
+	}
+	return int64(sample.Count)
+}
+
+// lostStacks names the frames standing for the kernel and user stacks which were lost.
+// A fault on one side only is expected, e.g. kernel threads have no user stack and samples
+// taken in user mode have no kernel stack, so it is only reported when both are missing.
+func lostStacks(sample Sample) (string, string) {
+	kernLost := lostFrame(sample.KernStackId)
+	userLost := lostFrame(sample.UserStackId)
+	if sample.KernStackId == errEFAULT && sample.UserStackId >= 0 {
+		kernLost = ""
+	}
+	if sample.UserStackId == errEFAULT && sample.KernStackId >= 0 {
+		userLost = ""
+	}
+	return kernLost, userLost
+}
+
+func lostFrame(stackId int32) string {
+	switch {
+	case stackId >= 0:
+		return ""
+	case stackId == errEEXIST:
+		return "[lost: stack collision]"
+	case stackId == errENOMEM:
+		return "[lost: stack map full]"
+	case stackId == errEFAULT:
+		return "[lost: stack fault]"
+	default:
+		return fmt.Sprintf("[lost: stack error %d]", stackId)
+	}
+}
+
+// newMappings returns the kernel and the user mapping of a process, the user mapping
+// being filled in by mapUser
+func newMappings() []*profile.Mapping {
+	kernMapping := &profile.Mapping{
+		ID:           1,
+		File:         "[kernel.kallsyms]",
+		HasFunctions: true,
+	}
+	userMapping := &profile.Mapping{
+		ID:           2,
+		HasFunctions: true,
+	}
+	return []*profile.Mapping{kernMapping, userMapping}
+}
+
+// unmapped are the comms of the processes whose executable mapping could not be found,
+// which is only logged once
+var unmapped sync.Map
+
+// mapUser names the user mapping after the binary of the process, so that processes
+// running the same binary share it when profiles are merged. It is only looked for in
+// processes with user stacks, kernel threads and the idle task having no binary.
+func (p *process) mapUser(pid uint32, comm string) {
+	m, err := p.sym.ExeMapping(pid)
+	if err != nil {
+		if _, seen := unmapped.LoadOrStore(comm, true); !seen {
+			log.Printf("Failed to find executable mapping of %d (%s): %v", pid, comm, err)
+		}
+		return
+	}
+	p.userMapping.Start = m.Start
+	p.userMapping.Limit = m.Limit
+	p.userMapping.Offset = m.Offset
+	p.userMapping.File = m.Path
+}
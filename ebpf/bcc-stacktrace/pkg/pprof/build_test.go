@@ -0,0 +1,154 @@
+package pprof
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/symbol"
+)
+
+// testSymbols resolves the addresses with a table
+type testSymbols map[uint64]string
+
+func (s testSymbols) resolve(addrs []uint64) []string {
+	var syms []string
+	for _, addr := range addrs {
+		sym, ok := s[addr]
+		if !ok {
+			sym = fmt.Sprintf("0x%x", addr)
+		}
+		syms = append(syms, sym)
+	}
+	return syms
+}
+
+func (s testSymbols) Kernel(addrs []uint64) []string { return s.resolve(addrs) }
+
+func (s testSymbols) User(pid uint32, addrs []uint64) []string { return s.resolve(addrs) }
+
+func (testSymbols) ExeMapping(pid uint32) (*symbol.Mapping, error) {
+	return &symbol.Mapping{Start: 0x400000, Limit: 0x500000, Path: "/usr/bin/api"}, nil
+}
+
+func TestBrokenStacks(t *testing.T) {
+	sym := testSymbols{
+		0x401000: "main.work",
+		0x402000: "main.main",
+		0x403000: "runtime.main",
+		0x404000: "runtime.goexit",
+		0x405000: "main.recurse",
+		0x407000: "__libc_start_main",
+	}
+	deep := []uint64{0x401000}
+	for len(deep) < MaxStackDepth {
+		deep = append(deep, 0x405000)
+	}
+	samples := []Sample{
+		{Pid: 42, UserStack: []uint64{0x401000, 0x402000, 0x403000, 0x404000}, Count: 1},
+		// The frame pointers of main.work were not followed
+		{Pid: 42, UserStack: []uint64{0x401000, 0x402000}, Count: 2},
+		{Pid: 42, UserStack: deep, Count: 3},
+		{Pid: 42, KernStackId: errEEXIST, UserStackId: errEEXIST, Count: 4},
+		// Native code is not symbolized, its root can't be told
+		{Pid: 42, UserStack: []uint64{0x401000, 0x406000}, Count: 5},
+		{Pid: 42, UserStack: []uint64{0x401000, 0x407000}, Count: 6},
+	}
+	p := BuildProfiles(samples, time.Unix(1700000000, 0), 10*time.Second, testTypes, sym)[42]
+	if p == nil {
+		t.Fatal("no profile built")
+	}
+
+	got := map[string]int64{}
+	for _, s := range p.Sample {
+		got[outermost(s)] = s.Value[0]
+	}
+	want := map[string]int64{
+		"runtime.goexit":          1,
+		"[unknown root]":          2,
+		"[truncated]":             3,
+		"[lost: stack collision]": 4,
+		"0x406000":                5,
+		"__libc_start_main":       6,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got outermost frames %v, want %v", got, want)
+	}
+	comments := []string{"3 of 21 samples with stacks truncated at 127 frames, 2 with an unknown root"}
+	if !reflect.DeepEqual(p.Comments, comments) {
+		t.Errorf("got comments %q, want %q", p.Comments, comments)
+	}
+}
+
+func outermost(s *profile.Sample) string {
+	l := s.Location[len(s.Location)-1]
+	return l.Line[0].Function.Name
+}
+
+// TestBuildOffCPU builds the off-cpu profile of blocks attributed to their pods
+func TestBuildOffCPU(t *testing.T) {
+	sym := testSymbols{0xffffffff81001000: "schedule", 0x401000: "main.wait", 0x402000: "runtime.goexit"}
+	pod := map[string]string{"namespace": "default", "pod": "api-0", "container": "api"}
+	samples := []Sample{
+		{Pid: 42, Comm: "api", KernStack: []uint64{0xffffffff81001000}, UserStack: []uint64{0x401000, 0x402000}, Count: 3, Weight: 4500000, CgroupId: 7, Labels: pod},
+		// Blocked in the same stack, in a cgroup which could not be attributed
+		{Pid: 42, Comm: "api", KernStack: []uint64{0xffffffff81001000}, UserStack: []uint64{0x401000, 0x402000}, Count: 1, Weight: 500000, CgroupId: 8},
+	}
+	p := BuildProfiles(samples, time.Unix(1700000000, 0), 10*time.Second, OffCPU, sym)[42]
+	if p == nil {
+		t.Fatal("no profile built")
+	}
+	if len(p.SampleType) != 1 || p.SampleType[0].Type != "off-cpu" || p.SampleType[0].Unit != "nanoseconds" {
+		t.Fatalf("got sample types %v", p.SampleType)
+	}
+
+	got := map[string]int64{}
+	for _, s := range p.Sample {
+		got[fmt.Sprint(s.Label["pod"])] = s.Value[0]
+	}
+	want := map[string]int64{"[api-0]": 4500000, "[]": 500000}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got blocked nanoseconds by pod %v, want %v", got, want)
+	}
+}
+
+// TestStackRoots checks the frames of incomplete stacks are at their root, and that the
+// user frames outside of the main binary have no mapping
+func TestStackRoots(t *testing.T) {
+	sym := testSymbols{
+		0xffffffff81001000: "do_syscall_64",
+		0x401000:           "main.work",
+		0x7f0000001000:     "memcpy",
+	}
+	samples := []Sample{
+		// The user stack was not walked past the shared library
+		{Pid: 42, KernStack: []uint64{0xffffffff81001000}, UserStack: []uint64{0x7f0000001000, 0x401000}, Count: 1},
+		{Pid: 42, KernStackId: errEEXIST, UserStack: []uint64{0x401000}, Count: 2},
+	}
+	p := BuildProfiles(samples, time.Unix(1700000000, 0), 10*time.Second, testTypes, sym)[42]
+	if p == nil {
+		t.Fatal("no profile built")
+	}
+
+	got := map[int64][]string{}
+	for _, s := range p.Sample {
+		var frames []string
+		for _, l := range s.Location {
+			name := l.Line[0].Function.Name
+			if l.Mapping != nil {
+				name += " in " + l.Mapping.File
+			}
+			frames = append(frames, name)
+		}
+		got[s.Value[0]] = frames
+	}
+	want := map[int64][]string{
+		1: {"do_syscall_64 in [kernel.kallsyms]", "memcpy", "main.work in /usr/bin/api", "[unknown root]"},
+		2: {"main.work in /usr/bin/api", "[lost: stack collision]", "[unknown root]"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got stacks %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,204 @@
+package pprof
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// ProfileBuilder builds a profile whose encoding only depends on what was added to it, not
+// on the order it was added in. Functions are deduplicated by name, system name and file,
+// locations by mapping, address and function, and identical samples are merged. IDs are
+// assigned once everything is added, in sorted order.
+type ProfileBuilder struct {
+	types    ValueTypes
+	mappings []*profile.Mapping
+	start    time.Time
+	duration time.Duration
+
+	functions map[functionKey]*profile.Function
+	locations map[locationKey]*profile.Location
+	// Index of the locations in the order they were created, to identify the samples
+	locationIndex map[*profile.Location]int
+	samples       map[string]*profile.Sample
+}
+
+type functionKey struct {
+	name       string
+	systemName string
+	file       string
+}
+
+type locationKey struct {
+	mapping  *profile.Mapping
+	address  uint64
+	function *profile.Function
+}
+
+// NewProfileBuilder returns a builder of a profile of the mappings, covering duration
+// from start
+func NewProfileBuilder(types ValueTypes, mappings []*profile.Mapping, start time.Time, duration time.Duration) *ProfileBuilder {
+	return &ProfileBuilder{
+		types:         types,
+		mappings:      mappings,
+		start:         start,
+		duration:      duration,
+		functions:     map[functionKey]*profile.Function{},
+		locations:     map[locationKey]*profile.Location{},
+		locationIndex: map[*profile.Location]int{},
+		samples:       map[string]*profile.Sample{},
+	}
+}
+
+// Function returns the function, the same one for the same name, system name and file
+func (b *ProfileBuilder) Function(name, systemName, file string) *profile.Function {
+	key := functionKey{name, systemName, file}
+	f, ok := b.functions[key]
+	if !ok {
+		f = &profile.Function{Name: name, SystemName: systemName, Filename: file}
+		b.functions[key] = f
+	}
+	return f
+}
+
+// Location returns the location of the address in the mapping, running the function. The
+// mapping is nil for frames which are not code addresses, and the function is nil for
+// addresses which could not be symbolized.
+func (b *ProfileBuilder) Location(m *profile.Mapping, address uint64, f *profile.Function) *profile.Location {
+	key := locationKey{m, address, f}
+	l, ok := b.locations[key]
+	if !ok {
+		l = &profile.Location{Mapping: m, Address: address}
+		if f != nil {
+			l.Line = []profile.Line{{Function: f}}
+		}
+		b.locations[key] = l
+		b.locationIndex[l] = len(b.locationIndex)
+	}
+	return l
+}
+
+// AddSample adds the sample, or adds its values to the ones of an identical sample, i.e.
+// one with the same locations and labels
+func (b *ProfileBuilder) AddSample(s *profile.Sample) {
+	var key strings.Builder
+	for _, l := range s.Location {
+		fmt.Fprintf(&key, "%d,", b.locationIndex[l])
+	}
+	key.WriteString(labelsString(s))
+	if prev, ok := b.samples[key.String()]; ok {
+		for i := range prev.Value {
+			prev.Value[i] += s.Value[i]
+		}
+		return
+	}
+	b.samples[key.String()] = s
+}
+
+// labelsString identifies the labels of a sample
+func labelsString(s *profile.Sample) string {
+	var parts []string
+	for k, v := range s.Label {
+		parts = append(parts, fmt.Sprintf("%q=%q", k, v))
+	}
+	for k, v := range s.NumLabel {
+		parts = append(parts, fmt.Sprintf("%q=%v%q", k, v, s.NumUnit[k]))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// Build assigns the IDs, sorts the profile and checks it is valid
+func (b *ProfileBuilder) Build() (*profile.Profile, error) {
+	p := &profile.Profile{
+		PeriodType:    b.types.PeriodType,
+		Period:        b.types.Period,
+		SampleType:    b.types.SampleType,
+		Mapping:       b.mappings,
+		TimeNanos:     b.start.UnixNano(),
+		DurationNanos: b.duration.Nanoseconds(),
+	}
+	for i, m := range p.Mapping {
+		m.ID = uint64(i + 1)
+	}
+
+	for _, f := range b.functions {
+		p.Function = append(p.Function, f)
+	}
+	sort.Slice(p.Function, func(i, j int) bool {
+		fi, fj := p.Function[i], p.Function[j]
+		if fi.Name != fj.Name {
+			return fi.Name < fj.Name
+		}
+		if fi.SystemName != fj.SystemName {
+			return fi.SystemName < fj.SystemName
+		}
+		return fi.Filename < fj.Filename
+	})
+	for i, f := range p.Function {
+		f.ID = uint64(i + 1)
+	}
+
+	for _, l := range b.locations {
+		p.Location = append(p.Location, l)
+	}
+	sort.Slice(p.Location, func(i, j int) bool {
+		li, lj := p.Location[i], p.Location[j]
+		if mi, mj := mappingID(li), mappingID(lj); mi != mj {
+			return mi < mj
+		}
+		if li.Address != lj.Address {
+			return li.Address < lj.Address
+		}
+		return functionID(li) < functionID(lj)
+	})
+	for i, l := range p.Location {
+		l.ID = uint64(i + 1)
+	}
+
+	type keyed struct {
+		s      *profile.Sample
+		labels string
+	}
+	samples := make([]keyed, 0, len(b.samples))
+	for _, s := range b.samples {
+		samples = append(samples, keyed{s, labelsString(s)})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		si, sj := samples[i].s, samples[j].s
+		for k := 0; k < len(si.Location) && k < len(sj.Location); k++ {
+			if si.Location[k].ID != sj.Location[k].ID {
+				return si.Location[k].ID < sj.Location[k].ID
+			}
+		}
+		if len(si.Location) != len(sj.Location) {
+			return len(si.Location) < len(sj.Location)
+		}
+		return samples[i].labels < samples[j].labels
+	})
+	for _, s := range samples {
+		p.Sample = append(p.Sample, s.s)
+	}
+
+	if err := p.CheckValid(); err != nil {
+		return nil, fmt.Errorf("invalid profile: %w", err)
+	}
+	return p, nil
+}
+
+func mappingID(l *profile.Location) uint64 {
+	if l.Mapping == nil {
+		return 0
+	}
+	return l.Mapping.ID
+}
+
+func functionID(l *profile.Location) uint64 {
+	if len(l.Line) == 0 {
+		return 0
+	}
+	return l.Line[0].Function.ID
+}
@@ -0,0 +1,142 @@
+package pprof
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+var update = flag.Bool("update", false, "Update the golden files")
+
+// frame is a code address and its symbol, or a synthetic frame when the address is zero
+type frame struct {
+	addr uint64
+	sym  string
+}
+
+type testSample struct {
+	kern   []frame
+	user   []frame
+	count  int64
+	labels map[string]string
+	time   int64
+}
+
+var testSamples = []testSample{
+	{
+		kern:  []frame{{0xffffffff81001000, "native_write_msr"}, {0xffffffff81002000, "do_syscall_64"}},
+		user:  []frame{{0x401000, "main.work"}, {0x402000, "main.main"}},
+		count: 3,
+	},
+	// The same symbol at another address
+	{user: []frame{{0x401010, "main.work"}, {0x402000, "main.main"}}, count: 2},
+	// The same stack as the previous one, merged with it
+	{user: []frame{{0x401010, "main.work"}, {0x402000, "main.main"}}, count: 5},
+	{user: []frame{{0x403000, "main.serve"}, {0x402000, "main.main"}}, count: 1, labels: map[string]string{"goroutine": "7", "handler": "/api"}},
+	{kern: []frame{{0, "[lost: stack fault]"}}, user: []frame{{0x402000, "main.main"}}, count: 4},
+	// Streamed samples are kept apart
+	{user: []frame{{0x401000, "main.work"}}, count: 1, time: 1700000000000000000},
+	{user: []frame{{0x401000, "main.work"}}, count: 1, time: 1700000000010000000},
+}
+
+var testTypes = ValueTypes{
+	PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+	Period:     10000000,
+	SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+	Weighted:   []bool{false, true},
+}
+
+// buildTestProfile adds the samples in the order given by perm
+func buildTestProfile(t *testing.T, perm []int) *profile.Profile {
+	mappings := []*profile.Mapping{
+		{File: "[kernel.kallsyms]", HasFunctions: true},
+		{File: "/usr/bin/api", Start: 0x400000, Limit: 0x500000, HasFunctions: true},
+	}
+	b := NewProfileBuilder(testTypes, mappings, time.Unix(1700000000, 0), 10*time.Second)
+	for _, i := range perm {
+		ts := testSamples[i]
+		var locations []*profile.Location
+		for _, f := range ts.kern {
+			if f.addr == 0 {
+				locations = append(locations, b.Location(nil, 0, b.Function(f.sym, f.sym, "")))
+				continue
+			}
+			locations = append(locations, b.Location(mappings[0], f.addr, b.Function(f.sym, "kernel", "")))
+		}
+		for _, f := range ts.user {
+			locations = append(locations, b.Location(mappings[1], f.addr, b.Function(f.sym, "User", "")))
+		}
+		s := &profile.Sample{
+			Location: locations,
+			Value:    []int64{ts.count, ts.count * 10000000},
+			Label:    map[string][]string{"comm": {"api"}},
+			NumLabel: map[string][]int64{"pid": {42}},
+		}
+		for k, v := range ts.labels {
+			s.Label[k] = []string{v}
+		}
+		if ts.time != 0 {
+			s.NumLabel["timestamp"] = []int64{ts.time}
+			s.NumUnit = map[string][]string{"timestamp": {"nanoseconds"}}
+		}
+		b.AddSample(s)
+	}
+	p, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestProfileBuilder(t *testing.T) {
+	perm := make([]int, len(testSamples))
+	for i := range perm {
+		perm[i] = i
+	}
+	p := buildTestProfile(t, perm)
+	var want bytes.Buffer
+	if err := p.WriteUncompressed(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "builder.pb")
+	if *update {
+		if err := ioutil.WriteFile(golden, want.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want.Bytes(), expected) {
+		t.Errorf("profile differs from %s, run go test -update if expected:\n%s", golden, p)
+	}
+
+	// One function per symbol, one sample per distinct stack and labels
+	if len(p.Function) != 6 {
+		t.Errorf("%d functions, want 6:\n%s", len(p.Function), p)
+	}
+	if len(p.Sample) != 6 {
+		t.Errorf("%d samples, want 6:\n%s", len(p.Sample), p)
+	}
+
+	// The encoding does not depend on the order the samples are added in
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		r.Shuffle(len(perm), func(i, j int) { perm[i], perm[j] = perm[j], perm[i] })
+		var got bytes.Buffer
+		if err := buildTestProfile(t, perm).WriteUncompressed(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Fatalf("profile built in order %v differs", perm)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package replay records the raw bpf maps of every interval, along with what is needed to
+// symbolize them, and replays them without a kernel
+package replay
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/ksym"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/symbol"
+)
+
+// Header starts a recording, with what applies to all its intervals
+type Header struct {
+	// Types of the values of the profiles
+	Types pprof.ValueTypes
+	// Kallsyms is /proc/kallsyms as of the start of the recording
+	Kallsyms string
+	// ByteOrder is the one of the maps, as named by its String. Recordings without it are
+	// little endian.
+	ByteOrder string
+}
+
+// Entry is the raw key and value of a map entry
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// Process is what symbolizes the stacks of a process
+type Process struct {
+	// Exe is the path of the main binary, as linked by /proc/<pid>/exe
+	Exe string
+	// Maps is /proc/<pid>/maps
+	Maps string
+}
+
+// Snapshot is an interval of a recording
+type Snapshot struct {
+	Start time.Time
+	End   time.Time
+	// Counts are the entries of the counts map, and Stacks the ones of the stack map they
+	// refer to
+	Counts []Entry
+	Stacks []Entry
+	// Errors are the error counters of the interval, in the order of enum error_t
+	Errors []uint64
+	// Processes of the samples, by pid
+	Processes map[uint32]*Process
+}
+
+// ReadProcess snapshots what symbolizes the stacks of a running process
+func ReadProcess(pid uint32) (*Process, error) {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return nil, fmt.Errorf("readlink exe: %w", err)
+	}
+	maps, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("read maps: %w", err)
+	}
+	return &Process{Exe: exe, Maps: string(maps)}, nil
+}
+
+// Writer writes a recording as a gzipped stream of JSON values, the header then a
+// snapshot per interval. Every snapshot is flushed, so that the recording can be replayed
+// up to the last one written even if the recorder is killed.
+type Writer struct {
+	gz  *gzip.Writer
+	enc *json.Encoder
+}
+
+// NewWriter starts a recording with the header
+func NewWriter(w io.Writer, header *Header) (*Writer, error) {
+	gz := gzip.NewWriter(w)
+	rw := &Writer{gz: gz, enc: json.NewEncoder(gz)}
+	if err := rw.enc.Encode(header); err != nil {
+		return nil, fmt.Errorf("writing header: %w", err)
+	}
+	return rw, rw.gz.Flush()
+}
+
+// Write appends the snapshot to the recording
+func (w *Writer) Write(s *Snapshot) error {
+	if err := w.enc.Encode(s); err != nil {
+		return err
+	}
+	return w.gz.Flush()
+}
+
+// Close ends the recording, without closing the underlying writer
+func (w *Writer) Close() error {
+	return w.gz.Close()
+}
+
+// Reader reads a recording written by Writer
+type Reader struct {
+	Header  Header
+	dec     *json.Decoder
+	decoder bpfmap.Decoder
+}
+
+// NewReader reads the header of the recording
+func NewReader(r io.Reader) (*Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading recording: %w", err)
+	}
+	rr := &Reader{dec: json.NewDecoder(gz)}
+	if err := rr.dec.Decode(&rr.Header); err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	rr.decoder.Order = binary.LittleEndian
+	if rr.Header.ByteOrder != "" {
+		if rr.decoder.Order, err = bpfmap.ByteOrder(rr.Header.ByteOrder); err != nil {
+			return nil, fmt.Errorf("reading header: %w", err)
+		}
+	}
+	return rr, nil
+}
+
+// Next returns the next snapshot, or io.EOF at the end of the recording
+func (r *Reader) Next() (*Snapshot, error) {
+	var s Snapshot
+	if err := r.dec.Decode(&s); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated recording: %w", err)
+		}
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Samples decodes the samples of the snapshot, the same way as the maps are when profiling
+// but in the byte order of the recording
+func (r *Reader) Samples(s *Snapshot) []pprof.Sample {
+	stacks := make(map[string][]byte, len(s.Stacks))
+	for _, e := range s.Stacks {
+		stacks[string(e.Key)] = e.Value
+	}
+	lookup := func(key []byte) ([]byte, error) {
+		value, ok := stacks[string(key)]
+		if !ok {
+			return nil, errors.New("not recorded")
+		}
+		return value, nil
+	}
+
+	var samples []pprof.Sample
+	for _, e := range s.Counts {
+		sample, err := r.decoder.DecodeSample(e.Key, e.Value, lookup)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// Symbolizer resolves the addresses of the samples of the snapshot with the kallsyms and
+// the processes recorded. The binaries of the processes are looked up under root, e.g. a
+// copy of the filesystem of the host, user addresses being left unresolved if they are
+// missing.
+func (r *Reader) Symbolizer(s *Snapshot, root string) pprof.Symbolizer {
+	return &snapshotSymbolizer{kallsyms: r.Header.Kallsyms, processes: s.Processes, root: root}
+}
+
+type snapshotSymbolizer struct {
+	kallsyms  string
+	processes map[uint32]*Process
+	root      string
+}
+
+func (s *snapshotSymbolizer) Kernel(addrs []uint64) []string {
+	return ksym.ResolveAddrsIn(strings.NewReader(s.kallsyms), addrs)
+}
+
+func (s *snapshotSymbolizer) User(pid uint32, addrs []uint64) []string {
+	proc, ok := s.processes[pid]
+	if !ok {
+		names := make([]string, len(addrs))
+		for i, addr := range addrs {
+			names[i] = fmt.Sprintf("0x%x", addr)
+		}
+		return names
+	}
+	return symbol.ResolveGoSymsIn(filepath.Join(s.root, proc.Exe), addrs)
+}
+
+func (s *snapshotSymbolizer) ExeMapping(pid uint32) (*symbol.Mapping, error) {
+	proc, ok := s.processes[pid]
+	if !ok {
+		return nil, fmt.Errorf("process %d not recorded", pid)
+	}
+	return symbol.ExeMappingIn(strings.NewReader(proc.Maps), proc.Exe)
+}
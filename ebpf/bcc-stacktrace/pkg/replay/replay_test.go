@@ -0,0 +1,233 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+)
+
+var update = flag.Bool("update", false, "Update the golden files")
+
+const kallsyms = `ffffffff81000000 T _stext
+ffffffff81001000 T native_write_msr
+ffffffff81002000 T do_syscall_64
+ffffffff81003000 T entry_SYSCALL_64
+`
+
+var cpu = pprof.ValueTypes{
+	PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+	Period:     10000000,
+	SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+	Weighted:   []bool{false, true},
+}
+
+func encode(t *testing.T, v interface{}) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func countsEntry(t *testing.T, pid uint32, comm string, kern, user int32, count uint64) Entry {
+	key := bpfmap.CountsKey{Pid: pid, KernStackId: kern, UserStackId: user}
+	copy(key.TaskComm[:], comm)
+	return Entry{
+		Key:   encode(t, key),
+		Value: encode(t, bpfmap.CountsValue{Count: count, Weight: count * 10000000}),
+	}
+}
+
+func stackEntry(t *testing.T, id int32, addrs ...uint64) Entry {
+	var stack bpfmap.Stack
+	copy(stack[:], addrs)
+	return Entry{Key: bpfmap.Decoder{Order: binary.LittleEndian}.StackKey(id), Value: encode(t, stack)}
+}
+
+// newSnapshot is an interval of a process running exe, whose text is mapped at
+// [start, limit), calling leaf from main
+func newSnapshot(t *testing.T, exe string, start, limit, leaf, main uint64) *Snapshot {
+	return &Snapshot{
+		Start: time.Unix(1700000000, 0).UTC(),
+		End:   time.Unix(1700000005, 0).UTC(),
+		Counts: []Entry{
+			countsEntry(t, 42, "api", 0, 1, 3),
+			countsEntry(t, 42, "api", -14, 2, 2),
+			// The stack of a collision is not in the stack map
+			countsEntry(t, 42, "api", -17, 3, 1),
+		},
+		Stacks: []Entry{
+			stackEntry(t, 0, 0xffffffff81001010, 0xffffffff81002020, 0xffffffff81003010),
+			stackEntry(t, 1, leaf, main),
+			stackEntry(t, 2, main),
+		},
+		Errors: []uint64{1, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		Processes: map[uint32]*Process{
+			42: {
+				Exe:  exe,
+				Maps: fmt.Sprintf("%x-%x r-xp 00000000 fd:03 960637 %s\n7ffd0000-7ffd1000 rw-p 00000000 00:00 0 [stack]\n", start, limit, exe),
+			},
+		},
+	}
+}
+
+// replay writes the snapshot in a recording, reads it back and builds its profiles
+func replay(t *testing.T, s *Snapshot) map[uint32]*profile.Profile {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, &Header{Types: cpu, Kallsyms: kallsyms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return read(t, &buf)
+}
+
+func read(t *testing.T, recording io.Reader) map[uint32]*profile.Profile {
+	r, err := NewReader(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("got %v after the last snapshot, want EOF", err)
+	}
+	return pprof.BuildProfiles(r.Samples(s), s.Start, s.End.Sub(s.Start), r.Header.Types, r.Symbolizer(s, "/"))
+}
+
+func functions(s *profile.Sample) []string {
+	var names []string
+	for _, l := range s.Location {
+		names = append(names, l.Line[0].Function.Name)
+	}
+	return names
+}
+
+func TestReplay(t *testing.T) {
+	// The stacks of this test binary are resolved with its symbols
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := uint64(reflect.ValueOf(functions).Pointer())
+	main := uint64(reflect.ValueOf(TestReplay).Pointer())
+	start, limit := leaf&^0xfffff, (main+0x100000)&^0xfffff
+	if main < leaf {
+		start, limit = main&^0xfffff, (leaf+0x100000)&^0xfffff
+	}
+
+	profiles := replay(t, newSnapshot(t, exe, start, limit, leaf, main))
+	p, ok := profiles[42]
+	if !ok || len(profiles) != 1 {
+		t.Fatalf("profiles of %d processes, want the one of 42", len(profiles))
+	}
+	if m := p.Mapping[1]; m.File != exe || m.Start != start || m.Limit != limit {
+		t.Errorf("user mapping %+v, want %s at [%x, %x)", m, exe, start, limit)
+	}
+
+	got := map[string]int64{}
+	for _, s := range p.Sample {
+		got[strings.Join(functions(s), ";")] = s.Value[1]
+	}
+	pkg := "github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/replay."
+	// The stacks of the snapshot end at the test rather than at a root
+	want := map[string]int64{
+		"native_write_msr;do_syscall_64;entry_SYSCALL_64;" + pkg + "functions;" + pkg + "TestReplay;[unknown root]": 30000000,
+		pkg + "TestReplay;[unknown root]": 20000000,
+		"[lost: stack collision]":         10000000,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got samples %v, want %v", got, want)
+	}
+}
+
+func TestReplayGolden(t *testing.T) {
+	recording := filepath.Join("testdata", "recording.gz")
+	golden := filepath.Join("testdata", "recording.pb")
+	if *update {
+		// The binary is missing, user addresses are left unresolved
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, &Header{Types: cpu, Kallsyms: kallsyms})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(newSnapshot(t, "/usr/bin/api", 0x400000, 0x500000, 0x401000, 0x402000)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(recording, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p := read(t, f)[42]
+	var got bytes.Buffer
+	if err := p.WriteUncompressed(&got); err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := ioutil.WriteFile(golden, got.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("replayed profile differs from %s, run go test -update if expected:\n%s", golden, p)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, &Header{Types: cpu, Kallsyms: kallsyms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(newSnapshot(t, "/usr/bin/api", 0x400000, 0x500000, 0x401000, 0x402000)); err != nil {
+		t.Fatal(err)
+	}
+	// The recorder was killed, the snapshots flushed can still be read
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Samples(s)) != 3 {
+		t.Errorf("%d samples, want 3", len(r.Samples(s)))
+	}
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Errorf("got %v at the end of a truncated recording, want an error", err)
+	}
+}
@@ -1,31 +1,37 @@
-//+build linux
 package symbol
 
-import(
+import (
 	"debug/elf"
 	"debug/gosym"
 	"errors"
 	"fmt"
+	"log"
+	"os"
+	"sync"
 )
 
 // TODO:
 // 1. support PIE elf which has no gopclntab
 // 2. handle non-go symbols
 func ResolveGoSyms(pid uint32, addrs []uint64) []string {
+	return ResolveGoSymsIn(fmt.Sprintf("/proc/%d/exe", pid), addrs)
+}
+
+// ResolveGoSymsIn resolves the addresses with the symbols of the Go binary at elfpath
+func ResolveGoSymsIn(elfpath string, addrs []uint64) []string {
 	res := []string{}
 	foundTab := false
 	var table *gosym.Table
-	elfpath := fmt.Sprintf("/proc/%d/exe", pid)
-	data, err := gopclntab(elfpath)
+	data, text, err := gopclntab(elfpath)
 	if err != nil {
-		fmt.Printf("Failed to read gopclntab: %v", err)
+		warnOnce(elfpath, "Failed to read gopclntab of %s: %v", elfpath, err)
 	}
 
 	// try gopclntab for non-PIE elf
 	if data != nil {
-		table, err = gosym.NewTable(nil, gosym.NewLineTable(data, 0))
+		table, err = gosym.NewTable(nil, gosym.NewLineTable(data, text))
 		if err != nil {
-			fmt.Printf("gosym.NewTable: %w", err)
+			warnOnce(elfpath, "Failed to read the symbols of %s: %v", elfpath, err)
 		} else {
 			foundTab = true
 		}
@@ -42,6 +48,22 @@ func ResolveGoSyms(pid uint32, addrs []uint64) []string {
 	return res
 }
 
+// warned are the binaries whose symbols could not be read, which is only logged once
+var warned sync.Map
+
+// warnOnce logs the error the first time the symbols of the binary at path fail to be read,
+// e.g. for every process of a binary which is not a Go one. /proc/<pid>/exe is resolved to
+// the binary the process runs.
+func warnOnce(path string, format string, args ...interface{}) {
+	binary := path
+	if target, err := os.Readlink(path); err == nil {
+		binary = target
+	}
+	if _, loaded := warned.LoadOrStore(binary, true); !loaded {
+		log.Printf(format, args...)
+	}
+}
+
 func resolveSymbol(table *gosym.Table, pc uint64) string {
 	_, _, fn := table.PCToLine(pc)
 	if fn == nil {
@@ -50,15 +72,23 @@ func resolveSymbol(table *gosym.Table, pc uint64) string {
 	return fn.Name
 }
 
-func gopclntab(path string) ([]byte, error) {
+// gopclntab returns the line table and the start address of the text, which the tables
+// of go1.18+ are relative to
+func gopclntab(path string) ([]byte, uint64, error) {
 	file, err := elf.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("elf.Open: %w", err)
+		return nil, 0, fmt.Errorf("elf.Open: %w", err)
+	}
+	defer file.Close()
+	var text uint64
+	if s := file.Section(".text"); s != nil {
+		text = s.Addr
 	}
 	for _, s := range file.Sections {
 		if s.Name == ".gopclntab" {
-			return s.Data()
+			data, err := s.Data()
+			return data, text, err
 		}
 	}
-	return nil, errors.New("could not find .gopclntab")
+	return nil, 0, errors.New("could not find .gopclntab")
 }
@@ -0,0 +1,105 @@
+package symbol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Mapping is the executable text mapping of a process as listed in /proc/<pid>/maps
+type Mapping struct {
+	Start  uint64
+	Limit  uint64
+	Offset uint64
+	Path   string
+}
+
+// ExeMapping returns the first executable mapping backed by the main binary of the process
+func ExeMapping(pid uint32) (*Mapping, error) {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return nil, fmt.Errorf("readlink exe: %w", err)
+	}
+	// The binary was replaced or removed since the process started, maps names it the same
+	// way followed by a separate (deleted) field
+	exe = strings.TrimSuffix(exe, " (deleted)")
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return nil, fmt.Errorf("open maps: %w", err)
+	}
+	defer f.Close()
+	return ExeMappingIn(f, exe)
+}
+
+// ExeMappingIn returns the first executable mapping of exe in maps, e.g. a snapshot of
+// /proc/<pid>/maps
+func ExeMappingIn(maps io.Reader, exe string) (*Mapping, error) {
+	scanner := bufio.NewScanner(maps)
+	for scanner.Scan() {
+		// Each line in /proc/<pid>/maps is formatted like the following:
+		// 00400000-0048a000 r-xp 00000000 fd:03 960637       /bin/foo
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[5] != exe || !strings.Contains(fields[1], "x") {
+			continue
+		}
+		m, err := parseMapping(fields)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read maps: %w", err)
+	}
+	return nil, fmt.Errorf("no executable mapping of %s", exe)
+}
+
+// ExecMappingsIn returns the executable mappings backed by files in maps, e.g. the main
+// binary and the shared libraries of a process
+func ExecMappingsIn(maps io.Reader) ([]*Mapping, error) {
+	var mappings []*Mapping
+	scanner := bufio.NewScanner(maps)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") || !strings.Contains(fields[1], "x") {
+			continue
+		}
+		m, err := parseMapping(fields)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read maps: %w", err)
+	}
+	return mappings, nil
+}
+
+func parseMapping(fields []string) (*Mapping, error) {
+	addrs := strings.SplitN(fields[0], "-", 2)
+	if len(addrs) != 2 {
+		return nil, fmt.Errorf("malformed address range %q", fields[0])
+	}
+	start, err := strconv.ParseUint(addrs[0], 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse start address: %w", err)
+	}
+	limit, err := strconv.ParseUint(addrs[1], 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse limit address: %w", err)
+	}
+	offset, err := strconv.ParseUint(fields[2], 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse offset: %w", err)
+	}
+	return &Mapping{
+		Start:  start,
+		Limit:  limit,
+		Offset: offset,
+		Path:   fields[5],
+	}, nil
+}
@@ -0,0 +1,152 @@
+package target
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Selector tells which processes are profiled: the ones with the pids, the ones whose
+// comm or command line match the regular expressions, and the ones in the cgroups or
+// their descendants. An empty selector selects all processes.
+type Selector struct {
+	Pids       []uint32
+	CgroupDirs []string
+	Comm       *regexp.Regexp
+	Cmdline    *regexp.Regexp
+
+	// procDir is where the processes are looked for, /proc but for tests
+	procDir string
+}
+
+// NewSelector parses comma separated pids and cgroup directories, along with the comm and
+// command line regular expressions, any of them being possibly empty
+func NewSelector(pids, cgroupDirs, comm, cmdline string) (*Selector, error) {
+	s := &Selector{procDir: "/proc"}
+	for _, p := range splitList(pids) {
+		pid, err := strconv.ParseInt(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pid %q", p)
+		}
+		// -1 used to stand for all processes
+		if pid < 0 {
+			continue
+		}
+		s.Pids = append(s.Pids, uint32(pid))
+	}
+	s.CgroupDirs = splitList(cgroupDirs)
+	var err error
+	if comm != "" {
+		if s.Comm, err = regexp.Compile(comm); err != nil {
+			return nil, fmt.Errorf("invalid comm regular expression: %w", err)
+		}
+	}
+	if cmdline != "" {
+		if s.Cmdline, err = regexp.Compile(cmdline); err != nil {
+			return nil, fmt.Errorf("invalid cmdline regular expression: %w", err)
+		}
+	}
+	return s, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// All tells whether all processes are selected
+func (s *Selector) All() bool {
+	return len(s.Pids) == 0 && len(s.CgroupDirs) == 0 && s.Comm == nil && s.Cmdline == nil
+}
+
+// Discover returns the processes and the cgroup ids currently selected. Processes are
+// matched by comm and command line at the time of the call, so it is to be called again
+// to pick up the processes started since.
+func (s *Selector) Discover() (map[uint32]bool, map[uint64]bool, error) {
+	pids := map[uint32]bool{}
+	for _, pid := range s.Pids {
+		pids[pid] = true
+	}
+	if s.Comm != nil || s.Cmdline != nil {
+		if err := s.matchProcesses(pids); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cgroups := map[uint64]bool{}
+	for _, dir := range s.CgroupDirs {
+		if err := addCgroups(dir, cgroups); err != nil {
+			return nil, nil, err
+		}
+	}
+	return pids, cgroups, nil
+}
+
+func (s *Selector) matchProcesses(pids map[uint32]bool) error {
+	entries, err := ioutil.ReadDir(s.procDir)
+	if err != nil {
+		return fmt.Errorf("listing processes: %w", err)
+	}
+	for _, entry := range entries {
+		pid, err := strconv.ParseUint(entry.Name(), 10, 32)
+		if err != nil {
+			continue
+		}
+		dir := filepath.Join(s.procDir, entry.Name())
+		// Processes may exit in between, they are simply left out
+		if s.Comm != nil {
+			comm, err := ioutil.ReadFile(filepath.Join(dir, "comm"))
+			if err == nil && s.Comm.Match(bytes.TrimSuffix(comm, []byte("\n"))) {
+				pids[uint32(pid)] = true
+				continue
+			}
+		}
+		if s.Cmdline != nil {
+			cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+			// Arguments are separated by NULs
+			cmdline = bytes.TrimSuffix(cmdline, []byte{0})
+			if err == nil && s.Cmdline.Match(bytes.ReplaceAll(cmdline, []byte{0}, []byte(" "))) {
+				pids[uint32(pid)] = true
+			}
+		}
+	}
+	return nil
+}
+
+// addCgroups adds the ids of the cgroup and of all its descendants, the id of a cgroup v2
+// being the inode number of its directory
+func addCgroups(dir string, cgroups map[uint64]bool) error {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Cgroups removed during the walk
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("failed to get the inode of cgroup directory %s", path)
+		}
+		cgroups[st.Ino] = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walking cgroup directory %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package target
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestDiscover(t *testing.T) {
+	proc := t.TempDir()
+	processes := map[string][2]string{
+		"1":    {"systemd\n", "/sbin/init\x00splash\x00"},
+		"42":   {"api-server\n", "/usr/bin/api-server\x00--port\x008080\x00"},
+		"43":   {"worker\n", "/usr/bin/python3\x00worker.py\x00--queue\x00jobs\x00"},
+		"self": {"bcc-stacktrace\n", ""},
+	}
+	for pid, files := range processes {
+		dir := filepath.Join(proc, pid)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "comm"), []byte(files[0]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "cmdline"), []byte(files[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cgroupRoot := t.TempDir()
+	app := filepath.Join(cgroupRoot, "app.slice")
+	child := filepath.Join(app, "web.scope")
+	other := filepath.Join(cgroupRoot, "other.slice")
+	for _, dir := range []string{child, other} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := NewSelector("-1,7, 9", app, "^api-", "worker\\.py --queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.procDir = proc
+	if s.All() {
+		t.Fatal("selector selects all processes")
+	}
+	pids, cgroups, err := s.Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[uint32]bool{7: true, 9: true, 42: true, 43: true}; !reflect.DeepEqual(pids, want) {
+		t.Errorf("pids: %v, want %v", pids, want)
+	}
+	want := map[uint64]bool{inode(t, app): true, inode(t, child): true}
+	if !reflect.DeepEqual(cgroups, want) {
+		t.Errorf("cgroups: %v, want %v", cgroups, want)
+	}
+
+	all, err := NewSelector("-1", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !all.All() {
+		t.Error("-pid -1 does not select all processes")
+	}
+	if _, err := NewSelector("abc", "", "", ""); err == nil {
+		t.Error("expected an error for an invalid pid")
+	}
+}
+
+func inode(t *testing.T, dir string) uint64 {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino
+}
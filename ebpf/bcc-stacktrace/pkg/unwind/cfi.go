@@ -0,0 +1,634 @@
+package unwind
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Rules of a register in a row, only the ones the unwinding needs being told apart
+const (
+	// The register keeps its value in the caller, e.g. the frame pointer of a function
+	// which does not use it, or the return address of arm64 leaf functions, kept in lr
+	sameValue = iota
+	// The register is saved at CFA+offset
+	atOffset
+	// The register has no value in the caller, e.g. the return address of _start
+	undefined
+	// Rules the unwinding does not support, e.g. DWARF expressions
+	unsupported
+)
+
+type rule struct {
+	kind   uint8
+	offset int64
+}
+
+// noReg is the CFA register of the rows after the end of a function, and exprReg the one
+// of the rows whose CFA is a DWARF expression, e.g. in the PLT
+const (
+	noReg   = ^uint64(0)
+	exprReg = noReg - 1
+)
+
+// row tells how to unwind the frames of the pcs from pc on, until the next row
+type row struct {
+	pc uint64
+	// CFA, the sp of the caller, is cfaReg + cfaOffset
+	cfaReg    uint64
+	cfaOffset int64
+	ra        rule
+	fp        rule
+}
+
+func (r row) sameRules(o row) bool {
+	return r.cfaReg == o.cfaReg && r.cfaOffset == o.cfaOffset && r.ra == o.ra && r.fp == o.fp
+}
+
+// Table is the unwind table of a binary, built from its .eh_frame, or .debug_frame
+type Table struct {
+	rows  []row
+	loads []elf.ProgHeader
+}
+
+// ReadTable builds the unwind table of the ELF binary at path
+func ReadTable(path string, arch Arch) (*Table, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t := &Table{}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD {
+			t.loads = append(t.loads, p.ProgHeader)
+		}
+	}
+	addrSize := 8
+	if f.Class == elf.ELFCLASS32 {
+		addrSize = 4
+	}
+	// Binaries built with -fno-asynchronous-unwind-tables, and Go ones, only have
+	// .debug_frame
+	for _, name := range []string{".eh_frame", ".debug_frame"} {
+		s := f.Section(name)
+		if s == nil || s.Type == elf.SHT_NOBITS {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		p := &parser{data: data, addr: s.Addr, eh: name == ".eh_frame", arch: arch, order: f.ByteOrder, addrSize: addrSize}
+		rows, err := p.parse()
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", name, err)
+		}
+		if len(rows) > 0 {
+			t.rows = rows
+			break
+		}
+	}
+	if len(t.rows) == 0 {
+		return nil, errors.New("no call frame information")
+	}
+	return t, nil
+}
+
+// vaddr returns the address in the binary of an offset in the file, e.g. of a pc in a
+// mapping of the binary
+func (t *Table) vaddr(off uint64) (uint64, bool) {
+	for _, p := range t.loads {
+		if off >= p.Off && off < p.Off+p.Filesz {
+			return off - p.Off + p.Vaddr, true
+		}
+	}
+	return 0, false
+}
+
+// lookup returns the row of the address, if its function has call frame information
+func (t *Table) lookup(addr uint64) (row, bool) {
+	i := sort.Search(len(t.rows), func(i int) bool { return t.rows[i].pc > addr }) - 1
+	if i < 0 || t.rows[i].cfaReg == noReg {
+		return row{}, false
+	}
+	return t.rows[i], true
+}
+
+// sortRows sorts the rows by pc. Where a function starts right at the end of another, the
+// end of the other is sorted first, so that lookups find the function.
+func sortRows(rows []row) []row {
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].pc != rows[j].pc {
+			return rows[i].pc < rows[j].pc
+		}
+		return rows[i].cfaReg == noReg && rows[j].cfaReg != noReg
+	})
+	return rows
+}
+
+// cie is a Common Information Entry, what the FDEs referring to it share
+type cie struct {
+	codeAlign uint64
+	dataAlign int64
+	raReg     uint64
+	// Encoding of the addresses of the FDEs, with a z augmentation
+	fdeEnc byte
+	hasAug bool
+	// Instructions run before the ones of every FDE
+	initial []byte
+}
+
+// parser parses .eh_frame, or .debug_frame, whose CIE ids and FDE addresses differ
+type parser struct {
+	data []byte
+	// Address of the section, which pc relative addresses are relative to
+	addr     uint64
+	eh       bool
+	arch     Arch
+	order    binary.ByteOrder
+	addrSize int
+	cies     map[int]*cie
+}
+
+// parse returns the rows of all the FDEs of the section
+func (p *parser) parse() ([]row, error) {
+	p.cies = map[int]*cie{}
+	var rows []row
+	for off := 0; off < len(p.data); {
+		e, err := p.entry(off)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		off = e.end
+		if e.isCIE {
+			continue
+		}
+		c, err := p.cie(e.cieOff)
+		if err != nil {
+			// Entries with unknown augmentations are skipped, the others still unwind
+			continue
+		}
+		rows, err = p.fde(c, e, rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sortRows(rows), nil
+}
+
+// entry is a CIE or an FDE, body being the offset right after its CIE id or pointer
+type entry struct {
+	isCIE  bool
+	cieOff int
+	body   int
+	end    int
+}
+
+// entry reads the header of the entry at off, returning nil at the terminator of .eh_frame
+func (p *parser) entry(off int) (*entry, error) {
+	b := p.reader(off, len(p.data))
+	length := uint64(b.u32())
+	if b.err == nil && length == 0 {
+		return nil, nil
+	}
+	is64 := length == 0xffffffff
+	if is64 {
+		length = b.u64()
+	}
+	if b.err != nil || length > uint64(len(p.data)-b.off) {
+		return nil, fmt.Errorf("truncated entry at 0x%x", off)
+	}
+	e := &entry{end: b.off + int(length)}
+	idOff := b.off
+	var id uint64
+	if is64 {
+		id = b.u64()
+	} else {
+		id = uint64(b.u32())
+	}
+	if b.err != nil {
+		return nil, fmt.Errorf("truncated entry at 0x%x", off)
+	}
+	e.body = b.off
+	switch {
+	case p.eh:
+		// The CIE pointer of .eh_frame is relative to itself
+		e.isCIE = id == 0
+		e.cieOff = idOff - int(id)
+	default:
+		e.isCIE = id == 0xffffffff || id == ^uint64(0)
+		e.cieOff = int(id)
+	}
+	return e, nil
+}
+
+// cie parses the CIE at off, once
+func (p *parser) cie(off int) (*cie, error) {
+	if c, ok := p.cies[off]; ok {
+		if c == nil {
+			return nil, errors.New("unsupported CIE")
+		}
+		return c, nil
+	}
+	c, err := p.parseCIE(off)
+	p.cies[off] = c
+	return c, err
+}
+
+func (p *parser) parseCIE(off int) (*cie, error) {
+	if off < 0 || off >= len(p.data) {
+		return nil, fmt.Errorf("no CIE at 0x%x", off)
+	}
+	e, err := p.entry(off)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || !e.isCIE {
+		return nil, fmt.Errorf("no CIE at 0x%x", off)
+	}
+	b := p.reader(e.body, e.end)
+	c := &cie{}
+	version := b.u8()
+	aug := b.cstring()
+	if version >= 4 {
+		// Address and segment selector sizes
+		b.u8()
+		b.u8()
+	}
+	c.codeAlign = b.uleb()
+	c.dataAlign = b.sleb()
+	if version == 1 {
+		c.raReg = uint64(b.u8())
+	} else {
+		c.raReg = b.uleb()
+	}
+	if aug != "" {
+		if aug[0] != 'z' {
+			return nil, fmt.Errorf("unsupported augmentation %q", aug)
+		}
+		c.hasAug = true
+		n := b.uleb()
+		augEnd := b.off + int(n)
+		for _, a := range aug[1:] {
+			switch a {
+			case 'R':
+				c.fdeEnc = b.u8()
+			case 'P':
+				// The personality routine is not needed to unwind
+				p.pointer(b, b.u8())
+			case 'L':
+				b.u8()
+			}
+		}
+		b.off = augEnd
+	}
+	if b.err != nil || b.off > e.end {
+		return nil, fmt.Errorf("truncated CIE at 0x%x", off)
+	}
+	c.initial = p.data[b.off:e.end]
+	return c, nil
+}
+
+// fde appends the rows of the FDE, from the start of its function to its end
+func (p *parser) fde(c *cie, e *entry, rows []row) ([]row, error) {
+	b := p.reader(e.body, e.end)
+	start, ok := p.pointer(b, c.fdeEnc)
+	// The range is an offset, whatever the encoding of the addresses
+	length, _ := p.pointer(b, c.fdeEnc&0x0f)
+	if c.hasAug {
+		b.off += int(b.uleb())
+	}
+	if b.err != nil || b.off > e.end {
+		return nil, fmt.Errorf("truncated FDE at 0x%x", e.body)
+	}
+	// Functions discarded by the linker, or addresses relative to something else than
+	// the section
+	if !ok || (start == 0 && length == 0) {
+		return rows, nil
+	}
+
+	initial := state{cfaReg: noReg}
+	m := &machine{p: p, c: c}
+	m.run(newReader(c.initial, 0, len(c.initial), p.order), &initial, nil)
+	m.loc = start
+	cur := initial
+	rows = m.run(p.reader(b.off, e.end), &cur, &rowsBuilder{rows: rows, initial: initial})
+	rows = appendRow(rows, row{pc: m.loc, cfaReg: cur.cfaReg, cfaOffset: cur.cfaOffset, ra: cur.ra, fp: cur.fp})
+	return append(rows, row{pc: start + length, cfaReg: noReg}), nil
+}
+
+func appendRow(rows []row, r row) []row {
+	if n := len(rows); n > 0 && rows[n-1].cfaReg != noReg && rows[n-1].sameRules(r) {
+		return rows
+	}
+	if n := len(rows); n > 0 && rows[n-1].pc == r.pc {
+		rows[n-1] = r
+		return rows
+	}
+	return append(rows, r)
+}
+
+// state is the rules at a location, while running the instructions of an FDE
+type state struct {
+	cfaReg    uint64
+	cfaOffset int64
+	ra        rule
+	fp        rule
+}
+
+// rowsBuilder collects the rows of an FDE, a row ending whenever the location advances
+type rowsBuilder struct {
+	rows    []row
+	initial state
+}
+
+// machine runs the call frame instructions
+type machine struct {
+	p   *parser
+	c   *cie
+	loc uint64
+}
+
+// run runs the instructions read by b on s. The rows are collected with rb, the initial
+// instructions of a CIE being run without.
+func (m *machine) run(b *reader, s *state, rb *rowsBuilder) []row {
+	var saved []state
+	set := func(reg uint64, r rule) {
+		switch reg {
+		case m.c.raReg:
+			s.ra = r
+		case m.p.arch.FP:
+			s.fp = r
+		}
+	}
+	restore := func(reg uint64) {
+		if rb == nil {
+			set(reg, rule{})
+			return
+		}
+		switch reg {
+		case m.c.raReg:
+			s.ra = rb.initial.ra
+		case m.p.arch.FP:
+			s.fp = rb.initial.fp
+		}
+	}
+	advance := func(delta uint64) {
+		if rb != nil {
+			rb.rows = appendRow(rb.rows, row{pc: m.loc, cfaReg: s.cfaReg, cfaOffset: s.cfaOffset, ra: s.ra, fp: s.fp})
+		}
+		m.loc += delta * m.c.codeAlign
+	}
+	da := m.c.dataAlign
+
+	for b.err == nil && b.off < b.end {
+		op := b.u8()
+		switch op >> 6 {
+		case 1: // DW_CFA_advance_loc
+			advance(uint64(op & 0x3f))
+			continue
+		case 2: // DW_CFA_offset
+			set(uint64(op&0x3f), rule{atOffset, int64(b.uleb()) * da})
+			continue
+		case 3: // DW_CFA_restore
+			restore(uint64(op & 0x3f))
+			continue
+		}
+		switch op {
+		case 0x00: // DW_CFA_nop
+		case 0x01: // DW_CFA_set_loc
+			loc, _ := m.p.pointer(b, m.c.fdeEnc)
+			if rb != nil {
+				rb.rows = appendRow(rb.rows, row{pc: m.loc, cfaReg: s.cfaReg, cfaOffset: s.cfaOffset, ra: s.ra, fp: s.fp})
+			}
+			m.loc = loc
+		case 0x02: // DW_CFA_advance_loc1
+			advance(uint64(b.u8()))
+		case 0x03: // DW_CFA_advance_loc2
+			advance(uint64(b.u16()))
+		case 0x04: // DW_CFA_advance_loc4
+			advance(uint64(b.u32()))
+		case 0x05: // DW_CFA_offset_extended
+			reg := b.uleb()
+			set(reg, rule{atOffset, int64(b.uleb()) * da})
+		case 0x06: // DW_CFA_restore_extended
+			restore(b.uleb())
+		case 0x07: // DW_CFA_undefined
+			set(b.uleb(), rule{kind: undefined})
+		case 0x08: // DW_CFA_same_value
+			set(b.uleb(), rule{kind: sameValue})
+		case 0x09: // DW_CFA_register
+			reg := b.uleb()
+			b.uleb()
+			set(reg, rule{kind: unsupported})
+		case 0x0a: // DW_CFA_remember_state
+			saved = append(saved, *s)
+		case 0x0b: // DW_CFA_restore_state
+			if n := len(saved); n > 0 {
+				*s = saved[n-1]
+				saved = saved[:n-1]
+			}
+		case 0x0c: // DW_CFA_def_cfa
+			s.cfaReg = b.uleb()
+			s.cfaOffset = int64(b.uleb())
+		case 0x0d: // DW_CFA_def_cfa_register
+			s.cfaReg = b.uleb()
+		case 0x0e: // DW_CFA_def_cfa_offset
+			s.cfaOffset = int64(b.uleb())
+		case 0x0f: // DW_CFA_def_cfa_expression
+			b.off += int(b.uleb())
+			s.cfaReg = exprReg
+		case 0x10: // DW_CFA_expression
+			reg := b.uleb()
+			b.off += int(b.uleb())
+			set(reg, rule{kind: unsupported})
+		case 0x11: // DW_CFA_offset_extended_sf
+			reg := b.uleb()
+			set(reg, rule{atOffset, b.sleb() * da})
+		case 0x12: // DW_CFA_def_cfa_sf
+			s.cfaReg = b.uleb()
+			s.cfaOffset = b.sleb() * da
+		case 0x13: // DW_CFA_def_cfa_offset_sf
+			s.cfaOffset = b.sleb() * da
+		case 0x14: // DW_CFA_val_offset
+			reg := b.uleb()
+			b.uleb()
+			set(reg, rule{kind: unsupported})
+		case 0x15: // DW_CFA_val_offset_sf
+			reg := b.uleb()
+			b.sleb()
+			set(reg, rule{kind: unsupported})
+		case 0x16: // DW_CFA_val_expression
+			reg := b.uleb()
+			b.off += int(b.uleb())
+			set(reg, rule{kind: unsupported})
+		case 0x2e: // DW_CFA_GNU_args_size
+			b.uleb()
+		case 0x2f: // DW_CFA_GNU_negative_offset_extended
+			reg := b.uleb()
+			set(reg, rule{atOffset, -int64(b.uleb()) * da})
+		default:
+			// The rest of the instructions can't be decoded
+			b.err = fmt.Errorf("unknown call frame instruction 0x%x", op)
+		}
+	}
+	if rb == nil {
+		return nil
+	}
+	return rb.rows
+}
+
+// pointer reads an address encoded with a DW_EH_PE_* encoding. Addresses which are not
+// absolute nor relative to the section are not ok.
+func (p *parser) pointer(b *reader, enc byte) (uint64, bool) {
+	if enc == 0xff {
+		return 0, true
+	}
+	field := p.addr + uint64(b.off)
+	var v uint64
+	switch enc & 0x0f {
+	case 0x00:
+		if p.addrSize == 4 {
+			v = uint64(b.u32())
+		} else {
+			v = b.u64()
+		}
+	case 0x01:
+		v = b.uleb()
+	case 0x02:
+		v = uint64(b.u16())
+	case 0x03:
+		v = uint64(b.u32())
+	case 0x04, 0x0c:
+		v = b.u64()
+	case 0x09:
+		v = uint64(b.sleb())
+	case 0x0a:
+		v = uint64(int16(b.u16()))
+	case 0x0b:
+		v = uint64(int32(b.u32()))
+	default:
+		b.err = fmt.Errorf("unknown pointer encoding 0x%x", enc)
+		return 0, false
+	}
+	switch enc & 0x70 {
+	case 0x00:
+	case 0x10:
+		v += field
+	default:
+		return v, false
+	}
+	return v, true
+}
+
+// reader reads the fields of the section from off to end, keeping the first error
+type reader struct {
+	data  []byte
+	off   int
+	end   int
+	order binary.ByteOrder
+	err   error
+}
+
+func newReader(data []byte, off, end int, order binary.ByteOrder) *reader {
+	return &reader{data: data, off: off, end: end, order: order}
+}
+
+func (p *parser) reader(off, end int) *reader {
+	return newReader(p.data, off, end, p.order)
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.off+n > r.end {
+		r.err = errors.New("truncated")
+		return nil
+	}
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *reader) u8() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return r.order.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return r.order.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) u64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return r.order.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) uleb() uint64 {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		b := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		if shift < 64 {
+			v |= uint64(b&0x7f) << shift
+		}
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+func (r *reader) sleb() int64 {
+	var v int64
+	var shift uint
+	for {
+		b := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		if shift < 64 {
+			v |= int64(b&0x7f) << shift
+		}
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v
+		}
+	}
+}
+
+func (r *reader) cstring() string {
+	start := r.off
+	for r.err == nil {
+		if r.u8() == 0 {
+			return string(r.data[start : r.off-1])
+		}
+	}
+	return ""
+}
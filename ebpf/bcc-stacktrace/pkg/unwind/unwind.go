@@ -0,0 +1,218 @@
+// Package unwind unwinds user stacks without frame pointers, from the registers and a copy
+// of the top of the stack, with the call frame information of the binaries mapped, i.e.
+// their .eh_frame or .debug_frame
+package unwind
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/symbol"
+)
+
+// Arch is the DWARF numbers of the registers of an architecture the unwinding reads
+type Arch struct {
+	SP uint64
+	FP uint64
+	// HasLR tells whether the return address of leaf functions is in a register, the link
+	// register, rather than on the stack
+	HasLR bool
+}
+
+var (
+	AMD64 = Arch{SP: 7, FP: 6}
+	ARM64 = Arch{SP: 31, FP: 29, HasLR: true}
+)
+
+// Regs are the registers of the user code interrupted
+type Regs struct {
+	IP uint64
+	SP uint64
+	FP uint64
+	// LR is the link register, on the architectures which have one
+	LR uint64
+}
+
+// Unwinder unwinds the stacks of the processes of the host, caching the tables of their
+// binaries
+type Unwinder struct {
+	arch Arch
+
+	mu sync.Mutex
+	// Tables by binary, nil for the ones without call frame information
+	tables map[binaryId]*Table
+	procs  map[uint32][]mapping
+}
+
+// binaryId identifies a binary by its device and inode
+type binaryId struct {
+	dev uint64
+	ino uint64
+}
+
+// mapping is an executable mapping of a process, along with the table of its binary
+type mapping struct {
+	symbol.Mapping
+	table *Table
+}
+
+// NewUnwinder unwinds the stacks of the processes of the host, of the arch
+func NewUnwinder(arch Arch) *Unwinder {
+	return &Unwinder{arch: arch, tables: map[binaryId]*Table{}, procs: map[uint32][]mapping{}}
+}
+
+// Unwind returns the addresses of the user stack of the process, leaf first, like
+// bpf_get_stack: the pc followed by the return addresses. stack is the copy of the stack
+// from regs.SP on. Unwinding stops where the stack is not known, e.g. beyond the copy.
+func (u *Unwinder) Unwind(pid uint32, regs Regs, stack []byte) []uint64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	maps, ok := u.procs[pid]
+	if !ok {
+		maps = u.readMappings(pid)
+		u.procs[pid] = maps
+	}
+	return unwindStack(u.arch, regs, stack, func(pc uint64) (row, bool) {
+		for _, m := range maps {
+			if pc < m.Start || pc >= m.Limit {
+				continue
+			}
+			if m.table == nil {
+				return row{}, false
+			}
+			addr, ok := m.table.vaddr(pc - m.Start + m.Offset)
+			if !ok {
+				return row{}, false
+			}
+			return m.table.lookup(addr)
+		}
+		return row{}, false
+	})
+}
+
+// Forget drops the mappings of the processes, to be read again, e.g. every interval as
+// processes load libraries, exit and pids are reused. Tables are kept.
+func (u *Unwinder) Forget() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.procs = map[uint32][]mapping{}
+}
+
+// readMappings reads the executable mappings of the process with the tables of their
+// binaries, looked up in the root of the process, e.g. in its container
+func (u *Unwinder) readMappings(pid uint32) []mapping {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		log.Printf("Failed to read the mappings of %d: %v", pid, err)
+		return nil
+	}
+	defer f.Close()
+	mappings, err := symbol.ExecMappingsIn(f)
+	if err != nil {
+		log.Printf("Failed to read the mappings of %d: %v", pid, err)
+		return nil
+	}
+	var maps []mapping
+	for _, m := range mappings {
+		path := filepath.Join(fmt.Sprintf("/proc/%d/root", pid), m.Path)
+		maps = append(maps, mapping{Mapping: *m, table: u.table(path)})
+	}
+	return maps
+}
+
+func (u *Unwinder) table(path string) *Table {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	id := binaryId{uint64(st.Dev), st.Ino}
+	if t, ok := u.tables[id]; ok {
+		return t
+	}
+	t, err := ReadTable(path, u.arch)
+	if err != nil {
+		log.Printf("Failed to read the unwind table of %s: %v", path, err)
+	}
+	u.tables[id] = t
+	return t
+}
+
+// unwindStack unwinds the stack with the rows found by lookup. Code without call frame
+// information, e.g. generated at run time, is unwound with the frame pointers.
+func unwindStack(arch Arch, regs Regs, stack []byte, lookup func(pc uint64) (row, bool)) []uint64 {
+	read := func(addr uint64) (uint64, bool) {
+		if addr < regs.SP || addr-regs.SP+8 > uint64(len(stack)) {
+			return 0, false
+		}
+		return bpfmap.NativeEndian.Uint64(stack[addr-regs.SP:]), true
+	}
+
+	pc, sp, fp, lr := regs.IP, regs.SP, regs.FP, regs.LR
+	var frames []uint64
+	for pc != 0 && len(frames) < pprof.MaxStackDepth {
+		frames = append(frames, pc)
+		// Return addresses are right after the call, which may end its function
+		addr := pc
+		if len(frames) > 1 {
+			addr--
+		}
+
+		var cfa, ra uint64
+		var ok bool
+		r, found := lookup(addr)
+		if !found {
+			// The frame record is the caller fp followed by the return address
+			if fp < sp {
+				break
+			}
+			cfa = fp + 16
+			if ra, ok = read(fp + 8); !ok {
+				break
+			}
+			if fp, ok = read(fp); !ok {
+				break
+			}
+		} else {
+			switch r.cfaReg {
+			case arch.SP:
+				cfa = sp + uint64(r.cfaOffset)
+			case arch.FP:
+				cfa = fp + uint64(r.cfaOffset)
+			default:
+				return frames
+			}
+			switch {
+			case r.ra.kind == atOffset:
+				if ra, ok = read(cfa + uint64(r.ra.offset)); !ok {
+					return frames
+				}
+			case r.ra.kind == sameValue && arch.HasLR && len(frames) == 1:
+				ra = lr
+			default:
+				// The outermost frame, or a return address which can't be found
+				return frames
+			}
+			if r.fp.kind == atOffset {
+				if fp, ok = read(cfa + uint64(r.fp.offset)); !ok {
+					return frames
+				}
+			}
+		}
+		// The stack grows down, callers have their frames above
+		if cfa < sp || (cfa == sp && len(frames) > 1) {
+			break
+		}
+		pc, sp, lr = ra, cfa, 0
+	}
+	return frames
+}
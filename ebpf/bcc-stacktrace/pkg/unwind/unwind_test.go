@@ -0,0 +1,258 @@
+package unwind
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+)
+
+// ehFrame builds an .eh_frame at addr, with a CIE and an FDE per function, their
+// addresses being pc relative like the ones gcc emits
+type ehFrame struct {
+	buf  bytes.Buffer
+	addr uint64
+	cie  int
+}
+
+// entry appends an entry, whose id or CIE pointer is given its offset
+func (e *ehFrame) entry(id func(off int) uint32, body []byte) {
+	// Entries are aligned on the size of the addresses
+	for (4+4+len(body))%8 != 0 {
+		body = append(body, 0)
+	}
+	off := e.buf.Len()
+	binary.Write(&e.buf, binary.LittleEndian, uint32(4+len(body)))
+	binary.Write(&e.buf, binary.LittleEndian, id(off+4))
+	e.buf.Write(body)
+}
+
+func (e *ehFrame) addCIE(codeAlign, dataAlign, raReg byte, initial ...byte) {
+	e.cie = e.buf.Len()
+	body := []byte{1, 'z', 'R', 0, codeAlign, dataAlign, raReg, 1, 0x1b}
+	e.entry(func(int) uint32 { return 0 }, append(body, initial...))
+}
+
+func (e *ehFrame) addFDE(start, length uint64, instructions ...byte) {
+	// The start is relative to itself, right after the length and the CIE pointer
+	field := e.addr + uint64(e.buf.Len()) + 8
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, int32(start-field))
+	binary.Write(&body, binary.LittleEndian, uint32(length))
+	body.WriteByte(0)
+	body.Write(instructions)
+	e.entry(func(off int) uint32 { return uint32(off - e.cie) }, body.Bytes())
+}
+
+func (e *ehFrame) table(t *testing.T, arch Arch) *Table {
+	p := &parser{data: e.buf.Bytes(), addr: e.addr, eh: true, arch: arch, order: binary.LittleEndian, addrSize: 8}
+	rows, err := p.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Table{rows: rows}
+}
+
+// stackAt is a copy of the stack from sp, with the words at the addresses given
+func stackAt(sp uint64, size int, words map[uint64]uint64) []byte {
+	stack := make([]byte, size)
+	for addr, w := range words {
+		bpfmap.NativeEndian.PutUint64(stack[addr-sp:], w)
+	}
+	return stack
+}
+
+func TestUnwindAMD64(t *testing.T) {
+	e := &ehFrame{addr: 0x2000}
+	// CFA is rsp+8 and the return address right below it on entry
+	e.addCIE(1, 0x78, 16, 0x0c, 7, 8, 0x90, 1)
+	// a: sub $0x28,%rsp
+	e.addFDE(0x1000, 0x40, 0x44, 0x0e, 0x30, 0x70, 0x0e, 0x08)
+	// b: push %rbp; mov %rsp,%rbp
+	e.addFDE(0x1040, 0x40, 0x41, 0x0e, 0x10, 0x86, 0x02, 0x43, 0x0d, 0x06)
+	// c: sub $0x18,%rsp
+	e.addFDE(0x1080, 0x40, 0x44, 0x0e, 0x20)
+	// _start: the return address is undefined
+	e.addFDE(0x10c0, 0x40, 0x07, 0x10)
+	table := e.table(t, AMD64)
+
+	regs := Regs{IP: 0x1010, SP: 0x7000, FP: 0x7040}
+	stack := stackAt(regs.SP, 0x100, map[uint64]uint64{
+		// a, whose CFA is 0x7030
+		0x7028: 0x1050,
+		// b, whose CFA is rbp+16
+		0x7040: 0xdead,
+		0x7048: 0x1090,
+		// c, whose CFA is 0x7070
+		0x7068: 0x10c8,
+	})
+	want := []uint64{0x1010, 0x1050, 0x1090, 0x10c8}
+	if got := unwindStack(AMD64, regs, stack, table.lookup); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+
+	// Frames beyond the copy of the stack are not known
+	if got := unwindStack(AMD64, regs, stack[:0x40], table.lookup); !reflect.DeepEqual(got, want[:2]) {
+		t.Errorf("got %x with the stack truncated, want %x", got, want[:2])
+	}
+}
+
+func TestUnwindARM64(t *testing.T) {
+	e := &ehFrame{addr: 0x3000}
+	// CFA is sp on entry, the return address being in lr
+	e.addCIE(4, 0x78, 30, 0x0c, 31, 0)
+	// leaf: no frame
+	e.addFDE(0x2000, 0x20)
+	// n: stp x29, x30, [sp, #-32]!
+	e.addFDE(0x2100, 0x40, 0x41, 0x0e, 0x20, 0x9d, 0x04, 0x9e, 0x03)
+	// m: str x30, [sp, #-16]!
+	e.addFDE(0x2200, 0x40, 0x41, 0x0e, 0x10, 0x9e, 0x02)
+	table := e.table(t, ARM64)
+
+	regs := Regs{IP: 0x2008, SP: 0x8000, FP: 0x8000, LR: 0x2110}
+	stack := stackAt(regs.SP, 0x100, map[uint64]uint64{
+		// n, whose CFA is 0x8020
+		0x8000: 0x8040,
+		0x8008: 0x2210,
+		// m, whose CFA is 0x8030, called from nowhere
+		0x8020: 0,
+	})
+	want := []uint64{0x2008, 0x2110, 0x2210}
+	if got := unwindStack(ARM64, regs, stack, table.lookup); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestUnwindFramePointers(t *testing.T) {
+	regs := Regs{IP: 0x1010, SP: 0x7000, FP: 0x7010}
+	stack := stackAt(regs.SP, 0x100, map[uint64]uint64{
+		0x7010: 0x7040,
+		0x7018: 0x1050,
+		0x7040: 0,
+		0x7048: 0x1090,
+	})
+	noCFI := func(uint64) (row, bool) { return row{}, false }
+	want := []uint64{0x1010, 0x1050, 0x1090}
+	if got := unwindStack(AMD64, regs, stack, noCFI); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+// prog copies the top of its stack from deep calls, compiled without frame pointers
+const prog = `#include <stdio.h>
+#include <stdint.h>
+#include <string.h>
+
+#define STACK 1024
+static unsigned char copy[STACK];
+
+__attribute__((noinline, noclone)) int leaf(int n)
+{
+	uint64_t ip, sp;
+	int i;
+
+	__asm__ volatile("lea 0(%%rip), %0\n\tmov %%rsp, %1" : "=r"(ip), "=r"(sp));
+	memcpy(copy, (void *)sp, STACK);
+	printf("%lx %lx ", ip, sp);
+	for (i = 0; i < STACK; i++)
+		printf("%02x", copy[i]);
+	printf("\n");
+	return n + 1;
+}
+
+__attribute__((noinline, noclone)) int middle(int n)
+{
+	volatile char buf[64];
+
+	buf[0] = n;
+	return leaf(buf[0]) * 2;
+}
+
+__attribute__((noinline, noclone)) int outer(int n)
+{
+	volatile char buf[128];
+
+	buf[0] = n;
+	return middle(buf[0]) + 3;
+}
+
+int main(void)
+{
+	return outer(1) == 0;
+}
+`
+
+func TestUnwindBinary(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("the test program is written for amd64")
+	}
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	dir := t.TempDir()
+	src, exe := filepath.Join(dir, "prog.c"), filepath.Join(dir, "prog")
+	if err := os.WriteFile(src, []byte(prog), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Not position independent, addresses in the binary are the ones at run time
+	out, err := exec.Command(cc, "-O2", "-fomit-frame-pointer", "-no-pie", "-o", exe, src).CombinedOutput()
+	if err != nil {
+		t.Fatalf("compiling: %v\n%s", err, out)
+	}
+	out, err = exec.Command(exe).Output()
+	if err != nil {
+		t.Fatalf("running: %v", err)
+	}
+	var regs Regs
+	var dump string
+	if _, err := fmt.Sscanf(string(out), "%x %x %s", &regs.IP, &regs.SP, &dump); err != nil {
+		t.Fatalf("parsing %q: %v", out, err)
+	}
+	stack, err := hex.DecodeString(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := ReadTable(exe, AMD64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	syms, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := func(pc uint64) string {
+		for _, s := range syms {
+			if elf.ST_TYPE(s.Info) == elf.STT_FUNC && pc >= s.Value && pc < s.Value+s.Size {
+				return s.Name
+			}
+		}
+		return fmt.Sprintf("0x%x", pc)
+	}
+
+	// The frame pointer is not used, the frames above main are in libc
+	frames := unwindStack(AMD64, regs, stack, table.lookup)
+	var got []string
+	for _, pc := range frames {
+		got = append(got, name(pc))
+	}
+	if want := "leaf;middle;outer;main"; len(got) < 4 || strings.Join(got[:4], ";") != want {
+		t.Errorf("unwound %v, want %s first", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/google/pprof/profile"
+)
+
+// Queue uploads profiles in the background, in the order they are queued, so that a slow
+// or unreachable server never holds up the profiling
+type Queue struct {
+	u        *Uploader
+	profiles chan *profile.Profile
+	done     chan struct{}
+	// failed is called with the error of every profile which could not be uploaded
+	failed func(error)
+	// ctx is canceled when Close gives up waiting, the profile being uploaded failing and
+	// the ones still queued being spooled
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	failures int
+	spooled  int
+}
+
+// NewQueue uploads the profiles queued with u, at most size of them waiting for the one
+// being uploaded. Profiles queued beyond are spooled right away, or dropped when u has no
+// spool directory.
+func NewQueue(u *Uploader, size int, failed func(error)) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		u:        u,
+		profiles: make(chan *profile.Profile, size),
+		done:     make(chan struct{}),
+		failed:   failed,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go q.run()
+	return q
+}
+
+// Put queues the profile to be uploaded. It fails if the queue is full and the profile
+// could not be spooled instead, the profile being dropped.
+func (q *Queue) Put(p *profile.Profile) error {
+	select {
+	case q.profiles <- p:
+		return nil
+	default:
+	}
+	if err := q.u.spoolProfile(p); err != nil {
+		return fmt.Errorf("upload queue full, dropping profile: %w", err)
+	}
+	return nil
+}
+
+// Close waits for the profiles queued to be uploaded, until ctx is done. The upload in
+// progress is then canceled and the profiles still queued are spooled for the next run
+// instead. It fails if any of the profiles queued could not be uploaded nor spooled.
+func (q *Queue) Close(ctx context.Context) error {
+	close(q.profiles)
+	select {
+	case <-q.done:
+	case <-ctx.Done():
+		q.cancel()
+		<-q.done
+	}
+	q.cancel()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.spooled > 0 {
+		log.Printf("%d profiles left to upload were spooled", q.spooled)
+	}
+	if q.failures > 0 {
+		return fmt.Errorf("%d profiles could not be uploaded", q.failures)
+	}
+	return nil
+}
+
+func (q *Queue) run() {
+	defer close(q.done)
+	for p := range q.profiles {
+		var err error
+		if q.ctx.Err() != nil {
+			if err = q.u.spoolProfile(p); err == nil {
+				q.mu.Lock()
+				q.spooled++
+				q.mu.Unlock()
+				continue
+			}
+			err = fmt.Errorf("shutting down, dropping profile: %w", err)
+		} else if err = q.u.Upload(q.ctx, p); err == nil {
+			continue
+		}
+		q.mu.Lock()
+		q.failures++
+		q.mu.Unlock()
+		if q.failed != nil {
+			q.failed(err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package upload
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spoolSuffix = ".pb.gz"
+
+// spool keeps the profiles that failed to upload on disk. Each file is named
+// <start unix nanos>-<duration nanos>.pb.gz so that no extra metadata is needed.
+// Profiles are spooled and drained concurrently, e.g. when the upload queue is full.
+type spool struct {
+	dir      string
+	maxBytes int64
+
+	// mu guards the files of dir
+	mu sync.Mutex
+}
+
+type spoolEntry struct {
+	path     string
+	start    time.Time
+	duration time.Duration
+	size     int64
+}
+
+func newSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating spool directory: %w", err)
+	}
+	return &spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+	}, nil
+}
+
+func (s *spool) put(data []byte, start time.Time, duration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxBytes > 0 && int64(len(data)) > s.maxBytes {
+		return fmt.Errorf("profile of %d bytes does not fit in the spool", len(data))
+	}
+	name := fmt.Sprintf("%d-%d%s", start.UnixNano(), duration.Nanoseconds(), spoolSuffix)
+	// Write to a temporary file first so that a crash never leaves a partial profile behind
+	tmp := filepath.Join(s.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("writing spooled profile: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return fmt.Errorf("writing spooled profile: %w", err)
+	}
+	return s.trim()
+}
+
+// trim drops the oldest profiles until the spool fits in maxBytes
+func (s *spool) trim() error {
+	if s.maxBytes <= 0 {
+		return nil
+	}
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	for _, e := range entries {
+		if total <= s.maxBytes {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			return fmt.Errorf("removing spooled profile: %w", err)
+		}
+		total -= e.size
+	}
+	return nil
+}
+
+// list returns the spooled profiles, oldest first
+func (s *spool) list() ([]spoolEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries()
+}
+
+// read returns the spooled profile, or nil if it was dropped since it was listed
+func (s *spool) read(e spoolEntry) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := ioutil.ReadFile(e.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading spooled profile: %w", err)
+	}
+	return data, nil
+}
+
+// remove drops the spooled profile, if it was not already
+func (s *spool) remove(e spoolEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(e.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing spooled profile: %w", err)
+	}
+	return nil
+}
+
+func (s *spool) entries() ([]spoolEntry, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading spool directory: %w", err)
+	}
+	var entries []spoolEntry
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, spoolSuffix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSuffix(name, spoolSuffix), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		start, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		duration, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, spoolEntry{
+			path:     filepath.Join(s.dir, name),
+			start:    time.Unix(0, start),
+			duration: time.Duration(duration),
+			size:     f.Size(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].start.Before(entries[j].start) })
+	return entries, nil
+}
@@ -0,0 +1,241 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+type Config struct {
+	// URL of the ingestion server, e.g. http://pyroscope:4040. Profiles are pushed to <URL>/ingest
+	URL string
+	// AppName is the name the profiles are stored under
+	AppName string
+	// Labels are attached to every uploaded profile, on top of the host label
+	Labels map[string]string
+	// MaxRetries is how many times a failed upload is retried before it is spooled
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubled on every following retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// SpoolDir keeps the profiles that could not be uploaded until the server is back. No spooling if empty
+	SpoolDir string
+	// SpoolMaxBytes bounds the size of SpoolDir, the oldest profiles are dropped first
+	SpoolMaxBytes int64
+	Client        *http.Client
+}
+
+// Uploader pushes profiles to a Pyroscope compatible /ingest endpoint
+type Uploader struct {
+	cfg   Config
+	name  string
+	spool *spool
+}
+
+func NewUploader(cfg Config) (*Uploader, error) {
+	parsed, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upload url: %w", err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("upload url %q is not an http or https url with a host, e.g. http://pyroscope:4040", cfg.URL)
+	}
+	if cfg.AppName == "" {
+		return nil, fmt.Errorf("app name is required")
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		cfg.MaxBackoff = cfg.Backoff
+	}
+	labels := map[string]string{}
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	if _, ok := labels["host"]; !ok {
+		host, err := os.Hostname()
+		if err == nil {
+			labels["host"] = host
+		}
+	}
+	cfg.Labels = labels
+
+	u := &Uploader{
+		cfg:  cfg,
+		name: appName(cfg.AppName, labels),
+	}
+	if cfg.SpoolDir != "" {
+		s, err := newSpool(cfg.SpoolDir, cfg.SpoolMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		u.spool = s
+	}
+	return u, nil
+}
+
+// Upload pushes the profile, retrying with backoff. Profiles that still fail are spooled
+// to disk, and profiles spooled earlier are pushed once the server accepts uploads again.
+// It only fails if the profile itself could not be pushed.
+func (u *Uploader) Upload(ctx context.Context, p *profile.Profile) error {
+	data, err := encode(p)
+	if err != nil {
+		return err
+	}
+	start := time.Unix(0, p.TimeNanos)
+	duration := time.Duration(p.DurationNanos)
+
+	err = u.pushWithRetry(ctx, data, start, duration)
+	if err != nil {
+		if u.spool != nil {
+			if serr := u.spool.put(data, start, duration); serr != nil {
+				return fmt.Errorf("%v, and spooling failed: %w", err, serr)
+			}
+		}
+		return err
+	}
+
+	if u.spool != nil {
+		// They are pushed again after the next upload
+		if err := u.drainSpool(ctx); err != nil {
+			log.Printf("Failed to upload the spooled profiles: %v", err)
+		}
+	}
+	return nil
+}
+
+// spoolProfile spools the profile without trying to upload it
+func (u *Uploader) spoolProfile(p *profile.Profile) error {
+	if u.spool == nil {
+		return fmt.Errorf("no spool directory")
+	}
+	data, err := encode(p)
+	if err != nil {
+		return err
+	}
+	return u.spool.put(data, time.Unix(0, p.TimeNanos), time.Duration(p.DurationNanos))
+}
+
+func encode(p *profile.Profile) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return nil, fmt.Errorf("encoding profile: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// drainSpool pushes the spooled profiles, oldest first, stopping at the first failure
+func (u *Uploader) drainSpool(ctx context.Context) error {
+	entries, err := u.spool.list()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		data, err := u.spool.read(e)
+		if err != nil {
+			return err
+		}
+		// Trimmed while the ones before were pushed
+		if data == nil {
+			continue
+		}
+		if err := u.push(ctx, data, e.start, e.duration); err != nil {
+			return fmt.Errorf("uploading spooled profile: %w", err)
+		}
+		if err := u.spool.remove(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *Uploader) pushWithRetry(ctx context.Context, data []byte, start time.Time, duration time.Duration) error {
+	backoff := u.cfg.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = u.push(ctx, data, start, duration)
+		if err == nil || attempt >= u.cfg.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > u.cfg.MaxBackoff {
+			backoff = u.cfg.MaxBackoff
+		}
+	}
+}
+
+func (u *Uploader) push(ctx context.Context, data []byte, start time.Time, duration time.Duration) error {
+	q := url.Values{}
+	q.Set("name", u.name)
+	q.Set("from", strconv.FormatInt(start.Unix(), 10))
+	q.Set("until", strconv.FormatInt(start.Add(duration).Unix(), 10))
+	q.Set("format", "pprof")
+	q.Set("spyName", "ebpfspy")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(u.cfg.URL, "/")+"/ingest?"+q.Encode(), bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := u.cfg.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("uploading profile: %w", err)
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("uploading profile: server returned %s", resp.Status)
+	}
+	return nil
+}
+
+// appName formats the name and labels like app{k1=v1,k2=v2}, with the labels sorted by key
+func appName(name string, labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+labels[k])
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// ParseLabels parses labels given as k1=v1,k2=v2
+func ParseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	if s == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("malformed label %q, expecting key=value", pair)
+		}
+		labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return labels, nil
+}
@@ -0,0 +1,335 @@
+package upload
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// ingestServer is a stand-in for the /ingest endpoint of a profile store
+type ingestServer struct {
+	mu       sync.Mutex
+	down     bool
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func (s *ingestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	s.received = append(s.received, r)
+	s.bodies = append(s.bodies, body)
+}
+
+func (s *ingestServer) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func testProfile(start time.Time) *profile.Profile {
+	f := &profile.Function{ID: 1, Name: "main.main"}
+	l := &profile.Location{ID: 1, Address: 0x1000, Line: []profile.Line{{Function: f}}}
+	return &profile.Profile{
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        10000000,
+		SampleType:    []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample:        []*profile.Sample{{Location: []*profile.Location{l}, Value: []int64{3}}},
+		Location:      []*profile.Location{l},
+		Function:      []*profile.Function{f},
+		TimeNanos:     start.UnixNano(),
+		DurationNanos: (10 * time.Second).Nanoseconds(),
+	}
+}
+
+func TestUpload(t *testing.T) {
+	srv := &ingestServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	u, err := NewUploader(Config{
+		URL:     ts.URL,
+		AppName: "bcc-stacktrace",
+		Labels:  map[string]string{"service": "api", "host": "node-1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1650000000, 0)
+	if err := u.Upload(context.Background(), testProfile(start)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(srv.received) != 1 {
+		t.Fatalf("expected 1 upload, got %d", len(srv.received))
+	}
+	q := srv.received[0].URL.Query()
+	if got, want := q.Get("name"), "bcc-stacktrace{host=node-1,service=api}"; got != want {
+		t.Errorf("name = %q, want %q", got, want)
+	}
+	if got, want := q.Get("from"), "1650000000"; got != want {
+		t.Errorf("from = %q, want %q", got, want)
+	}
+	if got, want := q.Get("until"), "1650000010"; got != want {
+		t.Errorf("until = %q, want %q", got, want)
+	}
+	if got, want := q.Get("format"), "pprof"; got != want {
+		t.Errorf("format = %q, want %q", got, want)
+	}
+	p, err := profile.ParseData(srv.bodies[0])
+	if err != nil {
+		t.Fatalf("parsing uploaded profile: %v", err)
+	}
+	if len(p.Sample) != 1 || p.Sample[0].Value[0] != 3 {
+		t.Errorf("unexpected uploaded samples: %v", p.Sample)
+	}
+}
+
+func TestNewUploaderURL(t *testing.T) {
+	for _, url := range []string{"pyroscope:4040", "localhost", "/ingest", "ftp://pyroscope", "http://", "http://[::1"} {
+		if _, err := NewUploader(Config{URL: url, AppName: "bcc-stacktrace"}); err == nil {
+			t.Errorf("url %q accepted", url)
+		}
+	}
+	for _, url := range []string{"http://pyroscope:4040", "https://profiles.example.com/base"} {
+		if _, err := NewUploader(Config{URL: url, AppName: "bcc-stacktrace"}); err != nil {
+			t.Errorf("url %q: %v", url, err)
+		}
+	}
+}
+
+func TestUploadSpool(t *testing.T) {
+	srv := &ingestServer{down: true}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	u, err := NewUploader(Config{
+		URL:        ts.URL,
+		AppName:    "bcc-stacktrace",
+		MaxRetries: 2,
+		Backoff:    time.Millisecond,
+		SpoolDir:   dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Unix(1650000000, 0)
+	for i := 0; i < 2; i++ {
+		err := u.Upload(context.Background(), testProfile(start.Add(time.Duration(i)*10*time.Second)))
+		if err == nil {
+			t.Fatal("expected upload to fail while the server is down")
+		}
+	}
+	entries, err := u.spool.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 spooled profiles, got %d", len(entries))
+	}
+
+	srv.setDown(false)
+	if err := u.Upload(context.Background(), testProfile(start.Add(20*time.Second))); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.received) != 3 {
+		t.Fatalf("expected 3 uploads, got %d", len(srv.received))
+	}
+	// The spooled profiles are pushed oldest first, after the current one
+	for i, want := range []string{"1650000020", "1650000000", "1650000010"} {
+		if got := srv.received[i].URL.Query().Get("from"); got != want {
+			t.Errorf("upload %d: from = %q, want %q", i, got, want)
+		}
+	}
+	entries, err = u.spool.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the spool to be drained, got %d profiles", len(entries))
+	}
+}
+
+func TestUploadSpoolFailure(t *testing.T) {
+	// The server rejects the profile spooled earlier, but not the current one
+	srv := &ingestServer{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("from") == "1650000000" {
+			http.Error(w, "bad profile", http.StatusBadRequest)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	u, err := NewUploader(Config{
+		URL:      ts.URL,
+		AppName:  "bcc-stacktrace",
+		SpoolDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1650000000, 0)
+	if err := u.spoolProfile(testProfile(start)); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Upload(context.Background(), testProfile(start.Add(10*time.Second))); err != nil {
+		t.Fatalf("expected the pushed profile to succeed, got %v", err)
+	}
+	entries, err := u.spool.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected the spooled profile to be kept, got %d profiles", len(entries))
+	}
+}
+
+func TestSpoolBounded(t *testing.T) {
+	s, err := newSpool(t.TempDir(), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1650000000, 0)
+	for i := 0; i < 3; i++ {
+		if err := s.put(make([]byte, 10), start.Add(time.Duration(i)*time.Second), time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := s.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 spooled profiles, got %d", len(entries))
+	}
+	if !entries[0].start.Equal(start.Add(time.Second)) {
+		t.Errorf("expected the oldest profile to be dropped, oldest left is %v", entries[0].start)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	// The server hangs until released
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	srv := &ingestServer{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		srv.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	u, err := NewUploader(Config{
+		URL:      ts.URL,
+		AppName:  "bcc-stacktrace",
+		SpoolDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQueue(u, 1, func(err error) { t.Errorf("upload failed: %v", err) })
+
+	start := time.Unix(1650000000, 0)
+	if err := q.Put(testProfile(start)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// One profile waits for the one being uploaded, the next one is spooled
+	for i := 1; i < 3; i++ {
+		if err := q.Put(testProfile(start.Add(time.Duration(i) * 10 * time.Second))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := u.spool.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].start.Equal(start.Add(20*time.Second)) {
+		t.Fatalf("expected the last profile to be spooled, got %v", entries)
+	}
+
+	close(release)
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(srv.received) != 3 {
+		t.Fatalf("expected 3 uploads, got %d", len(srv.received))
+	}
+	// The spooled profile is pushed once the server accepts uploads again
+	for i, want := range []string{"1650000000", "1650000020", "1650000010"} {
+		if got := srv.received[i].URL.Query().Get("from"); got != want {
+			t.Errorf("upload %d: from = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestQueueCloseTimeout(t *testing.T) {
+	// The server does not answer until the test is over
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	u, err := NewUploader(Config{
+		URL:        ts.URL,
+		AppName:    "bcc-stacktrace",
+		MaxRetries: 3,
+		Backoff:    time.Minute,
+		SpoolDir:   t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failures int
+	q := NewQueue(u, 2, func(err error) { failures++ })
+
+	start := time.Unix(1650000000, 0)
+	for i := 0; i < 3; i++ {
+		if err := q.Put(testProfile(start.Add(time.Duration(i) * 10 * time.Second))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			<-started
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	begin := time.Now()
+	if err := q.Close(ctx); err == nil {
+		t.Error("expected the canceled upload to fail")
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Errorf("Close took %v past its deadline", elapsed)
+	}
+	if failures != 1 {
+		t.Errorf("expected only the canceled upload to fail, got %d failures", failures)
+	}
+	// The profile being uploaded and the ones queued are all spooled
+	entries, err := u.spool.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Errorf("expected 3 spooled profiles, got %d", len(entries))
+	}
+}
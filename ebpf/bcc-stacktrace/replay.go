@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/output"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/replay"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/upload"
+)
+
+// recorder records the raw maps drained from the tables every interval
+type recorder struct {
+	tables *bpfTables
+	f      *os.File
+	w      *replay.Writer
+	start  time.Time
+	// Entries drained in the current interval, written along with its errors
+	snapshot *replay.Snapshot
+	pids     map[uint32]bool
+}
+
+// newRecorder starts a recording to the file of the profiles of the types, drained from
+// the tables
+func newRecorder(path string, types pprof.ValueTypes, tables *bpfTables) (*recorder, error) {
+	kallsyms, err := ioutil.ReadFile("/proc/kallsyms")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := replay.NewWriter(f, &replay.Header{Types: types, Kallsyms: string(kallsyms), ByteOrder: bpfmap.NativeEndian.String()})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	tables.record()
+	return &recorder{tables: tables, f: f, w: w, start: time.Now()}, nil
+}
+
+// close ends the recording
+func (r *recorder) close() {
+	if err := r.w.Close(); err != nil {
+		log.Printf("Failed to end the recording: %v", err)
+	}
+	if err := r.f.Close(); err != nil {
+		log.Printf("Failed to close the recording: %v", err)
+	}
+}
+
+func (r *recorder) drain() []pprof.Sample {
+	samples, snapshot := r.tables.drainRecorded()
+	r.snapshot = snapshot
+	r.pids = map[uint32]bool{}
+	for _, s := range samples {
+		r.pids[s.Pid] = true
+	}
+	return samples
+}
+
+// readErrors completes the snapshot of the interval with its errors and writes it, the
+// errors being read after the samples
+func (r *recorder) readErrors() []uint64 {
+	deltas := r.tables.readErrors()
+	snapshot := r.snapshot
+	r.snapshot = nil
+	if snapshot == nil {
+		return deltas
+	}
+
+	now := time.Now()
+	snapshot.Start, snapshot.End = r.start, now
+	r.start = now
+	snapshot.Errors = deltas
+	snapshot.Processes = map[uint32]*replay.Process{}
+	for pid := range r.pids {
+		proc, err := replay.ReadProcess(pid)
+		if err != nil {
+			log.Printf("Failed to record process %d: %v", pid, err)
+			continue
+		}
+		snapshot.Processes[pid] = proc
+	}
+	if err := r.w.Write(snapshot); err != nil {
+		log.Printf("Failed to record the interval: %v", err)
+	}
+	return deltas
+}
+
+// replayed is the source of a recorded interval
+type replayed struct {
+	reader   *replay.Reader
+	snapshot *replay.Snapshot
+}
+
+func (r replayed) drain() []pprof.Sample {
+	return r.reader.Samples(r.snapshot)
+}
+
+func (r replayed) readErrors() []uint64 {
+	// Recordings of other versions may count other errors
+	deltas := make([]uint64, len(errorNames))
+	copy(deltas, r.snapshot.Errors)
+	return deltas
+}
+
+// replayMain profiles the intervals of a recording, as they were profiled when recorded.
+// The binaries of the recorded processes are looked up under root.
+func replayMain(path, root string, writer *output.Writer, uploads *upload.Queue) int {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("Failed to open the recording: %v", err)
+		return 1
+	}
+	defer f.Close()
+	r, err := replay.NewReader(f)
+	if err != nil {
+		log.Printf("Failed to replay %s: %v", path, err)
+		return 1
+	}
+
+	failed := 0
+	for {
+		snapshot, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Failed to replay %s: %v", path, err)
+			return 1
+		}
+		if !flush(snapshot.Start, snapshot.End, r.Header.Types, replayed{r, snapshot}, r.Symbolizer(snapshot, root), writer, uploads) {
+			failed++
+		}
+	}
+	status := 0
+	if failed > 0 {
+		log.Printf("%d intervals could not be written or uploaded", failed)
+		status = 1
+	}
+	if err := closeUploads(uploads); err != nil {
+		log.Printf("%v", err)
+		status = 1
+	}
+	return status
+}
@@ -0,0 +1,281 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/output"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/target"
+)
+
+// sampler attaches the perf events while at least one profile request is in flight.
+// Concurrent requests share the attached programs, each one gets the samples taken
+// while it was subscribed.
+type sampler struct {
+	attach func() error
+	detach func()
+	drain  func() []pprof.Sample
+	// targets makes the bpf program record the processes and cgroups the requests are
+	// for, or all processes. Nil when the targets are selected on the command line.
+	targets func(all bool, pids map[uint32]bool, cgroups map[uint64]bool) error
+
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+	stop chan struct{}
+}
+
+type subscription struct {
+	filter  *targetFilter
+	samples []pprof.Sample
+}
+
+// targetFilter keeps the samples of a pid, or of the processes in a cgroup or in its
+// descendants, the cgroups being looked for again every dispatch
+type targetFilter struct {
+	sel     *target.Selector
+	pids    map[uint32]bool
+	cgroups map[uint64]bool
+}
+
+func newSampler(attach func() error, detach func(), drain func() []pprof.Sample, targets func(bool, map[uint32]bool, map[uint64]bool) error) *sampler {
+	return &sampler{
+		attach:  attach,
+		detach:  detach,
+		drain:   drain,
+		targets: targets,
+		subs:    map[*subscription]struct{}{},
+	}
+}
+
+func (s *sampler) subscribe(filter *targetFilter) (*subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The samples taken so far go to the subscribers before, not to the new one
+	s.dispatch()
+	sub := &subscription{filter: filter}
+	s.subs[sub] = struct{}{}
+	// The targets of a failed subscription are dropped from the maps
+	fail := func(err error) (*subscription, error) {
+		delete(s.subs, sub)
+		if rerr := s.retarget(); rerr != nil {
+			log.Printf("Failed to update targets: %v", rerr)
+		}
+		return nil, err
+	}
+	if err := s.retarget(); err != nil {
+		return fail(err)
+	}
+	if len(s.subs) == 1 {
+		if err := s.attach(); err != nil {
+			s.detach()
+			return fail(err)
+		}
+		s.stop = make(chan struct{})
+		go s.run(s.stop)
+	}
+	return sub, nil
+}
+
+// unsubscribe returns the samples taken since the subscription, detaching the perf
+// events if nobody else is listening
+func (s *sampler) unsubscribe(sub *subscription) []pprof.Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dispatch()
+	delete(s.subs, sub)
+	if len(s.subs) == 0 {
+		close(s.stop)
+		s.detach()
+		// Drop whatever landed in the maps in between
+		s.drain()
+	}
+	if err := s.retarget(); err != nil {
+		log.Printf("Failed to update targets: %v", err)
+	}
+	return sub.samples
+}
+
+// run drains the maps every second so they do not fill up during long requests
+func (s *sampler) run(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.dispatch()
+			// Cgroups may have been created under the ones requested
+			if err := s.retarget(); err != nil {
+				log.Printf("Failed to update targets: %v", err)
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// retarget has the bpf program record what the subscribers want. Must be called with mu held.
+func (s *sampler) retarget() error {
+	all := false
+	pids := map[uint32]bool{}
+	cgroups := map[uint64]bool{}
+	for sub := range s.subs {
+		f := sub.filter
+		// The targets found last are kept, e.g. when the cgroup was removed
+		if err := f.discover(); err != nil {
+			log.Printf("Failed to look for the targets of a profile: %v", err)
+		}
+		all = all || f.sel.All()
+		for pid := range f.pids {
+			pids[pid] = true
+		}
+		for id := range f.cgroups {
+			cgroups[id] = true
+		}
+	}
+	if s.targets == nil {
+		return nil
+	}
+	return s.targets(all, pids, cgroups)
+}
+
+// dispatch hands out the samples in the maps to the subscribers. Must be called with mu held.
+func (s *sampler) dispatch() {
+	samples := s.drain()
+	if len(samples) == 0 {
+		return
+	}
+	for sub := range s.subs {
+		for _, sample := range samples {
+			if sub.filter.match(sample) {
+				sub.samples = append(sub.samples, sample)
+			}
+		}
+	}
+}
+
+// newTargetFilter keeps the samples of the pid and of the cgroup directory, either being
+// possibly empty. Both empty keeps all samples.
+func newTargetFilter(pid, cgroupDir string) (*targetFilter, error) {
+	sel, err := target.NewSelector(pid, cgroupDir, "", "")
+	if err != nil {
+		return nil, err
+	}
+	f := &targetFilter{sel: sel}
+	return f, f.discover()
+}
+
+func (f *targetFilter) discover() error {
+	if f.sel.All() {
+		return nil
+	}
+	pids, cgroups, err := f.sel.Discover()
+	if err != nil {
+		return err
+	}
+	f.pids, f.cgroups = pids, cgroups
+	return nil
+}
+
+// match tells whether the sample was taken in the process or in one of the cgroups
+func (f *targetFilter) match(sample pprof.Sample) bool {
+	return f.sel.All() || f.pids[sample.Pid] || f.cgroups[sample.CgroupId]
+}
+
+// profileHandler serves /debug/pprof/profile?seconds=N&pid=P&cgroup=DIR, the same way
+// net/http/pprof does for the Go process it runs in. cgroup=DIR profiles the processes in
+// the cgroup or in its descendants, including the ones started during the request.
+// format=folded or format=svg returns collapsed stacks or a flame graph instead of a pprof
+// profile, format=trace a timeline of the samples when they are streamed.
+func profileHandler(s *sampler, types pprof.ValueTypes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		seconds := 30
+		if v := r.FormValue("seconds"); v != "" {
+			sec, err := strconv.Atoi(v)
+			if err != nil || sec <= 0 {
+				http.Error(w, fmt.Sprintf("invalid seconds %q", v), http.StatusBadRequest)
+				return
+			}
+			seconds = sec
+		}
+		pid := r.FormValue("pid")
+		if pid != "" {
+			if v, err := strconv.Atoi(pid); err != nil || v < 0 {
+				http.Error(w, fmt.Sprintf("invalid pid %q", pid), http.StatusBadRequest)
+				return
+			}
+		}
+		format := output.Pprof
+		if v := r.FormValue("format"); v != "" {
+			formats, err := output.ParseFormats(v)
+			if err != nil || len(formats) != 1 {
+				http.Error(w, fmt.Sprintf("invalid format %q", v), http.StatusBadRequest)
+				return
+			}
+			format = formats[0]
+		}
+		// The cgroup is one directory, not a list
+		cgroupDir := r.FormValue("cgroup")
+		if strings.Contains(cgroupDir, ",") {
+			http.Error(w, fmt.Sprintf("invalid cgroup %q", cgroupDir), http.StatusBadRequest)
+			return
+		}
+		filter, err := newTargetFilter(pid, cgroupDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sub, err := s.subscribe(filter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not enable profiling: %v", err), http.StatusInternalServerError)
+			return
+		}
+		start := time.Now()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Duration(seconds) * time.Second):
+		}
+		samples := s.unsubscribe(sub)
+		if r.Context().Err() != nil {
+			return
+		}
+
+		profiles := pprof.BuildProfiles(samples, start, time.Since(start), types, hostSymbols)
+		if len(profiles) == 0 {
+			http.Error(w, "No samples collected", http.StatusNotFound)
+			return
+		}
+		p, err := output.Merge(profiles)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch format {
+		case output.Folded:
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		case output.SVG:
+			w.Header().Set("Content-Type", "image/svg+xml")
+		case output.Trace:
+			w.Header().Set("Content-Type", "application/json")
+		default:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+		}
+		if err := output.Encode(w, format, p, "Flame Graph of "+r.URL.RawQuery); err != nil {
+			log.Printf("Writing profile: %v", err)
+		}
+	}
+}
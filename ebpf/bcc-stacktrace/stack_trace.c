@@ -6,54 +6,499 @@
  * modify it under the terms of version 2 of the GNU General Public
  * License as published by the Free Software Foundation.
  */
+#include <uapi/linux/ptrace.h>
+#include <linux/errno.h>
 #include <uapi/linux/bpf.h>
 #include <uapi/linux/bpf_perf_event.h>
 #include <uapi/linux/perf_event.h>
+#if defined(GOROUTINES) || defined(UNWIND_USER)
+#include <linux/sched.h>
+#endif
 
 #define TASK_COMM_LEN 16
 // Max depth of each stack trace to track
 #define PERF_MAX_STACK_DEPTH 127
+// Number of entries of the counts and stack maps of each set, set with -DMAP_SIZE
+#ifndef MAP_SIZE
+#define MAP_SIZE 10000
+#endif
 
 struct key_t {
   char comm[TASK_COMM_LEN];
   u32 pid;
   int kernstack;
   int userstack;
+  // Cpu the sample was taken on, when compiled with -DRECORD_CPU
+  u32 cpu;
+  // Id of the cgroup v2 of the task, i.e. the inode number of its directory
+  u64 cgroup;
+  // Left to zero: goroutines are only recorded with the streamed samples, a key per
+  // goroutine would split the counts of every stack. Kept for the key to be decoded the
+  // same way as the one of off_cpu.c.
+  u64 goid;
+  u64 labels;
 };
 
-BPF_HASH(counts, struct key_t, u64, 10000);
-BPF_STACK_TRACE(stackmap, 10000);
+// Number of samples of a key, and what they weigh, e.g. the cpu nanoseconds they stand for
+struct value_t {
+  u64 count;
+  u64 weight;
+};
+
+// Samples are recorded in one of two sets of maps, selected by active[0]. User space flips
+// it before each drain, so that it reads and cleans the set no program writes to anymore.
+BPF_HASH(counts_0, struct key_t, struct value_t, MAP_SIZE);
+BPF_STACK_TRACE(stackmap_0, MAP_SIZE);
+BPF_HASH(counts_1, struct key_t, struct value_t, MAP_SIZE);
+BPF_STACK_TRACE(stackmap_1, MAP_SIZE);
+BPF_ARRAY(active, u32, 1);
+// Entries added to the counts map of each set, for user space to drain the active set
+// before the end of the interval when it fills up. The stack maps are not tracked: stacks
+// are stored in the bucket of their hash, and are lost on collisions before the map fills up.
+BPF_ARRAY(occupancy, u64, 2);
+// Programs writing to each set. User space waits for the ones which read active before it
+// flipped it to be done before draining the set, see enter.
+BPF_ARRAY(inflight, u64, 2);
+
+// Only one event out of sampling[0] is recorded when the overhead is capped with
+// -max-overhead, and counted as that many. User space adjusts the ratio.
+BPF_ARRAY(sampling, u32, 1);
+
+// Reasons samples or their stacks are lost, counted per cpu. Keep in sync with
+// errorNames in collect.go.
+enum error_t {
+  ERR_KERN_EEXIST,
+  ERR_KERN_EFAULT,
+  ERR_KERN_ENOMEM,
+  ERR_KERN_OTHER,
+  ERR_USER_EEXIST,
+  ERR_USER_EFAULT,
+  ERR_USER_ENOMEM,
+  ERR_USER_OTHER,
+  ERR_COUNTS_FULL,
+  ERR_EVENTS_LOST,
+  ERR_FLIPPED,
+  ERR_BLOCKED_FULL,
+  NUM_ERRORS,
+};
+BPF_PERCPU_ARRAY(errors, u64, NUM_ERRORS);
 
 #define KERN_STACKID_FLAGS (0 | BPF_F_FAST_STACK_CMP)
 #define USER_STACKID_FLAGS (0 | BPF_F_FAST_STACK_CMP | BPF_F_USER_STACK)
 
+#ifdef FILTER_TARGETS
+// Processes and cgroups to profile, kept up to date by user space
+BPF_HASH(target_pids, u32, u8, 10240);
+BPF_HASH(target_cgroups, u64, u8, 10240);
+// Set to 1 by user space to profile all processes whatever the target maps hold, e.g.
+// while a profile of all processes is served
+BPF_ARRAY(all_targets, u32, 1);
+#endif
+
+// Targets are filtered with -DFILTER_TARGETS, the current task being profiled if its
+// process or its cgroup is in the target maps
+static inline int wanted(u32 tgid)
+{
+#ifdef FILTER_TARGETS
+  int zero = 0;
+  u32 *all = all_targets.lookup(&zero);
+  u64 cgroup;
+
+  if (all && *all)
+    return 1;
+  if (target_pids.lookup(&tgid))
+    return 1;
+  cgroup = bpf_get_current_cgroup_id();
+  if (target_cgroups.lookup(&cgroup))
+    return 1;
+  return 0;
+#else
+  return 1;
+#endif
+}
+
+#ifdef GOROUTINES
+// Where the goroutine id and the labels pointer are in struct g, by Go process. User space
+// reads them from the debug info of the binaries.
+struct go_offsets_t {
+  u64 goid;
+  u64 labels;
+};
+BPF_HASH(go_procs, u32, struct go_offsets_t, 10240);
+#endif
+
+// goroutine reads the id and the labels pointer of the goroutine the current thread runs,
+// leaving them to zero outside of Go processes
+static inline void goroutine(u32 tgid, u64 *goid, u64 *labels)
+{
+#ifdef GOROUTINES
+  struct go_offsets_t *off = go_procs.lookup(&tgid);
+  struct task_struct *task;
+  u64 g = 0;
+
+  if (!off)
+    return;
+  task = (struct task_struct *)bpf_get_current_task();
+#if defined(GO_ARCH_AMD64)
+  // g is in the TLS slot right below the thread pointer, which Go sets with
+  // arch_prctl so that the kernel keeps it in the task
+  u64 fsbase = 0;
+  bpf_probe_read_kernel(&fsbase, sizeof(fsbase), &task->thread.fsbase);
+  if (fsbase)
+    bpf_probe_read_user(&g, sizeof(g), (void *)(fsbase - 8));
+#elif defined(GO_ARCH_ARM64)
+  // g is kept in x28, the user registers being saved on kernel entry
+  struct pt_regs *regs = (struct pt_regs *)bpf_task_pt_regs(task);
+  bpf_probe_read_kernel(&g, sizeof(g), &regs->regs[28]);
+#endif
+  // Threads not running Go code, e.g. created by C libraries
+  if (!g)
+    return;
+  bpf_probe_read_user(goid, sizeof(*goid), (void *)(g + off->goid));
+  bpf_probe_read_user(labels, sizeof(*labels), (void *)(g + off->labels));
+#endif
+}
+
+static inline void occupied(u32 idx)
+{
+  u64 *val = occupancy.lookup(&idx);
+
+  if (val)
+    __sync_fetch_and_add(val, 1);
+}
+
+static inline void count_error(int index)
+{
+  u64 *val = errors.lookup(&index);
+
+  if (val)
+    (*val)++;
+}
+
+// enter_set counts the current program in the set idx, returning 0 if the set is not
+// the active one anymore
+static inline int enter_set(u32 idx)
+{
+  int zero = 0;
+  u64 *n = inflight.lookup(&idx);
+  u32 *buf;
+
+  if (n)
+    __sync_fetch_and_add(n, 1);
+  // Read active again once counted: user space reads the counter after the flip, so it
+  // either sees the program or the program sees the flip
+  buf = active.lookup(&zero);
+  if ((buf ? *buf : 0) == idx)
+    return 1;
+  if (n)
+    __sync_fetch_and_add(n, -1);
+  return 0;
+}
+
+// enter returns the index of the set the current program writes its sample to, counted
+// in inflight until leave. It returns -1 when user space flipped the sets twice in the
+// meantime, the sample being lost.
+static inline int enter(void)
+{
+  int zero = 0;
+  u32 *buf = active.lookup(&zero);
+  u32 idx = buf ? *buf : 0;
+
+  if (enter_set(idx))
+    return idx;
+  if (enter_set(1 - idx))
+    return 1 - idx;
+  count_error(ERR_FLIPPED);
+  return -1;
+}
+
+static inline void leave(u32 idx)
+{
+  u64 *n = inflight.lookup(&idx);
+
+  if (n)
+    __sync_fetch_and_add(n, -1);
+}
+
+// count_stack_error accounts a negative stack id, base being ERR_KERN_EEXIST or ERR_USER_EEXIST
+static inline void count_stack_error(int stackid, int base)
+{
+  switch (stackid) {
+  case -EEXIST:
+    count_error(base);
+    break;
+  case -EFAULT:
+    count_error(base + 1);
+    break;
+  case -ENOMEM:
+    count_error(base + 2);
+    break;
+  default:
+    count_error(base + 3);
+  }
+}
+
+// subsample returns how many events the current one stands for, or 0 if it is skipped
+static inline u32 subsample(void)
+{
+  int zero = 0;
+  u32 *ratio = sampling.lookup(&zero);
+
+  if (!ratio || *ratio <= 1)
+    return 1;
+  if (bpf_get_prandom_u32() % *ratio)
+    return 0;
+  return *ratio;
+}
+
+#ifdef UNWIND_USER
+// The registers of the user code and a copy of the top of its stack, for user space to
+// unwind it with the call frame information of the binaries when they are built without
+// frame pointers. Compiled in with -DUNWIND_USER and -DUSER_STACK_SIZE.
+struct user_regs_t {
+  u64 ip;
+  u64 sp;
+  u64 fp;
+  // Link register, holding the return address of leaf functions on arm64
+  u64 lr;
+  // Size in bytes of the copy, or a negative errno when there is none
+  int stacklen;
+  u32 pad;
+  u8 stack[USER_STACK_SIZE];
+};
+
+// copy_user_stack reads the user registers, saved at the top of the kernel stack of the
+// task whenever it enters the kernel (5.15+), and copies the stack from sp on. Samples
+// taken close to the top of the stack get a smaller copy.
+static inline void copy_user_stack(struct user_regs_t *u)
+{
+  struct task_struct *task = (struct task_struct *)bpf_get_current_task();
+  struct pt_regs *regs;
+  void *mm = NULL;
+
+  u->ip = u->sp = u->fp = u->lr = 0;
+  u->stacklen = -EFAULT;
+  // Kernel threads have no user stack
+  bpf_probe_read_kernel(&mm, sizeof(mm), &task->mm);
+  if (!mm)
+    return;
+  regs = (struct pt_regs *)bpf_task_pt_regs(task);
+#if defined(UNWIND_ARCH_AMD64)
+  bpf_probe_read_kernel(&u->ip, sizeof(u->ip), &regs->ip);
+  bpf_probe_read_kernel(&u->sp, sizeof(u->sp), &regs->sp);
+  bpf_probe_read_kernel(&u->fp, sizeof(u->fp), &regs->bp);
+#elif defined(UNWIND_ARCH_ARM64)
+  bpf_probe_read_kernel(&u->ip, sizeof(u->ip), &regs->pc);
+  bpf_probe_read_kernel(&u->sp, sizeof(u->sp), &regs->sp);
+  bpf_probe_read_kernel(&u->fp, sizeof(u->fp), &regs->regs[29]);
+  bpf_probe_read_kernel(&u->lr, sizeof(u->lr), &regs->regs[30]);
+#endif
+  if (!u->sp)
+    return;
+  if (bpf_probe_read_user(u->stack, USER_STACK_SIZE, (void *)u->sp) == 0) {
+    u->stacklen = USER_STACK_SIZE;
+    return;
+  }
+  if (bpf_probe_read_user(u->stack, USER_STACK_SIZE / 8, (void *)u->sp) == 0)
+    u->stacklen = USER_STACK_SIZE / 8;
+}
+#endif
+
+#ifdef STREAM
+// A single sample, streamed to user space with -stream. Stacks are copied rather than
+// referenced by id, so that they do not outlive the stack map.
+struct event_t {
+  u64 ts;
+  char comm[TASK_COMM_LEN];
+  u32 pid;
+  u32 tid;
+  u32 cpu;
+  // Sizes in bytes of the stacks, or negative errnos when they could not be read
+  int kernlen;
+  int userlen;
+  // Number of events the sample stands for when subsampling
+  u32 ratio;
+  u64 cgroup;
+  u64 goid;
+  u64 labels;
+  u64 weight;
+  u64 kernstack[PERF_MAX_STACK_DEPTH];
+  u64 userstack[PERF_MAX_STACK_DEPTH];
+#ifdef UNWIND_USER
+  struct user_regs_t user;
+#endif
+};
+
+#ifdef USE_RINGBUF
+BPF_RINGBUF_OUTPUT(events, RINGBUF_PAGES);
+#else
+BPF_PERF_OUTPUT(events);
+// Events are too large for the bpf stack, they are built in a per cpu buffer instead
+BPF_PERCPU_ARRAY(scratch, struct event_t, 1);
+#endif
+
+// stream sends the current stacks to user space, returning -1 if both could not be read
+static inline int stream(void *ctx, u32 tgid, u64 weight, u32 ratio)
+{
+  struct event_t *e;
+  int ret = 0;
+#ifdef USE_RINGBUF
+  e = events.ringbuf_reserve(sizeof(struct event_t));
+#else
+  int zero = 0;
+  e = scratch.lookup(&zero);
+#endif
+  if (!e) {
+    count_error(ERR_EVENTS_LOST);
+    return 0;
+  }
+
+  e->ts = bpf_ktime_get_ns();
+  bpf_get_current_comm(&e->comm, sizeof(e->comm));
+  e->pid = tgid;
+  e->tid = bpf_get_current_pid_tgid();
+  e->cpu = bpf_get_smp_processor_id();
+  e->cgroup = bpf_get_current_cgroup_id();
+  e->weight = weight;
+  e->ratio = ratio;
+  e->goid = 0;
+  e->labels = 0;
+  goroutine(tgid, &e->goid, &e->labels);
+  e->kernlen = bpf_get_stack(ctx, e->kernstack, sizeof(e->kernstack), 0);
+  e->userlen = bpf_get_stack(ctx, e->userstack, sizeof(e->userstack), BPF_F_USER_STACK);
+  if (e->kernlen < 0)
+    count_stack_error(e->kernlen, ERR_KERN_EEXIST);
+  if (e->userlen < 0)
+    count_stack_error(e->userlen, ERR_USER_EEXIST);
+  if (e->kernlen < 0 && e->userlen < 0)
+    ret = -1;
+#ifdef UNWIND_USER
+  copy_user_stack(&e->user);
+#endif
+
+#ifdef USE_RINGBUF
+  events.ringbuf_submit(e, 0);
+#else
+  if (events.perf_submit(ctx, e, sizeof(struct event_t)) != 0)
+    count_error(ERR_EVENTS_LOST);
+#endif
+  return ret;
+}
+#endif
+
+// record counts the current stacks along with the weight of the sample, returning -1 if
+// both could not be read. Such samples are still counted, with the negative stack ids
+// telling user space why they were lost. Skipped events are not recorded, the ones
+// recorded instead standing for them.
+static inline int record(void *ctx, u32 tgid, u64 weight)
+{
+  u32 ratio = subsample();
+
+  if (!ratio)
+    return 0;
+  weight *= ratio;
+#ifdef STREAM
+  return stream(ctx, tgid, weight, ratio);
+#else
+  // Zeroed, padding included, for the key to be found again
+  struct key_t key = {};
+  struct value_t *val, first = {ratio, weight};
+  int ret = 0;
+  // Read the index once, so that the stacks and the count land in the same set
+  int idx = enter();
+
+  if (idx < 0)
+    return 0;
+  bpf_get_current_comm(&key.comm, sizeof(key.comm));
+  if (idx) {
+    key.kernstack = stackmap_1.get_stackid(ctx, KERN_STACKID_FLAGS);
+    key.userstack = stackmap_1.get_stackid(ctx, USER_STACKID_FLAGS);
+  } else {
+    key.kernstack = stackmap_0.get_stackid(ctx, KERN_STACKID_FLAGS);
+    key.userstack = stackmap_0.get_stackid(ctx, USER_STACKID_FLAGS);
+  }
+  key.pid = tgid;
+  key.cgroup = bpf_get_current_cgroup_id();
+#ifdef RECORD_CPU
+  key.cpu = bpf_get_smp_processor_id();
+#endif
+  if ((int)key.kernstack < 0)
+    count_stack_error(key.kernstack, ERR_KERN_EEXIST);
+  if ((int)key.userstack < 0)
+    count_stack_error(key.userstack, ERR_USER_EEXIST);
+  if ((int)key.kernstack < 0 && (int)key.userstack < 0)
+    ret = -1;
+
+  if (idx) {
+    val = counts_1.lookup(&key);
+    if (val) {
+      __sync_fetch_and_add(&val->count, ratio);
+      __sync_fetch_and_add(&val->weight, weight);
+    } else if (counts_1.update(&key, &first) != 0)
+      count_error(ERR_COUNTS_FULL);
+    else
+      occupied(1);
+  } else {
+    val = counts_0.lookup(&key);
+    if (val) {
+      __sync_fetch_and_add(&val->count, ratio);
+      __sync_fetch_and_add(&val->weight, weight);
+    } else if (counts_0.update(&key, &first) != 0)
+      count_error(ERR_COUNTS_FULL);
+    else
+      occupied(0);
+  }
+  leave(idx);
+  return ret;
+#endif
+}
+
+// sample_weight returns the number of events a perf sample stands for, e.g. cpu nanoseconds for
+// clocks. The period varies from one sample to the other when sampling at a frequency, and
+// is scaled up when the event was multiplexed with others and only counted part of the time.
+static inline u64 sample_weight(struct bpf_perf_event_data *ctx)
+{
+  struct bpf_perf_event_value value = {};
+  u64 period = ctx->sample_period;
+
+  if (bpf_perf_prog_read_value(ctx, &value, sizeof(value)) != 0)
+    return period;
+  if (value.running == 0 || value.running >= value.enabled)
+    return period;
+  // In 1/1024ths, enabled being in nanoseconds since the event was enabled
+  return period * ((value.enabled << 10) / value.running) >> 10;
+}
+
 int bpf_prog1(struct bpf_perf_event_data *ctx)
 {
-  u32 cpu = bpf_get_smp_processor_id();
   // see https://github.com/iovisor/bcc/blob/master/docs/reference_guide.md#4-bpf_get_current_pid_tgid
   u64 id = bpf_get_current_pid_tgid();
   u32 tgid = id >> 32;
-  u32 pid = id;
-  struct bpf_perf_event_value value_buf;
-  struct key_t key;
-  u64 *val, one = 1;
-  int ret;
 
-  bpf_trace_printk("CPU-%d period %lld ip %llx", cpu, ctx->sample_period,
-                   PT_REGS_IP(&ctx->regs));
+  if (!wanted(tgid))
+    return 0;
+  record(ctx, tgid, sample_weight(ctx));
+  return 0;
+}
 
-  bpf_get_current_comm(&key.comm, sizeof(key.comm));
-  key.kernstack = stackmap.get_stackid(ctx, KERN_STACKID_FLAGS);
-  key.userstack = stackmap.get_stackid(ctx, USER_STACKID_FLAGS);
-  key.pid = tgid;
-  if ((int)key.kernstack < 0 && (int)key.userstack < 0) {
-    bpf_trace_printk("CPU-%d period %lld ip %llx", cpu, ctx->sample_period,
-                     PT_REGS_IP(&ctx->regs));
+// Attached to the tracepoint given with --event tracepoint:<category>:<name>
+int tracepoint_event(void *ctx)
+{
+  u32 tgid = bpf_get_current_pid_tgid() >> 32;
+
+  if (!wanted(tgid))
     return 0;
-  }
+  record(ctx, tgid, 1);
+  return 0;
+}
 
-  ret = bpf_perf_prog_read_value(ctx, (void *)&value_buf, sizeof(struct bpf_perf_event_value));
+// Attached to the kernel function given with --event kprobe:<function>
+int kprobe_event(struct pt_regs *ctx)
+{
+  u32 tgid = bpf_get_current_pid_tgid() >> 32;
 
-  counts.increment(key);
+  if (!wanted(tgid))
+    return 0;
+  record(ctx, tgid, 1);
   return 0;
 }
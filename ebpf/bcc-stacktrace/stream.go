@@ -0,0 +1,324 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/ringbuf"
+	bpf "github.com/iovisor/gobpf/bcc"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/unwind"
+	"golang.org/x/sys/unix"
+)
+
+// ringbufPages is the size of the ring buffer, an event taking about 2KiB
+const ringbufPages = 256
+
+// perfPages is the size of the per cpu perf buffers used on kernels without ring buffers
+const perfPages = 64
+
+// unwindPagesScale scales the buffers up when the events carry a copy of the user stack
+const unwindPagesScale = 4
+
+// maxStreamedSamples is the number of streamed samples kept until the next drain, the ones
+// streamed past it are dropped and counted as events lost
+const maxStreamedSamples = 100000
+
+// sampleSource is where run reads the samples and the errors of every interval from
+type sampleSource interface {
+	drain() []pprof.Sample
+	readErrors() []uint64
+}
+
+// streamEvent is struct event_t of stack_trace.c
+type streamEvent struct {
+	Ts        uint64
+	TaskComm  [bpfmap.TaskCommLen]byte
+	Pid       uint32
+	Tid       uint32
+	Cpu       uint32
+	KernLen   int32
+	UserLen   int32
+	Ratio     uint32
+	CgroupId  uint64
+	Goid      uint64
+	GoLabels  uint64
+	Weight    uint64
+	KernStack bpfmap.Stack
+	UserStack bpfmap.Stack
+}
+
+// useRingbuf tells whether the kernel has ring buffers (5.8+), perf buffers are used otherwise
+func useRingbuf() bool {
+	return features.HaveMapType(ebpf.RingBuf) == nil
+}
+
+// streamFlags compiles stack_trace.c to stream every sample instead of counting them,
+// along with a copy of the user stack when unwinding with unwindFlags
+func streamFlags(unwinding bool) []string {
+	cflags := []string{"-DSTREAM"}
+	if useRingbuf() {
+		pages := ringbufPages
+		if unwinding {
+			pages *= unwindPagesScale
+		}
+		cflags = append(cflags, "-DUSE_RINGBUF", fmt.Sprintf("-DRINGBUF_PAGES=%d", pages))
+	}
+	return cflags
+}
+
+// newSource returns the samples counted in the maps of stack_trace.c, drained early when
+// the counts map holds highWater entries, or the ones it streams if it was compiled with
+// streamFlags, their user stacks being unwound by unwinder and the pprof labels of the
+// goroutines of procs being read if not nil. The function returned stops reading the
+// streamed samples, it must be called before the module is closed.
+func newSource(m *bpf.Module, stream bool, unwinder *unwind.Unwinder, procs *goProcesses, highWater uint64) (sampleSource, func(), error) {
+	if !stream {
+		t := newTables(m)
+		t.watch(highWater, highWaterPoll)
+		return t, func() {}, nil
+	}
+	s, err := newStreamer(m, unwinder, procs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, s.close, nil
+}
+
+// streamer collects the samples streamed by stack_trace.c until they are drained
+type streamer struct {
+	tables *bpfTables
+	// offset turns the monotonic timestamps of the events into times since the epoch
+	offset int64
+	// unwinder unwinds the user stacks copied with the events, with unwindFlags
+	unwinder *unwind.Unwinder
+	// procs are the Go processes whose goroutines' pprof labels are read with the events
+	procs *goProcesses
+	// stop stops the reader of the ring buffer or of the perf buffers
+	stop func()
+
+	mu      sync.Mutex
+	samples []pprof.Sample
+	// Events dropped because the perf buffers or the samples kept until the next drain
+	// were full
+	lost uint64
+	// Memory of the Go processes the labels are read from, until the next drain
+	mems map[uint32]*os.File
+	// Goroutines whose labels could not be read since the previous drain
+	labelFailures int
+}
+
+func newStreamer(m *bpf.Module, unwinder *unwind.Unwinder, procs *goProcesses) (*streamer, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return nil, fmt.Errorf("reading monotonic clock: %w", err)
+	}
+	s := &streamer{
+		tables:   newTables(m),
+		offset:   time.Now().UnixNano() - ts.Nano(),
+		unwinder: unwinder,
+		procs:    procs,
+		mems:     map[uint32]*os.File{},
+	}
+	events := bpf.NewTable(m.TableId("events"), m)
+
+	if useRingbuf() {
+		// The reader owns the fd it is given, bcc keeps its own
+		fd, err := unix.FcntlInt(uintptr(events.Config()["fd"].(int)), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("duplicating ring buffer fd: %w", err)
+		}
+		rb, err := ebpf.NewMapFromFD(fd)
+		if err != nil {
+			return nil, fmt.Errorf("opening ring buffer: %w", err)
+		}
+		rd, err := ringbuf.NewReader(rb)
+		if err != nil {
+			return nil, fmt.Errorf("reading ring buffer: %w", err)
+		}
+		s.stop = func() {
+			if err := rd.Close(); err != nil {
+				log.Printf("Failed to close the ring buffer: %v", err)
+			}
+		}
+		go func() {
+			for {
+				record, err := rd.Read()
+				if err != nil {
+					if !errors.Is(err, ringbuf.ErrClosed) {
+						log.Printf("Failed to read ring buffer: %v", err)
+					}
+					return
+				}
+				s.add(record.RawSample)
+			}
+		}()
+		return s, nil
+	}
+
+	received := make(chan []byte, 1024)
+	lost := make(chan uint64)
+	pages := perfPages
+	if unwinder != nil {
+		pages *= unwindPagesScale
+	}
+	pm, err := bpf.InitPerfMapWithPageCnt(events, received, lost, pages)
+	if err != nil {
+		return nil, fmt.Errorf("opening perf buffers: %w", err)
+	}
+	pm.Start()
+	done := make(chan struct{})
+	s.stop = func() {
+		// The poller is stopped first, it may be blocked sending what it received
+		pm.Stop()
+		close(done)
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case data := <-received:
+				s.add(data)
+			case n := <-lost:
+				s.mu.Lock()
+				s.lost += n
+				s.mu.Unlock()
+			}
+		}
+	}()
+	return s, nil
+}
+
+// close stops reading the streamed samples
+func (s *streamer) close() {
+	s.stop()
+}
+
+func (s *streamer) add(data []byte) {
+	s.mu.Lock()
+	full := len(s.samples) >= maxStreamedSamples
+	if full {
+		s.lost++
+	}
+	s.mu.Unlock()
+	if full {
+		return
+	}
+
+	var e streamEvent
+	r := bytes.NewReader(data)
+	if err := binary.Read(r, bpfmap.NativeEndian, &e); err != nil {
+		log.Printf("decoding event: %v", err)
+		return
+	}
+	sample := pprof.Sample{
+		Pid:       e.Pid,
+		Comm:      string(bytes.TrimRight(e.TaskComm[:], "\x00")),
+		KernStack: streamedStack(e.KernStack[:], e.KernLen),
+		UserStack: streamedStack(e.UserStack[:], e.UserLen),
+		Count:     uint64(e.Ratio),
+		Weight:    e.Weight,
+		Time:      int64(e.Ts) + s.offset,
+		Tid:       e.Tid,
+		Cpu:       e.Cpu,
+		CgroupId:  e.CgroupId,
+		Goid:      e.Goid,
+		GoLabels:  e.GoLabels,
+	}
+	// Errors of bpf_get_stack are reported the same way as the ones of bpf_get_stackid
+	if e.KernLen < 0 {
+		sample.KernStackId = e.KernLen
+	}
+	if e.UserLen < 0 {
+		sample.UserStackId = e.UserLen
+	}
+	if s.unwinder != nil {
+		if err := unwindSample(s.unwinder, r, &sample); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+
+	s.mu.Lock()
+	// Read right away, before the goroutine changes its labels or exits
+	if s.procs != nil && e.Goid != 0 && e.GoLabels != 0 {
+		s.readLabels(&sample)
+	}
+	s.samples = append(s.samples, sample)
+	s.mu.Unlock()
+	samplesCollected.Add(float64(sample.Count))
+}
+
+// readLabels reads the pprof labels of the goroutine of the sample. Must be called with
+// mu held.
+func (s *streamer) readLabels(sample *pprof.Sample) {
+	o := s.procs.offsets(sample.Pid)
+	if o == nil {
+		return
+	}
+	labels, err := readGoLabels(s.mems, sample.Pid, sample.GoLabels, o.Format)
+	if err != nil {
+		s.labelFailures++
+		return
+	}
+	sample.GoroutineLabels = labels
+}
+
+// streamedStack returns the addresses of a stack copied by bpf_get_stack, size being in bytes
+func streamedStack(stack []uint64, size int32) []uint64 {
+	if size <= 0 {
+		return nil
+	}
+	n := int(size) / 8
+	if n > len(stack) {
+		n = len(stack)
+	}
+	return append([]uint64(nil), stack[:n]...)
+}
+
+// drain returns the samples streamed since the previous drain
+func (s *streamer) drain() []pprof.Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	samples := s.samples
+	s.samples = nil
+	for pid, mem := range s.mems {
+		mem.Close()
+		delete(s.mems, pid)
+	}
+	if s.labelFailures > 0 {
+		log.Printf("Failed to read the pprof labels of %d goroutines", s.labelFailures)
+		s.labelFailures = 0
+	}
+	// Processes map libraries, exit and their pids are reused in between
+	if s.unwinder != nil {
+		s.unwinder.Forget()
+	}
+	return samples
+}
+
+// readErrors returns the errors of the bpf program, along with the events lost in the
+// perf buffers since the previous read
+func (s *streamer) readErrors() []uint64 {
+	deltas := s.tables.readErrors()
+	s.mu.Lock()
+	lost := s.lost
+	s.lost = 0
+	s.mu.Unlock()
+	deltas[errEventsLost] += lost
+	bpfErrors.Add(errorNames[errEventsLost], int64(lost))
+	samplesDropped.WithLabelValues(errorNames[errEventsLost]).Add(float64(lost))
+	return deltas
+}
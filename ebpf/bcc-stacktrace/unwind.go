@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/pprof"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/unwind"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// unwindStackSize is how much of the user stack is copied with every sample with
+// -dwarf-unwind, making the events about 5 times larger
+const unwindStackSize = 8192
+
+var unwound = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "bcc_stacktrace_unwound_total",
+	Help: "User stacks unwound with the call frame information of the binaries, by result: deeper than with the frame pointers, or not.",
+}, []string{"result"})
+
+// unwindArch returns the registers stack_trace.c reads on this architecture
+func unwindArch() (unwind.Arch, string, error) {
+	switch runtime.GOARCH {
+	case "amd64":
+		return unwind.AMD64, "-DUNWIND_ARCH_AMD64", nil
+	case "arm64":
+		return unwind.ARM64, "-DUNWIND_ARCH_ARM64", nil
+	}
+	return unwind.Arch{}, "", fmt.Errorf("unwinding is not supported on %s", runtime.GOARCH)
+}
+
+// unwindFlags compiles the copy of the user registers and stack into the streamed events
+func unwindFlags() ([]string, error) {
+	_, flag, err := unwindArch()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-DUNWIND_USER", fmt.Sprintf("-DUSER_STACK_SIZE=%d", unwindStackSize), flag}, nil
+}
+
+// newUnwinder unwinds the stacks copied with unwindFlags
+func newUnwinder() (*unwind.Unwinder, error) {
+	arch, _, err := unwindArch()
+	if err != nil {
+		return nil, err
+	}
+	return unwind.NewUnwinder(arch), nil
+}
+
+// userRegs is struct user_regs_t of stack_trace.c, without the copy of the stack
+type userRegs struct {
+	Ip       uint64
+	Sp       uint64
+	Fp       uint64
+	Lr       uint64
+	StackLen int32
+	Pad      uint32
+}
+
+// unwindSample reads the registers and the stack following the event, and replaces the
+// user stack of the sample with the one unwound if it is deeper, e.g. as the binary was
+// built without frame pointers
+func unwindSample(u *unwind.Unwinder, r io.Reader, sample *pprof.Sample) error {
+	var regs userRegs
+	if err := binary.Read(r, bpfmap.NativeEndian, &regs); err != nil {
+		return fmt.Errorf("decoding user registers: %w", err)
+	}
+	stack := make([]byte, unwindStackSize)
+	if _, err := io.ReadFull(r, stack); err != nil {
+		return fmt.Errorf("decoding user stack: %w", err)
+	}
+	if regs.StackLen <= 0 {
+		return nil
+	}
+	if int(regs.StackLen) < len(stack) {
+		stack = stack[:regs.StackLen]
+	}
+
+	frames := u.Unwind(sample.Pid, unwind.Regs{IP: regs.Ip, SP: regs.Sp, FP: regs.Fp, LR: regs.Lr}, stack)
+	if len(frames) <= len(sample.UserStack) {
+		unwound.WithLabelValues("same").Inc()
+		return nil
+	}
+	unwound.WithLabelValues("deeper").Inc()
+	sample.UserStack = frames
+	sample.UserStackId = 0
+	return nil
+}
@@ -1,6 +1,6 @@
 // Code generated by bpf2go; DO NOT EDIT.
-//go:build 386 || amd64 || amd64p32 || arm || arm64 || mips64le || mips64p32le || mipsle || ppc64le || riscv64
-// +build 386 amd64 amd64p32 arm arm64 mips64le mips64p32le mipsle ppc64le riscv64
+//go:build arm64
+// +build arm64
 
 package main
 
@@ -28,9 +28,9 @@ func loadBpf() (*ebpf.CollectionSpec, error) {
 //
 // The following types are suitable as obj argument:
 //
-//     *bpfObjects
-//     *bpfPrograms
-//     *bpfMaps
+//	*bpfObjects
+//	*bpfPrograms
+//	*bpfMaps
 //
 // See ebpf.CollectionSpec.LoadAndAssign documentation for details.
 func loadBpfObjects(obj interface{}, opts *ebpf.CollectionOptions) error {
@@ -61,8 +61,11 @@ type bpfProgramSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
-	Counts   *ebpf.MapSpec `ebpf:"counts"`
-	Stackmap *ebpf.MapSpec `ebpf:"stackmap"`
+	Counts        *ebpf.MapSpec `ebpf:"counts"`
+	Filtering     *ebpf.MapSpec `ebpf:"filtering"`
+	Stackmap      *ebpf.MapSpec `ebpf:"stackmap"`
+	TargetCgroups *ebpf.MapSpec `ebpf:"target_cgroups"`
+	TargetPids    *ebpf.MapSpec `ebpf:"target_pids"`
 }
 
 // bpfObjects contains all objects after they have been loaded into the kernel.
@@ -84,14 +87,20 @@ func (o *bpfObjects) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
-	Counts   *ebpf.Map `ebpf:"counts"`
-	Stackmap *ebpf.Map `ebpf:"stackmap"`
+	Counts        *ebpf.Map `ebpf:"counts"`
+	Filtering     *ebpf.Map `ebpf:"filtering"`
+	Stackmap      *ebpf.Map `ebpf:"stackmap"`
+	TargetCgroups *ebpf.Map `ebpf:"target_cgroups"`
+	TargetPids    *ebpf.Map `ebpf:"target_pids"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
 		m.Counts,
+		m.Filtering,
 		m.Stackmap,
+		m.TargetCgroups,
+		m.TargetPids,
 	)
 }
 
@@ -118,5 +127,6 @@ func _BpfClose(closers ...io.Closer) error {
 }
 
 // Do not access this directly.
-//go:embed bpf_bpfel.o
+//
+//go:embed bpf_bpfel_arm64.o
 var _BpfBytes []byte
@@ -1,5 +1,6 @@
-//go:build linux
+//go:build linux && (386 || amd64 || arm64 || s390x)
 // +build linux
+// +build 386 amd64 arm64 s390x
 
 // This program demonstrates attaching an eBPF program to a kernel symbol.
 // The eBPF program will be attached to the start of the sys_execve
@@ -8,33 +9,51 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 	"unsafe"
 
+	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/rlimit"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/bpfmap"
+	"github.com/pendoragon/code/ebpf/bcc-stacktrace/pkg/target"
 	"golang.org/x/sys/unix"
 )
 
 // $BPF_CLANG and $BPF_CFLAGS are set by the Makefile.
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang-14 -cflags "-O2 -Wall -g -Werror -D__TARGET_ARCH_x86" bpf perfevent.c -- -I../headers
-
-const TASK_COMM_LEN int = 16
-const MAX_STACK_DEPTH int = 127
+// An object is generated per architecture, bpf2go setting __TARGET_ARCH_xxx for the
+// PT_REGS macros and the kernel types of headers/vmlinux.h. s390x is the only big endian
+// one supported, its object is the bpfeb one: bpf2go would name it _s390.go, which
+// builds on s390 only. The bpfeb bindings then build on every big endian architecture,
+// this file only on the supported ones, see unsupported.go.
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang-14 -cflags "-O2 -Wall -g -Werror" -target amd64,arm64 bpf perfevent.c -- -I../headers
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang-14 -cflags "-O2 -Wall -g -Werror -D__TARGET_ARCH_s390" -target bpfeb bpf perfevent.c -- -I../headers
 
+// countsMapKey is struct key_t of perfevent.c
 type countsMapKey struct {
-	TaskComm    [TASK_COMM_LEN]byte
+	TaskComm    [bpfmap.TaskCommLen]byte
 	KernStackId int32
 	UserStackId int32
 }
 
-type callStack [MAX_STACK_DEPTH]uint64
-
 func main() {
-	target_pid := flag.Int("pid", -1, "PID of the process whose stack traces will be collected. Default to -1, i.e. all processes")
+	pids := flag.String("pid", "", "Comma separated PIDs of the processes whose stack traces will be collected. Default to all processes")
+	cgroups := flag.String("cgroup", "", "Comma separated cgroup v2 directories whose processes, and the ones of their descendants, will be profiled. Default to none")
+	verbose := flag.Bool("v", false, "Log the addresses of every stack counted, every second. Default to only the number of stacks and samples")
 	flag.Parse()
 
+	sel, err := target.NewSelector(*pids, *cgroups, "", "")
+	if err != nil {
+		log.Fatalf("Failed to parse the targets: %v", err)
+	}
+
 	// Allow the current process to lock memory for eBPF resources.
 	if err := rlimit.RemoveMemlock(); err != nil {
 		log.Fatal(err)
@@ -46,32 +65,49 @@ func main() {
 	}
 	defer objs.Close()
 
-	fd, err := unix.PerfEventOpen(
-		&unix.PerfEventAttr{
-			Type:   unix.PERF_TYPE_SOFTWARE,
-			Config: unix.PERF_COUNT_SW_CPU_CLOCK,
-			Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
-			Sample: 100,
-			Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
-		},
-		*target_pid,
-		-1,
-		-1,
-		unix.PERF_FLAG_FD_CLOEXEC,
-	)
-	if err != nil {
-		log.Fatalf("opening perf event: %v", err)
+	if !sel.All() {
+		if err := updateTargets(&objs, sel); err != nil {
+			log.Fatalf("updating targets: %v", err)
+		}
+		if err := objs.Filtering.Put(uint32(0), uint32(1)); err != nil {
+			log.Fatalf("enabling target filtering: %v", err)
+		}
 	}
 
-	// err = attachPerfEvent(fd, objs.BpfProg1)
-	err = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, objs.BpfProg1.FD())
+	// The perf event is opened system wide on each cpu, the program filters the targets,
+	// which can then change without opening the events again
+	cpus, err := onlineCPUs()
 	if err != nil {
-		log.Fatalf("attaching perf event: %v", err)
+		log.Fatalf("listing online cpus: %v", err)
 	}
+	for _, cpu := range cpus {
+		fd, err := unix.PerfEventOpen(
+			&unix.PerfEventAttr{
+				Type:   unix.PERF_TYPE_SOFTWARE,
+				Config: unix.PERF_COUNT_SW_CPU_CLOCK,
+				Size:   uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+				Sample: 100,
+				Bits:   unix.PerfBitDisabled | unix.PerfBitFreq,
+			},
+			-1,
+			cpu,
+			-1,
+			unix.PERF_FLAG_FD_CLOEXEC,
+		)
+		if err != nil {
+			log.Fatalf("opening perf event on cpu %d: %v", cpu, err)
+		}
+		defer unix.Close(fd)
 
-	err = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0)
-	if err != nil {
-		log.Fatalf("enable perf event: %v", err)
+		err = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, objs.BpfProg1.FD())
+		if err != nil {
+			log.Fatalf("attaching perf event: %v", err)
+		}
+
+		err = unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0)
+		if err != nil {
+			log.Fatalf("enable perf event: %v", err)
+		}
 	}
 
 	// Read loop reporting the total amount of times the kernel
@@ -80,40 +116,142 @@ func main() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		itCounts := objs.Counts.Iterate()
-		var countsKey countsMapKey
-		var countsValue uint64
+		// Descendant cgroups may have been created since
+		if !sel.All() {
+			if err := updateTargets(&objs, sel); err != nil {
+				log.Printf("Failed to update targets: %v", err)
+			}
+		}
 
-		for itCounts.Next(&countsKey, &countsValue) {
-			log.Println("==============================================================================================================")
-			log.Printf("kernel stack id: %v; user stack id: %v; seen times: %d", countsKey.KernStackId, countsKey.UserStackId, countsValue)
+		// The maps are decoded like the ones of bcc-stacktrace, in the byte order of the host
+		itCounts := objs.Counts.Iterate()
+		var key, value []byte
 
-			var userStack, kernStack callStack
-			err := objs.Stackmap.Lookup(&countsKey.KernStackId, &kernStack)
-			if err != nil {
-				log.Printf("Failed to lookup kernel stack with id: %d, %v", countsKey.KernStackId, err)
+		var stacks, samples uint64
+		for itCounts.Next(&key, &value) {
+			var countsKey countsMapKey
+			if err := binary.Read(bytes.NewReader(key), bpfmap.NativeEndian, &countsKey); err != nil {
+				log.Printf("decoding counts map key: %v", err)
+				continue
 			}
-
-			err = objs.Stackmap.Lookup(&countsKey.UserStackId, &userStack)
-			if err != nil {
-				log.Printf("Failed to lookup user stack with id: %d, %v", countsKey.UserStackId, err)
+			count := bpfmap.NativeEndian.Uint64(value)
+			stacks++
+			samples += count
+			if !*verbose {
+				continue
 			}
+			log.Println("==============================================================================================================")
+			log.Printf("kernel stack id: %v; user stack id: %v; seen times: %d", countsKey.KernStackId, countsKey.UserStackId, count)
 
 			// print stack
 			log.Println("Kernel stack:")
-			for _, addr := range kernStack {
-				if addr != uint64(0) {
-					log.Printf("\t0x%x", addr)
-				}
+			for _, addr := range lookupStack(&objs, countsKey.KernStackId, "kernel") {
+				log.Printf("\t0x%x", addr)
 			}
 			log.Println("User stack:")
-			for _, addr := range userStack {
-				if addr != uint64(0) {
-					log.Printf("\t0x%x", addr)
-				}
+			for _, addr := range lookupStack(&objs, countsKey.UserStackId, "user") {
+				log.Printf("\t0x%x", addr)
 			}
 
 			log.Println("==============================================================================================================")
 		}
+		if err := itCounts.Err(); err != nil {
+			log.Printf("Failed to iterate counts map: %v", err)
+		}
+		log.Printf("%d stacks counted, seen %d times", stacks, samples)
+	}
+}
+
+// lookupStack returns the addresses of a stack of the stack map, without the zero padding
+func lookupStack(objs *bpfObjects, stackId int32, kind string) []uint64 {
+	// Negative ids are the errors of bpf_get_stackid
+	if stackId < 0 {
+		return nil
+	}
+	value, err := objs.Stackmap.LookupBytes(bpfmap.Native.StackKey(stackId))
+	if err == nil && value == nil {
+		err = ebpf.ErrKeyNotExist
+	}
+	if err != nil {
+		log.Printf("Failed to lookup %s stack with id: %d, %v", kind, stackId, err)
+		return nil
+	}
+	addrs, err := bpfmap.Native.DecodeStack(value)
+	if err != nil {
+		log.Printf("decoding %s stack %d: %v", kind, stackId, err)
+	}
+	return addrs
+}
+
+// updateTargets makes the target maps hold the processes and cgroups selected
+func updateTargets(objs *bpfObjects, sel *target.Selector) error {
+	pids, cgroups, err := sel.Discover()
+	if err != nil {
+		return err
+	}
+	// Deleting while iterating may restart the iteration, stale keys are removed after
+	var stalePids []uint32
+	var staleCgroups []uint64
+	var pid uint32
+	var id uint64
+	var value uint8
+	for it := objs.TargetPids.Iterate(); it.Next(&pid, &value); {
+		if !pids[pid] {
+			stalePids = append(stalePids, pid)
+		}
+	}
+	for it := objs.TargetCgroups.Iterate(); it.Next(&id, &value); {
+		if !cgroups[id] {
+			staleCgroups = append(staleCgroups, id)
+		}
+	}
+	for _, pid := range stalePids {
+		if err := objs.TargetPids.Delete(pid); err != nil {
+			return fmt.Errorf("removing target pid %d: %w", pid, err)
+		}
+	}
+	for _, id := range staleCgroups {
+		if err := objs.TargetCgroups.Delete(id); err != nil {
+			return fmt.Errorf("removing target cgroup %d: %w", id, err)
+		}
+	}
+
+	one := uint8(1)
+	for pid := range pids {
+		if err := objs.TargetPids.Put(pid, one); err != nil {
+			return fmt.Errorf("adding target pid %d: %w", pid, err)
+		}
+	}
+	for id := range cgroups {
+		if err := objs.TargetCgroups.Put(id, one); err != nil {
+			return fmt.Errorf("adding target cgroup %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// onlineCPUs parses the cpu list of /sys/devices/system/cpu/online, e.g. 0-3,6
+func onlineCPUs() ([]int, error) {
+	buf, err := ioutil.ReadFile("/sys/devices/system/cpu/online")
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, r := range strings.Split(strings.TrimSpace(string(buf)), ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpu range %q", r)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid cpu range %q", r)
+			}
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
 	}
+	return cpus, nil
 }
@@ -40,43 +40,64 @@ struct {
 	__uint(max_entries, 10000);
 } stackmap SEC(".maps");
 
+// Processes and cgroups profiled, filled from user space. Both empty means all processes.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__type(key, u32);
+	__type(value, u8);
+	__uint(max_entries, 10240);
+} target_pids SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__type(key, u64);
+	__type(value, u8);
+	__uint(max_entries, 10240);
+} target_cgroups SEC(".maps");
+
+// Set to 1 by user space when the target maps are to be checked
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__type(key, u32);
+	__type(value, u32);
+	__uint(max_entries, 1);
+} filtering SEC(".maps");
+
+static __always_inline int wanted(void)
+{
+	u32 zero = 0, tgid = bpf_get_current_pid_tgid() >> 32;
+	u64 cgroup;
+	u32 *on;
+
+	on = bpf_map_lookup_elem(&filtering, &zero);
+	if (!on || !*on)
+		return 1;
+	if (bpf_map_lookup_elem(&target_pids, &tgid))
+		return 1;
+	cgroup = bpf_get_current_cgroup_id();
+	return bpf_map_lookup_elem(&target_cgroups, &cgroup) != NULL;
+}
+
 #define KERN_STACKID_FLAGS (0 | BPF_F_FAST_STACK_CMP)
 #define USER_STACKID_FLAGS (0 | BPF_F_FAST_STACK_CMP | BPF_F_USER_STACK)
 
 SEC("perf_event")
 int bpf_prog1(struct bpf_perf_event_data *ctx)
 {
-	char time_fmt1[] = "Time Enabled: %llu, Time Running: %llu";
-	char time_fmt2[] = "Get Time Failed, ErrCode: %d";
-	char addr_fmt[] = "Address recorded on event: %llx";
-	char fmt[] = "CPU-%d period %lld ip %llx";
-	u32 cpu = bpf_get_smp_processor_id();
-	struct bpf_perf_event_value value_buf;
 	struct key_t key;
 	u64 *val, one = 1;
-	int ret;
 
 	if (ctx->sample_period < 10000)
 		/* ignore warmup */
 		return 0;
+	if (!wanted())
+		return 0;
 
 	bpf_get_current_comm(&key.comm, sizeof(key.comm));
 	key.kernstack = bpf_get_stackid(ctx, &stackmap, KERN_STACKID_FLAGS);
 	key.userstack = bpf_get_stackid(ctx, &stackmap, USER_STACKID_FLAGS);
-	if ((int)key.kernstack < 0 && (int)key.userstack < 0) {
-		bpf_trace_printk(fmt, sizeof(fmt), cpu, ctx->sample_period,
-				 PT_REGS_IP(&ctx->regs));
+	if ((int)key.kernstack < 0 && (int)key.userstack < 0)
 		return 0;
-	}
-
-	ret = bpf_perf_prog_read_value(ctx, (void *)&value_buf, sizeof(struct bpf_perf_event_value));
-	if (!ret)
-	  bpf_trace_printk(time_fmt1, sizeof(time_fmt1), value_buf.enabled, value_buf.running);
-	else
-	  bpf_trace_printk(time_fmt2, sizeof(time_fmt2), ret);
-
-	if (ctx->addr != 0)
-	  bpf_trace_printk(addr_fmt, sizeof(addr_fmt), ctx->addr);
 
 	val = bpf_map_lookup_elem(&counts, &key);
 	if (val)
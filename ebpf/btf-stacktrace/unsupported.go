@@ -0,0 +1,12 @@
+//go:build !linux || !(386 || amd64 || arm64 || s390x)
+// +build !linux !386,!amd64,!arm64,!s390x
+
+package main
+
+import "log"
+
+// The bpf program is only compiled for the architectures of the go:generate lines of
+// main.go, e.g. the bpfeb object reads the registers of s390x
+func main() {
+	log.Fatalf("btf-stacktrace only runs on linux, on amd64, arm64 or s390x")
+}
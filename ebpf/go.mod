@@ -6,5 +6,23 @@ require (
 	github.com/cilium/ebpf v0.8.1
 	github.com/google/pprof v0.0.0-20220509035851-59ca7ad80af3
 	github.com/iovisor/gobpf v0.2.0
-	golang.org/x/sys v0.1.0
+	github.com/prometheus/client_golang v1.12.2
+	golang.org/x/sys v0.6.0
+	google.golang.org/grpc v1.47.0
+	k8s.io/kubelet v0.24.17
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	golang.org/x/net v0.8.0 // indirect
+	golang.org/x/text v0.8.0 // indirect
+	google.golang.org/genproto v0.0.0-20220107163113-42d7afdf6368 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
 )